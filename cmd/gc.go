@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/RedHatInsights/valpop/impl"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// GC CMD
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "removes expired releases",
+	Long:  "removes the releases of --prefix, or of every prefix when it is not set, that the retention policy expires, the same cleanup populate runs after each upload",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		timeout, minAssetRecords, err := retentionPolicy()
+		if err != nil {
+			return err
+		}
+
+		maxDeletions := viper.GetInt("max-deletions")
+		if maxDeletions < 0 {
+			return fmt.Errorf("max-deletions must be a non-negative integer")
+		}
+		orphanGrace := viper.GetInt64("orphan-grace")
+		if orphanGrace < 0 {
+			return fmt.Errorf("orphan-grace must be a non-negative integer")
+		}
+
+		backend, err := newBackend()
+		if err != nil {
+			return err
+		}
+
+		defer backend.Close()
+		prefixes := []string{viper.GetString("prefix")}
+		if prefixes[0] == "" {
+			prefixes, err = backend.Prefixes()
+			if err != nil {
+				return err
+			}
+		}
+
+		report, gcErr := runGC(backend, prefixes, impl.GCOptions{
+			Timeout:         timeout,
+			MinAssetRecords: minAssetRecords,
+			MaxDeletions:    maxDeletions,
+			DryRun:          viper.GetBool("dry-run"),
+			Orphans:         viper.GetBool("orphans"),
+			OrphanGrace:     orphanGrace,
+		})
+		err = printResult(cmd.OutOrStdout(), report)
+		if err != nil {
+			return err
+		}
+		return gcErr
+	},
+}
+
+// runGC collects garbage from every prefix. A prefix that fails, for example by
+// exceeding the deletion cap, does not stop the others; its error is returned
+// once all prefixes have been processed
+func runGC(backend impl.Backend, prefixes []string, opts impl.GCOptions) (impl.GCReport, error) {
+	report := impl.GCReport{}
+	errs := []error{}
+	for _, prefix := range prefixes {
+		result, err := backend.GC(prefix, opts)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("gc of %s failed: %w", prefix, err))
+			continue
+		}
+		report = append(report, result)
+	}
+	return report, errors.Join(errs...)
+}
+
+func init() {
+	gcCmd.Flags().Int("max-deletions", 0, "Refuse to delete more than this many keys from a prefix, 0 for no cap")
+	gcCmd.Flags().Bool("orphans", false, "Also remove data keys no retained manifest references")
+	gcCmd.Flags().Int64("orphan-grace", 86400, "Seconds an unreferenced data key is kept before --orphans removes it")
+	viper.BindPFlag("max-deletions", gcCmd.Flags().Lookup("max-deletions"))
+	viper.BindPFlag("orphans", gcCmd.Flags().Lookup("orphans"))
+	viper.BindPFlag("orphan-grace", gcCmd.Flags().Lookup("orphan-grace"))
+	rootCmd.AddCommand(gcCmd)
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+
+	"github.com/RedHatInsights/valpop/impl"
+	"github.com/RedHatInsights/valpop/impl/mock"
+)
+
+var _ = Describe("GC Command", func() {
+	BeforeEach(func() {
+		viper.Reset()
+	})
+
+	It("should validate min-asset-records is non-negative", func() {
+		viper.Set("mode", "s3")
+		viper.Set("min-asset-records", -1)
+
+		err := gcCmd.RunE(gcCmd, []string{})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("min-asset-records must be a non-negative integer"))
+	})
+
+	It("should validate max-deletions is non-negative", func() {
+		viper.Set("mode", "s3")
+		viper.Set("max-deletions", -1)
+
+		err := gcCmd.RunE(gcCmd, []string{})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("max-deletions must be a non-negative integer"))
+	})
+
+	It("should validate orphan-grace is non-negative", func() {
+		viper.Set("mode", "s3")
+		viper.Set("orphan-grace", -1)
+
+		err := gcCmd.RunE(gcCmd, []string{})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("orphan-grace must be a non-negative integer"))
+	})
+
+	Context("runGC", func() {
+		var backend *mock.S3Service
+
+		BeforeEach(func() {
+			backend = mock.NewS3Service()
+			small := impl.NewGCResult("small", false)
+			small.Add("data/small/old.js", 100)
+			large := impl.NewGCResult("large", false)
+			large.Add("data/large/a.js", 100)
+			large.Add("data/large/b.js", 200)
+			backend.GCResults["small"] = small
+			backend.GCResults["large"] = large
+		})
+
+		It("should report every prefix", func() {
+			report, err := runGC(backend, []string{"small", "large"}, impl.GCOptions{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(report).To(HaveLen(2))
+			Expect(report.String()).To(HaveSuffix("Reclaimed 400 bytes from 3 keys in 2 prefixes\n"))
+		})
+
+		It("should keep going when a prefix exceeds the deletion cap", func() {
+			report, err := runGC(backend, []string{"large", "small"}, impl.GCOptions{MaxDeletions: 1})
+			Expect(errors.Is(err, impl.ErrDeletionCap)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("gc of large failed"))
+			Expect(report).To(HaveLen(1))
+			Expect(report[0].Prefix).To(Equal("small"))
+		})
+
+		It("should report what a dry run would remove", func() {
+			report, err := runGC(backend, []string{"large"}, impl.GCOptions{MaxDeletions: 1, DryRun: true})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(report.String()).To(HavePrefix("large: would remove 2 keys (300 bytes)\n"))
+			Expect(report.String()).To(HaveSuffix("Would reclaim 300 bytes from 2 keys in 1 prefixes\n"))
+		})
+	})
+})
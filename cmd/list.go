@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/RedHatInsights/valpop/impl"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// List CMD
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "lists the stored releases",
+	Long:  "lists the releases stored for --prefix, or for every prefix when it is not set, marking the one being served and those the retention policy would remove",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		timeout, minAssetRecords, err := retentionPolicy()
+		if err != nil {
+			return err
+		}
+
+		backend, err := newBackend()
+		if err != nil {
+			return err
+		}
+
+		defer backend.Close()
+		prefixes := []string{viper.GetString("prefix")}
+		if prefixes[0] == "" {
+			prefixes, err = backend.Prefixes()
+			if err != nil {
+				return err
+			}
+		}
+
+		releases := impl.ReleaseList{}
+		now := time.Now().Unix()
+		for _, prefix := range prefixes {
+			manifests, err := backend.Manifests(prefix)
+			if err != nil {
+				return err
+			}
+			current, err := backend.Current(prefix)
+			if err != nil {
+				return err
+			}
+			releases = append(releases, impl.DescribeReleases(prefix, manifests, current, now, timeout, minAssetRecords)...)
+		}
+		return printResult(cmd.OutOrStdout(), releases)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(listCmd)
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+
+	"github.com/RedHatInsights/valpop/impl"
+	"github.com/RedHatInsights/valpop/impl/mock"
+)
+
+var _ = Describe("List Command", func() {
+	BeforeEach(func() {
+		viper.Reset()
+	})
+
+	It("should validate min-asset-records is non-negative", func() {
+		viper.Set("mode", "s3")
+		viper.Set("min-asset-records", -1)
+
+		err := listCmd.RunE(listCmd, []string{})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("min-asset-records must be a non-negative integer"))
+	})
+
+	It("should mark the release the current pointer serves", func() {
+		backend := mock.NewS3Service()
+		for _, timestamp := range []int64{1000, 2000, 3000} {
+			backend.StoredManifests[impl.MakeManifestKey("test", timestamp)] = impl.Manifest{Timestamp: timestamp}
+		}
+		backend.CurrentReleases["test"] = 2000
+		useBackend(backend)
+		out := &bytes.Buffer{}
+		listCmd.SetOut(out)
+		DeferCleanup(func() {
+			listCmd.SetOut(nil)
+		})
+		viper.Set("prefix", "test")
+		viper.Set("timeout", 30)
+		viper.Set("min-asset-records", 1)
+		viper.Set("json", true)
+
+		Expect(listCmd.RunE(listCmd, []string{})).To(Succeed())
+		releases := impl.ReleaseList{}
+		Expect(json.Unmarshal(out.Bytes(), &releases)).To(Succeed())
+		Expect(releases).To(HaveLen(3))
+		for _, release := range releases {
+			Expect(release.Latest).To(Equal(release.Timestamp == 2000), "release %d", release.Timestamp)
+			if release.Timestamp == 2000 {
+				Expect(release.Expiring).To(BeFalse())
+			}
+		}
+	})
+})
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/RedHatInsights/valpop/impl"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Locks CMD
+var locksCmd = &cobra.Command{
+	Use:   "locks",
+	Short: "lists populate locks",
+	Long:  "lists the populate locks of --prefix, or of every prefix when it is not set; --clear removes the stale ones left by crashed populates",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		backend, err := newBackend()
+		if err != nil {
+			return err
+		}
+
+		defer backend.Close()
+		locks, err := backend.Locks(viper.GetString("prefix"))
+		if err != nil {
+			return err
+		}
+		if viper.GetBool("clear") {
+			return clearStaleLocks(cmd.OutOrStdout(), backend, locks, time.Now().Unix())
+		}
+		return printResult(cmd.OutOrStdout(), impl.LockList(locks))
+	},
+}
+
+// clearStaleLocks removes the locks whose lease ended before now; held locks
+// are left alone so a running populate is never disturbed
+func clearStaleLocks(w io.Writer, backend impl.Backend, locks []impl.Lock, now int64) error {
+	cleared := 0
+	for _, lock := range locks {
+		if !lock.Expired(now) {
+			continue
+		}
+		err := backend.ClearLock(lock)
+		if err != nil {
+			return err
+		}
+		cleared++
+	}
+	fmt.Fprintf(w, "Cleared %d stale lock(s)\n", cleared)
+	return nil
+}
+
+func init() {
+	locksCmd.Flags().Bool("clear", false, "Remove stale locks left by crashed populates")
+	viper.BindPFlag("clear", locksCmd.Flags().Lookup("clear"))
+	rootCmd.AddCommand(locksCmd)
+}
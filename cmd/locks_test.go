@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"bytes"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+
+	"github.com/RedHatInsights/valpop/impl"
+	"github.com/RedHatInsights/valpop/impl/mock"
+)
+
+var _ = Describe("Locks Command", func() {
+	BeforeEach(func() {
+		viper.Reset()
+	})
+
+	It("should reject an unknown mode", func() {
+		viper.Set("mode", "memcached")
+
+		err := locksCmd.RunE(locksCmd, []string{})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("memcached"))
+	})
+
+	It("should clear the stale locks of every prefix with --clear", func() {
+		backend := mock.NewS3Service()
+		backend.StoredLocks["crashed"] = impl.Lock{Prefix: "crashed", Owner: "pod-a", Expires: 1000}
+		backend.StoredLocks["running"] = impl.Lock{Prefix: "running", Owner: "pod-b", Expires: time.Now().Add(time.Hour).Unix()}
+		useBackend(backend)
+		var out bytes.Buffer
+		locksCmd.SetOut(&out)
+		DeferCleanup(func() {
+			locksCmd.SetOut(nil)
+		})
+		viper.Set("clear", true)
+
+		Expect(locksCmd.RunE(locksCmd, []string{})).To(Succeed())
+		Expect(backend.StoredLocks).To(HaveKey("running"))
+		Expect(backend.StoredLocks).ToNot(HaveKey("crashed"))
+		Expect(out.String()).To(Equal("Cleared 1 stale lock(s)\n"))
+	})
+
+	Context("clearStaleLocks", func() {
+		It("should only clear locks whose lease has ended", func() {
+			backend := mock.NewS3Service()
+			stale := impl.Lock{Prefix: "crashed", Owner: "pod-a", Expires: 1000}
+			held := impl.Lock{Prefix: "running", Owner: "pod-b", Expires: 5000}
+			backend.StoredLocks["crashed"] = stale
+			backend.StoredLocks["running"] = held
+
+			var out bytes.Buffer
+			Expect(clearStaleLocks(&out, backend, []impl.Lock{stale, held}, 2000)).To(Succeed())
+
+			Expect(backend.StoredLocks).ToNot(HaveKey("crashed"))
+			Expect(backend.StoredLocks).To(HaveKey("running"))
+			Expect(out.String()).To(Equal("Cleared 1 stale lock(s)\n"))
+		})
+	})
+})
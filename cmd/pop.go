@@ -2,34 +2,98 @@ package cmd
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
 
-	"github.com/RedHatInsights/valpop/impl/valkey"
+	"github.com/RedHatInsights/valpop/impl"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 // Pop CMD
-var dest string
 var popCmd = &cobra.Command{
 	Use:   "pop",
 	Short: "copies to the dest for serving",
-	Long:  "copies cache to dest for serving",
+	Long:  "copies cache to dest for serving, or streams it as a tar archive with --format",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		if viper.GetString("dest") == "" {
-			return fmt.Errorf("dest arg not set")
+		format, output := viper.GetString("format"), viper.GetString("output")
+		if format == "" {
+			format = impl.PopFormatDir
 		}
-		if viper.GetString("mode") == "valkey" {
-			return valkey.PopFn(addr, dest)
+		if !slices.Contains(impl.PopFormats, format) {
+			return fmt.Errorf("unknown format %q, must be one of: %s", format, strings.Join(impl.PopFormats, ", "))
 		}
-		return nil
+		if format == impl.PopFormatDir {
+			if viper.GetString("dest") == "" {
+				return fmt.Errorf("dest arg not set")
+			}
+			if output != "" {
+				return fmt.Errorf("output needs --format %s or %s", impl.PopFormatTar, impl.PopFormatTarGz)
+			}
+		} else if output == "" {
+			return fmt.Errorf("output arg not set, use - for stdout")
+		}
+		if viper.GetString("prefix") == "" {
+			return fmt.Errorf("no prefix arg set")
+		}
+
+		backend, err := newBackend()
+		if err != nil {
+			return err
+		}
+
+		defer backend.Close()
+		if format == impl.PopFormatDir {
+			return backend.PopFn(viper.GetString("prefix"), viper.GetString("dest"))
+		}
+		return popArchive(cmd.OutOrStdout(), cmd.ErrOrStderr(), backend, viper.GetString("prefix"), format, output)
 	},
 }
 
+// popArchive streams the release of prefix as an archive to the output file,
+// or to stdout when output is "-", with the backend progress moved to stderr
+// A partly written output file is removed
+func popArchive(stdout, stderr io.Writer, backend impl.Backend, prefix, format, output string) (err error) {
+	w := stdout
+	if output == "-" {
+		backend.SetOutput(stderr)
+	} else {
+		var f *os.File
+		f, err = os.Create(output)
+		if err != nil {
+			return fmt.Errorf("could not create output: %w", err)
+		}
+		defer func() {
+			closeErr := f.Close()
+			if err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(output)
+			}
+		}()
+		w = f
+	}
+
+	target, err := impl.NewArchiveTarget(w, format)
+	if err != nil {
+		return err
+	}
+	err = backend.PopTo(prefix, target)
+	if err != nil {
+		return err
+	}
+	return target.Close()
+}
+
 func init() {
-	popCmd.Flags().StringVarP(&dest, "dest", "d", "", "Dest directory")
+	popCmd.Flags().StringP("dest", "d", "", "Dest directory")
+	popCmd.Flags().String("format", impl.PopFormatDir, fmt.Sprintf("Output format, one of: %s", strings.Join(impl.PopFormats, ", ")))
+	popCmd.Flags().StringP("output", "o", "", "Archive file to write with --format tar or tar.gz, - for stdout")
 	viper.BindPFlag("dest", popCmd.Flags().Lookup("dest"))
+	viper.BindPFlag("format", popCmd.Flags().Lookup("format"))
+	viper.BindPFlag("output", popCmd.Flags().Lookup("output"))
 	rootCmd.AddCommand(popCmd)
 }
-
-// TODO Define a cacher function to return all files in the standard struct
-// TODO Stop passing prefix and other items to the cacher object
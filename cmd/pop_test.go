@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+
+	"github.com/RedHatInsights/valpop/impl"
+	"github.com/RedHatInsights/valpop/impl/mock"
+)
+
+var _ = Describe("Pop Command", func() {
+	BeforeEach(func() {
+		viper.Reset()
+	})
+
+	Context("required flag validation", func() {
+		It("should require dest flag", func() {
+			viper.Set("mode", "s3")
+			viper.Set("prefix", "test")
+			viper.Set("dest", "")
+
+			err := popCmd.RunE(popCmd, []string{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("dest arg not set"))
+		})
+
+		It("should require prefix flag", func() {
+			viper.Set("mode", "s3")
+			viper.Set("dest", "/tmp/dest")
+			viper.Set("prefix", "")
+
+			err := popCmd.RunE(popCmd, []string{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("no prefix arg set"))
+		})
+	})
+
+	Context("format flag", func() {
+		DescribeTable("should check the format and output",
+			func(format, output, message string) {
+				viper.Set("prefix", "test")
+				viper.Set("dest", "/tmp/dest")
+				viper.Set("format", format)
+				viper.Set("output", output)
+
+				err := popCmd.RunE(popCmd, []string{})
+				Expect(err).To(MatchError(ContainSubstring(message)))
+			},
+			Entry("unknown format", "zip", "-", `unknown format "zip", must be one of: dir, tar, tar.gz`),
+			Entry("archive without output", "tar.gz", "", "output arg not set"),
+			Entry("output without archive", "dir", "-", "output needs --format tar or tar.gz"),
+		)
+	})
+
+	Context("popArchive", func() {
+		It("should write the archive to the output file", func() {
+			output := filepath.Join(GinkgoT().TempDir(), "release.tar")
+			mockService := mock.NewS3Service()
+
+			Expect(popArchive(io.Discard, io.Discard, mockService, "test", impl.PopFormatTar, output)).To(Succeed())
+			Expect(mockService.Operations).To(ContainElement("PopTo"))
+			f, err := os.Open(output)
+			Expect(err).ToNot(HaveOccurred())
+			defer f.Close()
+			_, err = tar.NewReader(f).Next()
+			Expect(err).To(MatchError(io.EOF))
+		})
+
+		It("should remove the output file when pop fails", func() {
+			output := filepath.Join(GinkgoT().TempDir(), "release.tar.gz")
+			mockService := mock.NewS3Service()
+			mockService.Errors["PopTo"] = errors.New("no manifests found")
+
+			Expect(popArchive(io.Discard, io.Discard, mockService, "test", impl.PopFormatTarGz, output)).To(MatchError("no manifests found"))
+			Expect(output).ToNot(BeAnExistingFile())
+		})
+
+		It("should stream to stdout and send progress to stderr", func() {
+			var stdout, stderr bytes.Buffer
+			mockService := mock.NewS3Service()
+
+			Expect(popArchive(&stdout, &stderr, mockService, "test", impl.PopFormatTarGz, "-")).To(Succeed())
+			Expect(mockService.Operations).To(Equal([]string{"SetOutput", "PopTo"}))
+			Expect(mockService.Output).To(BeIdenticalTo(&stderr))
+			gz, err := gzip.NewReader(&stdout)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = tar.NewReader(gz).Next()
+			Expect(err).To(MatchError(io.EOF))
+		})
+	})
+
+	It("should pop the release into dest", func() {
+		backend := mock.NewS3Service()
+		useBackend(backend)
+		viper.Set("prefix", "test")
+		viper.Set("dest", GinkgoT().TempDir())
+
+		Expect(popCmd.RunE(popCmd, []string{})).To(Succeed())
+		Expect(backend.Operations).To(Equal([]string{"PopFn", "Close"}))
+	})
+
+	It("should keep the insecure TLS warning out of an archive streamed to stdout", func() {
+		viper.Set("mode", "s3")
+		viper.Set("hostname", "s3.example.com")
+		viper.Set("port", "443")
+		viper.Set("username", "user")
+		viper.Set("password", "password")
+		viper.Set("s3-secure", true)
+		viper.Set("s3-insecure-skip-verify", true)
+		viper.Set("prefix", "test")
+		viper.Set("format", impl.PopFormatTar)
+		viper.Set("output", "-")
+
+		// Build the real s3 backend, which warns about the skipped verification,
+		// and pop from a mock in its place
+		original, popped := newBackend, mock.NewS3Service()
+		newBackend = func() (impl.Backend, error) {
+			backend, err := original()
+			if err != nil {
+				return nil, err
+			}
+			backend.Close()
+			return popped, nil
+		}
+		stdout, err := os.Create(filepath.Join(GinkgoT().TempDir(), "stdout"))
+		Expect(err).ToNot(HaveOccurred())
+		realStdout := os.Stdout
+		os.Stdout = stdout
+		DeferCleanup(func() {
+			newBackend, os.Stdout = original, realStdout
+			stdout.Close()
+		})
+
+		Expect(popCmd.RunE(popCmd, []string{})).To(Succeed())
+		Expect(popped.Operations).To(ContainElement("PopTo"))
+		_, err = stdout.Seek(0, io.SeekStart)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = tar.NewReader(stdout).Next()
+		Expect(err).To(MatchError(io.EOF))
+	})
+})
@@ -2,9 +2,9 @@ package cmd
 
 import (
 	"fmt"
+	"strings"
 
-	"github.com/RedHatInsights/valpop/impl/s3"
-	"github.com/RedHatInsights/valpop/impl/valkey"
+	"github.com/RedHatInsights/valpop/impl"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -22,66 +22,89 @@ var populateCmd = &cobra.Command{
 			return fmt.Errorf("no prefix arg set")
 		}
 
-		minAssetRecords := viper.GetInt("min-asset-records")
-		if minAssetRecords < 0 {
-			return fmt.Errorf("min-asset-records must be a non-negative integer")
+		timeout, minAssetRecords, err := retentionPolicy()
+		if err != nil {
+			return err
 		}
 
-		if viper.GetString("mode") == "valkey" {
-			client, err := valkey.NewValkey(addr)
-			if err != nil {
-				return err
-			}
+		concurrency := viper.GetInt("concurrency")
+		if concurrency < 1 {
+			return fmt.Errorf("concurrency must be a positive integer")
+		}
+
+		precompress := impl.PrecompressOptions{
+			Encodings: viper.GetStringSlice("precompress"),
+			MinSize:   viper.GetInt64("precompress-min-size"),
+		}
+		err = impl.ValidatePrecompress(precompress)
+		if err != nil {
+			return err
+		}
 
-			defer client.Close()
+		source, err := impl.OpenSource(viper.GetString("source"), viper.GetString("source-path"))
+		if err != nil {
+			return err
+		}
+		defer source.Close()
+
+		filter, err := impl.NewFileFilter(source, viper.GetStringSlice("include"), viper.GetStringSlice("exclude"))
+		if err != nil {
+			return err
+		}
 
-			return client.PopulateFn(
-				addr,
-				viper.GetString("source"),
-				viper.GetString("prefix"),
-				viper.GetString("image"),
-				viper.GetString("valpop-image"),
-				viper.GetInt64("timeout"),
-				int64(minAssetRecords),
-				viper.GetInt64("cache-max-age"),
-			)
-		} else if viper.GetString("mode") == "s3" {
-			client, err := s3.NewMinio(addr, viper.GetString("username"), viper.GetString("password"))
+		backend, err := newBackend()
+		if err != nil {
+			return err
+		}
+
+		defer backend.Close()
+		opts := impl.PopulateOptions{
+			Source:          viper.GetString("source"),
+			Files:           source,
+			Prefix:          viper.GetString("prefix"),
+			Image:           viper.GetString("image"),
+			ValpopImage:     viper.GetString("valpop-image"),
+			Timeout:         timeout,
+			MinAssetRecords: minAssetRecords,
+			Concurrency:     concurrency,
+			Precompress:     precompress,
+			Filter:          filter,
+		}
+		if viper.GetBool("dry-run") {
+			plan, err := backend.PlanPopulate(opts)
 			if err != nil {
 				return err
 			}
-
-			defer client.Close()
-			return client.PopulateFn(
-				addr,
-				bucket,
-				viper.GetString("source"),
-				viper.GetString("prefix"),
-				viper.GetString("image"),
-				viper.GetString("valpop-image"),
-				viper.GetInt64("timeout"),
-				int64(minAssetRecords),
-				viper.GetInt64("cache-max-age"),
-			)
+			return printResult(cmd.OutOrStdout(), plan)
 		}
-		return nil
+		return backend.PopulateFn(opts)
 	},
 }
 
 func init() {
-	populateCmd.Flags().StringP("source", "s", "", "Source directory")
-	populateCmd.Flags().StringP("prefix", "r", "", "Prefix for dir structure and cache")
+	populateCmd.Flags().StringP("source", "s", "", "Source directory, tar or tar.gz archive, or OCI image layout (layout or layout:ref)")
+	populateCmd.Flags().String("source-path", "", "Directory inside the source to populate from, e.g. the asset path inside an image")
 	populateCmd.Flags().StringP("image", "i", "", "Image identifier (e.g., container image tag)")
 	populateCmd.Flags().String("valpop-image", "", "Valpop image used for this build (recorded in manifest)")
-	populateCmd.Flags().Int64P("timeout", "t", 30, "Timeout for cache")
-	populateCmd.Flags().IntP("min-asset-records", "n", 3, "Minimum number of asset records to keep")
 	populateCmd.Flags().Int64P("cache-max-age", "g", 86400, "Cache-Control max-age in seconds for static assets")
+	populateCmd.Flags().Int("concurrency", 4, "Maximum number of parallel uploads")
+	populateCmd.Flags().StringSlice("precompress", nil, fmt.Sprintf("Store precompressed variants of compressible files, any of: %s", strings.Join(impl.Encodings, ", ")))
+	populateCmd.Flags().Int64("precompress-min-size", impl.DefaultPrecompressMinSize, "Smallest file in bytes to precompress")
+	populateCmd.Flags().StringSlice("content-type", nil, "Content-Type for an extension as ext=type, e.g. map=application/json, repeatable")
+	populateCmd.Flags().Bool("sniff-content-type", false, "Detect the Content-Type of files with unknown extensions from their content")
+	populateCmd.Flags().StringSlice("include", nil, "Only upload files matching these globs, e.g. '*.js,*.css'")
+	populateCmd.Flags().StringSlice("exclude", nil, "Leave out files and directories matching these globs, e.g. '*.map,.git'")
 	viper.BindPFlag("source", populateCmd.Flags().Lookup("source"))
-	viper.BindPFlag("prefix", populateCmd.Flags().Lookup("prefix"))
+	viper.BindPFlag("source-path", populateCmd.Flags().Lookup("source-path"))
 	viper.BindPFlag("image", populateCmd.Flags().Lookup("image"))
 	viper.BindPFlag("valpop-image", populateCmd.Flags().Lookup("valpop-image"))
-	viper.BindPFlag("timeout", populateCmd.Flags().Lookup("timeout"))
-	viper.BindPFlag("min-asset-records", populateCmd.Flags().Lookup("min-asset-records"))
 	viper.BindPFlag("cache-max-age", populateCmd.Flags().Lookup("cache-max-age"))
+	viper.BindPFlag("concurrency", populateCmd.Flags().Lookup("concurrency"))
+	viper.BindPFlag("precompress", populateCmd.Flags().Lookup("precompress"))
+	viper.BindPFlag("precompress-min-size", populateCmd.Flags().Lookup("precompress-min-size"))
+	viper.BindPFlag("content-type", populateCmd.Flags().Lookup("content-type"))
+	viper.BindPFlag("sniff-content-type", populateCmd.Flags().Lookup("sniff-content-type"))
+	viper.BindPFlag("include", populateCmd.Flags().Lookup("include"))
+	viper.BindPFlag("exclude", populateCmd.Flags().Lookup("exclude"))
 	rootCmd.AddCommand(populateCmd)
 }
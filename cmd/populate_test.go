@@ -1,11 +1,19 @@
 package cmd
 
 import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
 	"testing"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/spf13/viper"
+
+	"github.com/RedHatInsights/valpop/impl"
+	"github.com/RedHatInsights/valpop/impl/mock"
+	"github.com/RedHatInsights/valpop/impl/s3"
 )
 
 func TestPopulateCmd(t *testing.T) {
@@ -116,6 +124,123 @@ var _ = Describe("Populate Command", func() {
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("min-asset-records must be a non-negative integer"))
 			})
+
+			It("should validate concurrency is positive", func() {
+				viper.Set("source", "/tmp/test")
+				viper.Set("prefix", "test")
+				viper.Set("min-asset-records", 3)
+				viper.Set("concurrency", 0)
+
+				err := populateCmd.RunE(populateCmd, []string{})
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("concurrency must be a positive integer"))
+			})
+
+			It("should reject unknown precompress encodings", func() {
+				viper.Set("source", "/tmp/test")
+				viper.Set("prefix", "test")
+				viper.Set("min-asset-records", 3)
+				viper.Set("concurrency", 1)
+				viper.Set("precompress", []string{"gzip", "zstd"})
+
+				err := populateCmd.RunE(populateCmd, []string{})
+				Expect(err).To(MatchError(ContainSubstring(`unknown precompress encoding "zstd"`)))
+			})
+
+			It("should reject invalid exclude globs", func() {
+				viper.Set("source", GinkgoT().TempDir())
+				viper.Set("prefix", "test")
+				viper.Set("min-asset-records", 3)
+				viper.Set("concurrency", 1)
+				viper.Set("exclude", []string{"*.map,[a-"})
+
+				err := populateCmd.RunE(populateCmd, []string{})
+				Expect(err).To(MatchError(ContainSubstring(`invalid exclude pattern "[a-"`)))
+			})
+
+			It("should report a missing source", func() {
+				viper.Set("source", "/nonexistent/dist.tar.gz")
+				viper.Set("prefix", "test")
+				viper.Set("min-asset-records", 3)
+				viper.Set("concurrency", 1)
+
+				err := populateCmd.RunE(populateCmd, []string{})
+				Expect(err).To(MatchError(ContainSubstring("could not open source")))
+			})
+		})
+	})
+
+	Context("dry run", func() {
+		var client *mock.S3Client
+		var out *bytes.Buffer
+
+		BeforeEach(func() {
+			viper.Reset()
+			source := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(source, "index.html"), []byte("<html></html>"), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(source, "app.js"), bytes.Repeat([]byte("console.log(1);\n"), 128), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(source, "app.js.map"), []byte("{}"), 0644)).To(Succeed())
+
+			client = mock.NewS3Client()
+			backend := s3.NewMinioWithClient(client, "test-bucket", 0)
+			backend.SetOutput(GinkgoWriter)
+			useBackend(&backend)
+			out = &bytes.Buffer{}
+			populateCmd.SetOut(out)
+			DeferCleanup(func() {
+				populateCmd.SetOut(nil)
+			})
+
+			viper.Set("source", source)
+			viper.Set("prefix", "test")
+			viper.Set("min-asset-records", 3)
+			viper.Set("concurrency", 2)
+			viper.Set("dry-run", true)
+			viper.Set("json", true)
+		})
+
+		// plannedKeys runs populate and returns the keys of the planned uploads
+		plannedKeys := func() []string {
+			Expect(populateCmd.RunE(populateCmd, []string{})).To(Succeed())
+			plan := impl.Plan{}
+			Expect(json.Unmarshal(out.Bytes(), &plan)).To(Succeed())
+			keys := []string{}
+			for _, upload := range plan.Uploads {
+				keys = append(keys, upload.Key)
+			}
+			return keys
+		}
+
+		It("should print the plan without writing to the bucket", func() {
+			Expect(plannedKeys()).To(ConsistOf(
+				impl.MakeDataKey("test", "index.html"),
+				impl.MakeDataKey("test", "app.js"),
+				impl.MakeDataKey("test", "app.js.map"),
+			))
+			Expect(client.Objects).To(BeEmpty())
+		})
+
+		It("should plan precompressed variants of files above the minimum size", func() {
+			viper.Set("precompress", []string{"br", "gzip"})
+			viper.Set("precompress-min-size", 1024)
+
+			Expect(plannedKeys()).To(ConsistOf(
+				impl.MakeDataKey("test", "index.html"),
+				impl.MakeDataKey("test", "app.js"),
+				impl.MakeDataKey("test", "app.js.map"),
+				impl.MakeDataKey("test", "app.js.br"),
+				impl.MakeDataKey("test", "app.js.gz"),
+			))
+		})
+
+		It("should leave excluded files out of the plan", func() {
+			viper.Set("exclude", []string{"*.map"})
+			viper.Set("json", false)
+
+			Expect(populateCmd.RunE(populateCmd, []string{})).To(Succeed())
+			Expect(out.String()).To(ContainSubstring("exclude   app.js.map\n"))
+			Expect(out.String()).NotTo(ContainSubstring(impl.MakeDataKey("test", "app.js.map")))
+			Expect(out.String()).To(HaveSuffix(", excluding 1 paths\n"))
 		})
 	})
 })
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/RedHatInsights/valpop/impl"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Rollback CMD
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "restores a retained release",
+	Long:  "restores a retained release, selected by manifest timestamp or image, and records it as the latest release without rebuilding",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		prefix, to := viper.GetString("prefix"), viper.GetString("to")
+		if prefix == "" {
+			return fmt.Errorf("no prefix arg set")
+		}
+		if to == "" {
+			return fmt.Errorf("no to arg set")
+		}
+
+		backend, err := newBackend()
+		if err != nil {
+			return err
+		}
+
+		defer backend.Close()
+		manifests, err := backend.Manifests(prefix)
+		if err != nil {
+			return err
+		}
+		target, err := impl.FindRelease(manifests, to)
+		if err != nil {
+			return err
+		}
+		if !slices.ContainsFunc(manifests, func(manifest impl.Manifest) bool { return manifest.Timestamp > target.Timestamp }) {
+			return fmt.Errorf("release %d is already the latest", target.Timestamp)
+		}
+
+		restored, err := backend.Rollback(prefix, target, impl.RollbackTimestamp(manifests, time.Now().Unix()))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Rolled back %s to release %d (image: %s) as release %d\n", prefix, target.Timestamp, target.Image, restored.Timestamp)
+		return nil
+	},
+}
+
+func init() {
+	rollbackCmd.Flags().String("to", "", "Release to restore: a manifest timestamp or an image")
+	viper.BindPFlag("to", rollbackCmd.Flags().Lookup("to"))
+	rootCmd.AddCommand(rollbackCmd)
+}
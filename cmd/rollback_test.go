@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+)
+
+var _ = Describe("Rollback Command", func() {
+	BeforeEach(func() {
+		viper.Reset()
+	})
+
+	It("should require prefix flag", func() {
+		viper.Set("mode", "s3")
+		viper.Set("to", "1742472000")
+
+		err := rollbackCmd.RunE(rollbackCmd, []string{})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("no prefix arg set"))
+	})
+
+	It("should require to flag", func() {
+		viper.Set("mode", "s3")
+		viper.Set("prefix", "myapp")
+
+		err := rollbackCmd.RunE(rollbackCmd, []string{})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("no to arg set"))
+	})
+})
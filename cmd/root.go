@@ -1,50 +1,141 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"strings"
 
+	"github.com/RedHatInsights/valpop/impl"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
-)
 
-var addr string
-var bucket string
+	// Storage backends register themselves with impl on import
+	_ "github.com/RedHatInsights/valpop/impl/s3"
+	_ "github.com/RedHatInsights/valpop/impl/valkey"
+)
 
 var rootCmd = &cobra.Command{
 	Use:   "valpop",
 	Short: "pops or populates storage for Frontends",
 	Long:  "pops or populates storage for Frontends - ya know",
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
-		addr = fmt.Sprintf("%s:%s", viper.GetString("hostname"), viper.GetString("port"))
-		bucket = viper.GetString("bucket")
-		if viper.GetString("mode") == "s3" {
-			if viper.GetString("username") == "" {
-				return fmt.Errorf("can't have s3 with no username")
-			}
-			if viper.GetString("password") == "" {
-				return fmt.Errorf("can't have s3 with no password")
-			}
+		err := readConfigFile()
+		if err != nil {
+			return err
 		}
-		return nil
+		factory, err := impl.LookupFactory(viper.GetString("mode"))
+		if err != nil {
+			return err
+		}
+		return factory.Check(viper.GetViper())
 	},
 }
 
+// readConfigFile loads the --config file, if any; its keys are the flag names
+// and rank below flags and env vars
+func readConfigFile() error {
+	configFile := viper.GetString("config")
+	if configFile == "" {
+		return nil
+	}
+	viper.SetConfigFile(configFile)
+	err := viper.ReadInConfig()
+	if err != nil {
+		return fmt.Errorf("could not read config file %s: %w", configFile, err)
+	}
+	return nil
+}
+
+// newBackend constructs the storage backend selected with --mode; tests
+// replace it to run the commands against a mock
+var newBackend = func() (impl.Backend, error) {
+	return impl.NewBackend(viper.GetString("mode"), viper.GetViper())
+}
+
+// retentionPolicy returns the --timeout and --min-asset-records settings that
+// decide which releases cleanup removes
+func retentionPolicy() (timeout, minAssetRecords int64, err error) {
+	minAssetRecords = viper.GetInt64("min-asset-records")
+	if minAssetRecords < 0 {
+		return 0, 0, fmt.Errorf("min-asset-records must be a non-negative integer")
+	}
+	return viper.GetInt64("timeout"), minAssetRecords, nil
+}
+
+// printResult writes result as indented JSON when --json is set, otherwise as text
+func printResult(w io.Writer, result fmt.Stringer) error {
+	if viper.GetBool("json") {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+	_, err := fmt.Fprint(w, result.String())
+	return err
+}
+
+// backendsHelp lists the registered backends for the root command help text
+func backendsHelp() string {
+	var sb strings.Builder
+	sb.WriteString("Available backends (--mode):\n")
+	for _, factory := range impl.Factories() {
+		fmt.Fprintf(&sb, "  %-8s %s\n", factory.Name, factory.Description)
+	}
+	return sb.String()
+}
+
 func init() {
 	viper.SetEnvPrefix("VALPOP")
+	// Flag names use dashes, env vars use underscores: --s3-region reads VALPOP_S3_REGION
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
 	viper.AutomaticEnv()
 
+	rootCmd.Long = rootCmd.Long + "\n\n" + backendsHelp()
+
 	rootCmd.PersistentFlags().StringP("hostname", "a", "127.0.0.1", "Storage hostname")
 	rootCmd.PersistentFlags().StringP("port", "p", "6379", "Storage port")
-	rootCmd.PersistentFlags().StringP("mode", "m", "s3", "Mode, s3 or valkey")
-	rootCmd.PersistentFlags().StringP("username", "u", "", "Username for S3")
-	rootCmd.PersistentFlags().StringP("password", "c", "", "Password for S3")
+	rootCmd.PersistentFlags().StringP("mode", "m", "s3", fmt.Sprintf("Storage backend, one of: %s", strings.Join(impl.FactoryNames(), ", ")))
+	rootCmd.PersistentFlags().StringP("username", "u", "", "Username (access key) for S3 static credentials")
+	rootCmd.PersistentFlags().StringP("password", "c", "", "Password (secret key) for S3 static credentials")
 	rootCmd.PersistentFlags().StringP("bucket", "b", "frontend", "S3 bucket name")
+	rootCmd.PersistentFlags().StringP("prefix", "r", "", "Prefix for dir structure and cache")
+	rootCmd.PersistentFlags().Int64P("timeout", "t", 30, "Timeout for cache")
+	rootCmd.PersistentFlags().IntP("min-asset-records", "n", 3, "Minimum number of asset records to keep")
+	rootCmd.PersistentFlags().Int64("lock-wait", 60, "Seconds to wait for another populate of the same prefix to release its lock (S3 only)")
+	rootCmd.PersistentFlags().Int64("lock-lease", 900, "Seconds a populate lock is held before another populate may take it over")
+	rootCmd.PersistentFlags().Int64("timestamp", 0, "Release (manifest timestamp) to operate on, 0 for the latest")
+	rootCmd.PersistentFlags().Bool("json", false, "Print machine-readable JSON output")
+	rootCmd.PersistentFlags().Bool("dry-run", false, "Print the uploads and deletions a command would make without changing storage")
+	rootCmd.PersistentFlags().StringSlice("protect", nil, "Glob of files cleanup never deletes, repeatable; patterns without a '/' match the file name at any depth (fed-mods.json is always protected)")
+	rootCmd.PersistentFlags().String("config", "", "YAML, JSON or TOML file to read settings from, keyed by flag name")
 	viper.BindPFlag("hostname", rootCmd.PersistentFlags().Lookup("hostname"))
 	viper.BindPFlag("port", rootCmd.PersistentFlags().Lookup("port"))
 	viper.BindPFlag("mode", rootCmd.PersistentFlags().Lookup("mode"))
 	viper.BindPFlag("username", rootCmd.PersistentFlags().Lookup("username"))
 	viper.BindPFlag("password", rootCmd.PersistentFlags().Lookup("password"))
 	viper.BindPFlag("bucket", rootCmd.PersistentFlags().Lookup("bucket"))
+	viper.BindPFlag("prefix", rootCmd.PersistentFlags().Lookup("prefix"))
+	viper.BindPFlag("timeout", rootCmd.PersistentFlags().Lookup("timeout"))
+	viper.BindPFlag("min-asset-records", rootCmd.PersistentFlags().Lookup("min-asset-records"))
+	viper.BindPFlag("lock-wait", rootCmd.PersistentFlags().Lookup("lock-wait"))
+	viper.BindPFlag("lock-lease", rootCmd.PersistentFlags().Lookup("lock-lease"))
+	viper.BindPFlag("timestamp", rootCmd.PersistentFlags().Lookup("timestamp"))
+	viper.BindPFlag("json", rootCmd.PersistentFlags().Lookup("json"))
+	viper.BindPFlag("dry-run", rootCmd.PersistentFlags().Lookup("dry-run"))
+	viper.BindPFlag("protect", rootCmd.PersistentFlags().Lookup("protect"))
+	viper.BindPFlag("config", rootCmd.PersistentFlags().Lookup("config"))
+
+	// Backends define their own settings, e.g. the --s3-* flags
+	for _, factory := range impl.Factories() {
+		if factory.Flags == nil {
+			continue
+		}
+		flags := pflag.NewFlagSet(factory.Name, pflag.ContinueOnError)
+		factory.Flags(flags)
+		rootCmd.PersistentFlags().AddFlagSet(flags)
+		viper.BindPFlags(flags)
+	}
 }
 
 func Execute() error {
@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/RedHatInsights/valpop/impl"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+)
+
+// useBackend makes the commands run against backend until the spec ends
+func useBackend(backend impl.Backend) {
+	original := newBackend
+	newBackend = func() (impl.Backend, error) {
+		return backend, nil
+	}
+	DeferCleanup(func() {
+		newBackend = original
+	})
+}
+
+var _ = Describe("Root Command", func() {
+	BeforeEach(func() {
+		viper.Reset()
+	})
+
+	Context("mode validation", func() {
+		It("should reject unknown modes up front", func() {
+			viper.Set("mode", "redis")
+
+			err := rootCmd.PersistentPreRunE(rootCmd, []string{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(`unknown mode "redis"`))
+			Expect(err.Error()).To(ContainSubstring("s3, valkey"))
+		})
+
+		It("should require S3 credentials in s3 mode", func() {
+			viper.Set("mode", "s3")
+			viper.Set("password", "secret")
+
+			err := rootCmd.PersistentPreRunE(rootCmd, []string{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("can't have s3 with no username"))
+
+			viper.Set("username", "admin")
+			viper.Set("password", "")
+			err = rootCmd.PersistentPreRunE(rootCmd, []string{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("can't have s3 with no password"))
+		})
+
+		It("should accept s3 mode with credentials", func() {
+			viper.Set("mode", "s3")
+			viper.Set("username", "admin")
+			viper.Set("password", "secret")
+
+			Expect(rootCmd.PersistentPreRunE(rootCmd, []string{})).To(Succeed())
+		})
+
+		It("should not require a username when credentials come from elsewhere", func() {
+			viper.Set("mode", "s3")
+			viper.Set("s3-credentials", "env")
+
+			Expect(rootCmd.PersistentPreRunE(rootCmd, []string{})).To(Succeed())
+		})
+
+		It("should require a token file for web identity credentials", func() {
+			viper.Set("mode", "s3")
+			viper.Set("s3-credentials", "web-identity")
+			GinkgoT().Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "")
+
+			err := rootCmd.PersistentPreRunE(rootCmd, []string{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("s3-web-identity-token-file"))
+		})
+
+		It("should accept valkey mode without credentials", func() {
+			viper.Set("mode", "valkey")
+
+			Expect(rootCmd.PersistentPreRunE(rootCmd, []string{})).To(Succeed())
+		})
+	})
+
+	Context("protected files", func() {
+		It("should reject invalid protect patterns", func() {
+			viper.Set("mode", "valkey")
+			viper.Set("protect", []string{"[index.html"})
+
+			err := rootCmd.PersistentPreRunE(rootCmd, []string{})
+			Expect(err).To(MatchError(ContainSubstring(`invalid protect pattern "[index.html"`)))
+		})
+
+		It("should read protect patterns from the config file", func() {
+			configFile := filepath.Join(GinkgoT().TempDir(), "valpop.yaml")
+			Expect(os.WriteFile(configFile, []byte("mode: valkey\nprotect:\n  - \"*.html\"\n  - static/entry-*.js\n"), 0644)).To(Succeed())
+			viper.Set("config", configFile)
+
+			Expect(rootCmd.PersistentPreRunE(rootCmd, []string{})).To(Succeed())
+			Expect(viper.GetString("mode")).To(Equal("valkey"))
+			Expect(impl.ProtectedPatterns(viper.GetViper())).To(Equal([]string{"fed-mods.json", "*.html", "static/entry-*.js"}))
+		})
+
+		It("should fail on a missing config file", func() {
+			viper.Set("config", filepath.Join(GinkgoT().TempDir(), "missing.yaml"))
+
+			err := rootCmd.PersistentPreRunE(rootCmd, []string{})
+			Expect(err).To(MatchError(ContainSubstring("could not read config file")))
+		})
+	})
+
+	Context("cache rules", func() {
+		It("should read cache rules from the config file in s3 mode", func() {
+			configFile := filepath.Join(GinkgoT().TempDir(), "valpop.yaml")
+			Expect(os.WriteFile(configFile, []byte("s3-credentials: env\ncache-rules:\n  - pattern: \"*.html\"\n    cache-control: no-cache\n"), 0644)).To(Succeed())
+			viper.Set("config", configFile)
+			viper.Set("mode", "s3")
+
+			Expect(rootCmd.PersistentPreRunE(rootCmd, []string{})).To(Succeed())
+			rules, err := impl.CacheRulesFromConfig(viper.GetViper())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rules).To(Equal([]impl.CacheRule{{Pattern: "*.html", CacheControl: "no-cache"}}))
+		})
+
+		It("should reject cache rules without a header", func() {
+			configFile := filepath.Join(GinkgoT().TempDir(), "valpop.yaml")
+			Expect(os.WriteFile(configFile, []byte("s3-credentials: env\ncache-rules:\n  - pattern: \"*.html\"\n"), 0644)).To(Succeed())
+			viper.Set("config", configFile)
+			viper.Set("mode", "s3")
+
+			err := rootCmd.PersistentPreRunE(rootCmd, []string{})
+			Expect(err).To(MatchError(ContainSubstring("must have a pattern and a cache-control")))
+		})
+	})
+
+	Context("help output", func() {
+		It("should list the registered backends", func() {
+			Expect(rootCmd.Long).To(ContainSubstring("Available backends"))
+			Expect(rootCmd.Long).To(ContainSubstring("s3"))
+			Expect(rootCmd.Long).To(ContainSubstring("valkey"))
+		})
+
+		It("should list the backends in the mode flag usage", func() {
+			flag := rootCmd.PersistentFlags().Lookup("mode")
+			Expect(flag.Usage).To(ContainSubstring("s3, valkey"))
+		})
+
+		It("should add the flags the backends define", func() {
+			flag := rootCmd.PersistentFlags().Lookup("s3-credentials")
+			Expect(flag).NotTo(BeNil())
+			Expect(flag.DefValue).To(Equal("static"))
+			Expect(flag.Usage).To(ContainSubstring("static, env, file, web-identity, chain"))
+		})
+	})
+})
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Verify CMD
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "checks a stored release against its manifest",
+	Long:  "checks that every file listed in a release manifest is stored with the recorded size and hash",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if viper.GetString("prefix") == "" {
+			return fmt.Errorf("no prefix arg set")
+		}
+
+		backend, err := newBackend()
+		if err != nil {
+			return err
+		}
+
+		defer backend.Close()
+		report, err := backend.Verify(viper.GetString("prefix"), viper.GetInt64("timestamp"))
+		if err != nil {
+			return err
+		}
+
+		err = printResult(cmd.OutOrStdout(), report)
+		if err != nil {
+			return err
+		}
+		if !report.OK() {
+			// The report already lists the problems, usage would only bury it
+			cmd.SilenceUsage = true
+			return fmt.Errorf("verify failed: %d of %d files missing or corrupt", len(report.Problems), report.Checked)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+}
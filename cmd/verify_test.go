@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+
+	"github.com/RedHatInsights/valpop/impl"
+)
+
+var _ = Describe("Verify Command", func() {
+	BeforeEach(func() {
+		viper.Reset()
+	})
+
+	It("should require prefix flag", func() {
+		viper.Set("mode", "s3")
+		viper.Set("prefix", "")
+
+		err := verifyCmd.RunE(verifyCmd, []string{})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("no prefix arg set"))
+	})
+
+	Context("report output", func() {
+		report := impl.VerifyReport{
+			Prefix:          "myapp",
+			Timestamp:       1742472000,
+			ManifestVersion: 2,
+			Checked:         2,
+			Problems:        []impl.VerifyProblem{{Path: "app.js", Problem: impl.ProblemMissing}},
+		}
+
+		It("should print text by default", func() {
+			var out bytes.Buffer
+			Expect(printResult(&out, report)).To(Succeed())
+			Expect(out.String()).To(ContainSubstring("missing: app.js"))
+		})
+
+		It("should print JSON with --json", func() {
+			viper.Set("json", true)
+
+			var out bytes.Buffer
+			Expect(printResult(&out, report)).To(Succeed())
+
+			var decoded impl.VerifyReport
+			Expect(json.Unmarshal(out.Bytes(), &decoded)).To(Succeed())
+			Expect(decoded).To(Equal(report))
+		})
+	})
+})
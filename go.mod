@@ -4,6 +4,7 @@ module github.com/RedHatInsights/valpop
 go 1.25.0
 
 require (
+	github.com/andybalholm/brotli v1.2.6
 	github.com/minio/minio-go/v7 v7.0.100
 	github.com/onsi/ginkgo/v2 v2.28.1
 	github.com/onsi/gomega v1.39.1
@@ -0,0 +1,101 @@
+package impl
+
+import (
+	"fmt"
+	"path"
+)
+
+// EntrypointCacheControl is the short-lived header of files loaded by a fixed
+// name. stale-while-revalidate lets the CDN serve the stale file while the new
+// one is fetched in the background, so a release is picked up within minutes
+// without sending every request to the origin
+const EntrypointCacheControl = "public, max-age=60, stale-while-revalidate=300"
+
+// CacheRule sets the Cache-Control header of the files matching Pattern, a glob
+// matched like the --protect patterns, see MatchGlob
+type CacheRule struct {
+	Pattern      string `json:"pattern"`
+	CacheControl string `json:"cacheControl"`
+}
+
+// DefaultCacheRules give entrypoints EntrypointCacheControl and every other
+// file a max-age of cacheMaxAge seconds
+func DefaultCacheRules(cacheMaxAge int64) []CacheRule {
+	return []CacheRule{
+		{Pattern: "*index.html", CacheControl: EntrypointCacheControl},
+		{Pattern: "*fed-mods.json", CacheControl: EntrypointCacheControl},
+		{Pattern: "*app-info.json", CacheControl: EntrypointCacheControl},
+		{Pattern: "*app-info.deps.json", CacheControl: EntrypointCacheControl},
+		{Pattern: "*", CacheControl: fmt.Sprintf("public, max-age=%d", cacheMaxAge)},
+	}
+}
+
+// CachePolicy is an ordered list of rules; the first rule matching a file wins
+type CachePolicy []CacheRule
+
+// NewCachePolicy returns the configured rules followed by DefaultCacheRules, so
+// files no configured rule matches keep the default headers
+func NewCachePolicy(rules []CacheRule, cacheMaxAge int64) CachePolicy {
+	return append(append(CachePolicy{}, rules...), DefaultCacheRules(cacheMaxAge)...)
+}
+
+// Match returns the first rule matching filepath
+func (p CachePolicy) Match(filepath string) (CacheRule, bool) {
+	for _, rule := range p {
+		if MatchGlob(filepath, []string{rule.Pattern}) {
+			return rule, true
+		}
+	}
+	return CacheRule{}, false
+}
+
+// CacheControl returns the header of the first rule matching filepath, empty
+// when none does
+func (p CachePolicy) CacheControl(filepath string) string {
+	rule, _ := p.Match(filepath)
+	return rule.CacheControl
+}
+
+// CacheRulesFromConfig reads the cache-rules list of the config file, whose
+// entries hold a pattern and a cache-control header
+func CacheRulesFromConfig(cfg Config) ([]CacheRule, error) {
+	var entries []map[string]any
+	switch raw := cfg.Get("cache-rules").(type) {
+	case nil:
+		return nil, nil
+	case []map[string]any:
+		entries = raw
+	case []any:
+		for _, item := range raw {
+			entry, ok := item.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("invalid cache rule %v: must have a pattern and a cache-control", item)
+			}
+			entries = append(entries, entry)
+		}
+	default:
+		return nil, fmt.Errorf("cache-rules must be a list of rules, got %T", raw)
+	}
+
+	rules := []CacheRule{}
+	for _, entry := range entries {
+		pattern, _ := entry["pattern"].(string)
+		cacheControl, _ := entry["cache-control"].(string)
+		rules = append(rules, CacheRule{Pattern: pattern, CacheControl: cacheControl})
+	}
+	return rules, ValidateCacheRules(rules)
+}
+
+// ValidateCacheRules rejects rules without a header or with an invalid glob
+func ValidateCacheRules(rules []CacheRule) error {
+	for _, rule := range rules {
+		if rule.Pattern == "" || rule.CacheControl == "" {
+			return fmt.Errorf("invalid cache rule %q: must have a pattern and a cache-control", rule.Pattern)
+		}
+		_, err := path.Match(rule.Pattern, "")
+		if err != nil {
+			return fmt.Errorf("invalid cache rule pattern %q: %w", rule.Pattern, err)
+		}
+	}
+	return nil
+}
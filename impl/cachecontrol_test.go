@@ -0,0 +1,84 @@
+package impl_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+
+	"github.com/RedHatInsights/valpop/impl"
+)
+
+var _ = Describe("Cache policy", func() {
+	Context("default rules", func() {
+		policy := impl.NewCachePolicy(nil, 600)
+
+		DescribeTable("should keep entrypoints short-lived and use cache-max-age elsewhere",
+			func(filepath, expected string) {
+				Expect(policy.CacheControl(filepath)).To(Equal(expected))
+			},
+			Entry("index.html", "index.html", impl.EntrypointCacheControl),
+			Entry("nested index.html", "assets/index.html", impl.EntrypointCacheControl),
+			Entry("fed-mods.json", "fed-mods.json", impl.EntrypointCacheControl),
+			Entry("app-info.json", "app-info.json", impl.EntrypointCacheControl),
+			Entry("app-info.deps.json", "some/path/app-info.deps.json", impl.EntrypointCacheControl),
+			Entry("static asset", "static/app.js", "public, max-age=600"),
+			Entry("case sensitive", "INDEX.HTML", "public, max-age=600"),
+		)
+	})
+
+	Context("configured rules", func() {
+		policy := impl.NewCachePolicy([]impl.CacheRule{
+			{Pattern: "*.????????.js", CacheControl: "public, max-age=31536000, immutable"},
+			{Pattern: "*.html", CacheControl: "no-cache"},
+		}, 600)
+
+		It("should apply the first matching rule", func() {
+			rule, ok := policy.Match("static/app.1a2b3c4d.js")
+			Expect(ok).To(BeTrue())
+			Expect(rule).To(Equal(impl.CacheRule{Pattern: "*.????????.js", CacheControl: "public, max-age=31536000, immutable"}))
+			Expect(policy.CacheControl("index.html")).To(Equal("no-cache"))
+		})
+
+		It("should fall back to the default rules", func() {
+			Expect(policy.CacheControl("fed-mods.json")).To(Equal(impl.EntrypointCacheControl))
+			rule, _ := policy.Match("static/app.js")
+			Expect(rule.Pattern).To(Equal("*"))
+		})
+	})
+
+	Context("CacheRulesFromConfig", func() {
+		It("should read an ordered list of rules", func() {
+			cfg := viper.New()
+			cfg.Set("cache-rules", []any{
+				map[string]any{"pattern": "*.html", "cache-control": "no-cache"},
+				map[string]any{"pattern": "static/*", "cache-control": "public, max-age=3600"},
+			})
+
+			rules, err := impl.CacheRulesFromConfig(cfg)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rules).To(Equal([]impl.CacheRule{
+				{Pattern: "*.html", CacheControl: "no-cache"},
+				{Pattern: "static/*", CacheControl: "public, max-age=3600"},
+			}))
+		})
+
+		It("should return no rules when none are configured", func() {
+			rules, err := impl.CacheRulesFromConfig(viper.New())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rules).To(BeEmpty())
+		})
+
+		DescribeTable("should reject malformed rules",
+			func(raw any, message string) {
+				cfg := viper.New()
+				cfg.Set("cache-rules", raw)
+				_, err := impl.CacheRulesFromConfig(cfg)
+				Expect(err).To(MatchError(ContainSubstring(message)))
+			},
+			Entry("not a list", "*.html=no-cache", "cache-rules must be a list"),
+			Entry("not a rule", []any{"*.html"}, "must have a pattern and a cache-control"),
+			Entry("missing header", []any{map[string]any{"pattern": "*.html"}}, "must have a pattern and a cache-control"),
+			Entry("bad glob", []any{map[string]any{"pattern": "[*.html", "cache-control": "no-cache"}}, "invalid cache rule pattern"),
+		)
+	})
+})
@@ -0,0 +1,193 @@
+package impl
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Content encodings populate can precompress files with
+const (
+	EncodingGzip   = "gzip"
+	EncodingBrotli = "br"
+)
+
+// Encodings lists the supported content encodings, in the order variants are written
+var Encodings = []string{EncodingBrotli, EncodingGzip}
+
+// variantExtensions are appended to a file's path to name its variants, as
+// nginx gzip_static and brotli_static expect
+var variantExtensions = map[string]string{
+	EncodingGzip:   ".gz",
+	EncodingBrotli: ".br",
+}
+
+// DefaultPrecompressMinSize is the smallest file worth precompressing; below it
+// the saving rarely outweighs the extra object
+const DefaultPrecompressMinSize = 1024
+
+// PrecompressOptions selects the variants populate writes next to each file
+type PrecompressOptions struct {
+	// Encodings are the variants to write, none when empty
+	Encodings []string
+	// MinSize is the smallest file, in bytes, that gets variants
+	MinSize int64
+}
+
+// ValidatePrecompress rejects unknown encodings and negative sizes
+func ValidatePrecompress(opts PrecompressOptions) error {
+	for _, encoding := range opts.Encodings {
+		if _, ok := variantExtensions[encoding]; !ok {
+			return fmt.Errorf("unknown precompress encoding %q, must be one of: %s", encoding, strings.Join(Encodings, ", "))
+		}
+	}
+	if opts.MinSize < 0 {
+		return fmt.Errorf("precompress-min-size must be a non-negative integer")
+	}
+	return nil
+}
+
+// Compressible reports whether files of contentType shrink when compressed
+// Raster images, fonts and archives are compressed already
+func Compressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.TrimSpace(mediaType)
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	switch mediaType {
+	case "application/javascript", "application/json", "application/manifest+json",
+		"application/xml", "application/wasm", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// VariantPath returns the path of the encoding variant of filepath, e.g. app.js.br
+func VariantPath(filepath, encoding string) string {
+	return filepath + variantExtensions[encoding]
+}
+
+// SourcePath returns the path of the file a variant was compressed from, or
+// filepath itself when contentEncoding is empty
+func SourcePath(filepath, contentEncoding string) string {
+	if contentEncoding == "" {
+		return filepath
+	}
+	return strings.TrimSuffix(filepath, variantExtensions[contentEncoding])
+}
+
+// Variants returns the variants opts selects for files, each after the variants
+// of the files before it. Only compressible files of at least opts.MinSize get
+// variants, and never when the source already has a file at the variant's path
+// Sizes and hashes are only known once ProcessVariants compresses them
+func Variants(files []FileInfo, opts PrecompressOptions) []FileInfo {
+	existing := map[string]bool{}
+	for _, file := range files {
+		existing[file.Path] = true
+	}
+
+	variants := []FileInfo{}
+	for _, file := range files {
+		if file.ContentEncoding != "" || file.Size < opts.MinSize || !Compressible(file.ContentType) {
+			continue
+		}
+		for _, encoding := range Encodings {
+			path := VariantPath(file.Path, encoding)
+			if !slices.Contains(opts.Encodings, encoding) || existing[path] {
+				continue
+			}
+			variants = append(variants, FileInfo{Path: path, ContentType: file.ContentType, ContentEncoding: encoding})
+		}
+	}
+	return variants
+}
+
+// Compression levels of the variants, a moderate ratio that keeps populate of
+// large bundles quick; gzip.BestCompression and brotli.BestCompression save a
+// few percent more at many times the cost
+const (
+	gzipLevel   = gzip.DefaultCompression
+	brotliLevel = 5
+)
+
+// ProcessVariants compresses the variants opts selects for files, read from
+// fileSystem, and hands each to callback with its size and hash using up to
+// concurrency workers, as ProcessFiles does for the files themselves. Each
+// variant is spooled to a temporary file, so memory does not grow with file size
+func ProcessVariants(fileSystem fs.FS, files []FileInfo, opts PrecompressOptions, concurrency int, callback func(FileInfo) error) ([]FileInfo, UploadStats, error) {
+	start := time.Now()
+	variants := Variants(files, opts)
+	stats, err := processAll(variants, concurrency, func(variant *FileInfo) error {
+		spool, err := os.CreateTemp("", "valpop-variant-")
+		if err != nil {
+			return fmt.Errorf("could not create temporary file: %w", err)
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+
+		hash := sha256.New()
+		err = compressFile(fileSystem, SourcePath(variant.Path, variant.ContentEncoding), variant.ContentEncoding, io.MultiWriter(spool, hash))
+		if err != nil {
+			return err
+		}
+		variant.Size, err = spool.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		_, err = spool.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		variant.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+		info := *variant
+		info.Reader = spool
+		return callback(info)
+	})
+	stats.Duration = time.Since(start)
+	return variants, stats, err
+}
+
+// compressFile writes the contents of filepath compressed with encoding to w
+// The gzip header carries no name or time, so the same file always compresses
+// to the same bytes and unchanged variants are skipped like files
+func compressFile(fileSystem fs.FS, filepath, encoding string, w io.Writer) error {
+	f, err := fileSystem.Open(filepath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var writer io.WriteCloser
+	switch encoding {
+	case EncodingGzip:
+		writer, err = gzip.NewWriterLevel(w, gzipLevel)
+		if err != nil {
+			return err
+		}
+	case EncodingBrotli:
+		writer = brotli.NewWriterLevel(w, brotliLevel)
+	default:
+		return fmt.Errorf("unknown content encoding %q", encoding)
+	}
+
+	_, err = io.Copy(writer, f)
+	if err != nil {
+		return fmt.Errorf("could not compress %s: %w", filepath, err)
+	}
+	err = writer.Close()
+	if err != nil {
+		return fmt.Errorf("could not compress %s: %w", filepath, err)
+	}
+	return nil
+}
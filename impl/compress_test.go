@@ -0,0 +1,143 @@
+package impl_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"sync"
+	"testing/fstest"
+
+	"github.com/andybalholm/brotli"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/RedHatInsights/valpop/impl"
+)
+
+var _ = Describe("Precompression", func() {
+	script := strings.Repeat("console.log('valpop');\n", 100)
+	mockFS := fstest.MapFS{
+		"index.html":    {Data: []byte(strings.Repeat("<p>valpop</p>\n", 100))},
+		"app.js":        {Data: []byte(script)},
+		"tiny.js":       {Data: []byte("x")},
+		"logo.png":      {Data: bytes.Repeat([]byte{0x89}, 4096)},
+		"vendor.js":     {Data: []byte(script)},
+		"vendor.js.gz":  {Data: []byte("built by the bundler")},
+		"styles/a.css":  {Data: []byte(strings.Repeat("a { color: red }\n", 100))},
+		"data/big.json": {Data: []byte(strings.Repeat(`{"a": 1}`, 200))},
+	}
+	opts := impl.PrecompressOptions{Encodings: []string{impl.EncodingGzip, impl.EncodingBrotli}, MinSize: 1024}
+
+	files := func() []impl.FileInfo {
+		files, _, err := impl.ProcessFiles(mockFS, 1, func(impl.FileInfo) error { return nil })
+		Expect(err).ToNot(HaveOccurred())
+		return files
+	}
+
+	Context("Variants", func() {
+		It("should select compressible files above the minimum size", func() {
+			Expect(impl.FilePaths(impl.Variants(files(), opts))).To(Equal([]string{
+				"app.js.br", "app.js.gz",
+				"data/big.json.br", "data/big.json.gz",
+				"index.html.br", "index.html.gz",
+				"styles/a.css.br", "styles/a.css.gz",
+				// vendor.js.gz is shipped by the build and left alone
+				"vendor.js.br",
+			}))
+		})
+
+		It("should only write the requested encodings", func() {
+			variants := impl.Variants(files(), impl.PrecompressOptions{Encodings: []string{impl.EncodingGzip}, MinSize: 1024})
+			Expect(variants).ToNot(BeEmpty())
+			for _, variant := range variants {
+				Expect(variant.Path).To(HaveSuffix(".gz"))
+				Expect(variant.ContentEncoding).To(Equal(impl.EncodingGzip))
+			}
+		})
+
+		It("should keep the content type of the source file", func() {
+			variant := impl.Variants(files(), opts)[0]
+			Expect(variant.ContentType).To(Equal("application/javascript"))
+			Expect(impl.SourcePath(variant.Path, variant.ContentEncoding)).To(Equal("app.js"))
+		})
+	})
+
+	Context("ProcessVariants", func() {
+		It("should compress each variant and hand it over with its size and hash", func() {
+			var mu sync.Mutex
+			contents := map[string][]byte{}
+			variants, stats, err := impl.ProcessVariants(mockFS, files(), opts, 3, func(file impl.FileInfo) error {
+				content, err := io.ReadAll(file.Reader)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(int64(len(content))).To(Equal(file.Size))
+				hash, err := impl.HashContent(bytes.NewReader(content))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(hash).To(Equal(file.SHA256))
+				mu.Lock()
+				contents[file.Path] = content
+				mu.Unlock()
+				return nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(variants).To(HaveLen(9))
+			Expect(stats.Files).To(Equal(9))
+
+			gz, err := gzip.NewReader(bytes.NewReader(contents["app.js.gz"]))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(io.ReadAll(gz)).To(Equal([]byte(script)))
+			Expect(io.ReadAll(brotli.NewReader(bytes.NewReader(contents["app.js.br"])))).To(Equal([]byte(script)))
+			Expect(len(contents["app.js.br"])).To(BeNumerically("<", len(script)))
+		})
+
+		It("should compress the same file to the same bytes every time", func() {
+			hashes := func() map[string]string {
+				variants, _, err := impl.ProcessVariants(mockFS, files(), opts, 1, func(impl.FileInfo) error { return nil })
+				Expect(err).ToNot(HaveOccurred())
+				hashes := map[string]string{}
+				for _, variant := range variants {
+					hashes[variant.Path] = variant.SHA256
+				}
+				return hashes
+			}
+			Expect(hashes()).To(Equal(hashes()))
+			Expect(hashes()["app.js.br"]).To(Equal(hashes()["vendor.js.br"]))
+		})
+
+		It("should process nothing without encodings", func() {
+			variants, stats, err := impl.ProcessVariants(mockFS, files(), impl.PrecompressOptions{}, 1, func(impl.FileInfo) error {
+				Fail("no variant expected")
+				return nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(variants).To(BeEmpty())
+			Expect(stats.Files).To(BeZero())
+		})
+	})
+
+	Context("Compressible", func() {
+		DescribeTable("should only compress types that shrink",
+			func(contentType string, compressible bool) {
+				Expect(impl.Compressible(contentType)).To(Equal(compressible))
+			},
+			Entry("html", "text/html; charset=utf-8", true),
+			Entry("javascript", "application/javascript", true),
+			Entry("json", "application/json", true),
+			Entry("svg", "image/svg+xml", true),
+			Entry("png", "image/png", false),
+			Entry("woff2", "font/woff2", false),
+			Entry("unknown", "application/octet-stream", false),
+		)
+	})
+
+	Context("ValidatePrecompress", func() {
+		It("should accept the supported encodings", func() {
+			Expect(impl.ValidatePrecompress(opts)).To(Succeed())
+		})
+
+		It("should reject unknown encodings", func() {
+			err := impl.ValidatePrecompress(impl.PrecompressOptions{Encodings: []string{"zstd"}})
+			Expect(err).To(MatchError(ContainSubstring(`unknown precompress encoding "zstd", must be one of: br, gzip`)))
+		})
+	})
+})
@@ -0,0 +1,231 @@
+package impl
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// IgnoreFile is the gitignore-style file at the root of a source directory
+// listing paths populate leaves out. It is never uploaded itself
+const IgnoreFile = ".valpopignore"
+
+// FileFilter selects the files of a source directory populate uploads
+// The zero value selects every file; globs are matched with MatchGlob
+type FileFilter struct {
+	// Include limits uploads to the files matching one of these globs, when set
+	Include []string
+	// Exclude leaves out the files and directories matching any of these globs
+	Exclude []string
+	ignore  []ignoreRule
+}
+
+// ignoreRule is one pattern line of IgnoreFile
+type ignoreRule struct {
+	segments []string
+	negate   bool
+	dirOnly  bool
+}
+
+// NewFileFilter builds the filter of the --include and --exclude globs and the
+// IgnoreFile at the root of source, if there is one. Entries may hold several
+// comma separated globs, as VALPOP_INCLUDE and VALPOP_EXCLUDE do
+func NewFileFilter(source fs.FS, include, exclude []string) (FileFilter, error) {
+	filter := FileFilter{Include: splitPatterns(include), Exclude: splitPatterns(exclude)}
+	for flag, patterns := range map[string][]string{"include": filter.Include, "exclude": filter.Exclude} {
+		for _, pattern := range patterns {
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return FileFilter{}, fmt.Errorf("invalid %s pattern %q: %w", flag, pattern, err)
+			}
+		}
+	}
+
+	raw, err := fs.ReadFile(source, IgnoreFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return filter, nil
+	}
+	if err != nil {
+		return FileFilter{}, fmt.Errorf("could not read %s: %w", IgnoreFile, err)
+	}
+	filter.ignore, err = parseIgnore(raw)
+	return filter, err
+}
+
+// parseIgnore reads the rules of an IgnoreFile: blank lines and lines starting
+// with '#' are skipped, '!' re-includes, a trailing '/' only matches
+// directories, '**' matches any number of directories, and patterns without a
+// '/' before their end match at any depth while others are relative to the root
+func parseIgnore(raw []byte) ([]ignoreRule, error) {
+	rules := []ignoreRule{}
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule := ignoreRule{}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if !strings.Contains(line, "/") {
+			line = "**/" + line
+		}
+		line = strings.TrimPrefix(line, "/")
+		if line == "" {
+			continue
+		}
+
+		rule.segments = strings.Split(line, "/")
+		for _, segment := range rule.segments {
+			if _, err := path.Match(segment, ""); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid pattern %q: %w", IgnoreFile, number, scanner.Text(), err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// matchSegments reports whether the path segments name match the pattern
+// segments, where "**" matches any number of segments
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(name); i >= 0; i-- {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(pattern[0], name[0]); !matched {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// Excluded reports whether populate leaves out the file or directory at
+// filepath. Exclude globs and IgnoreFile rules apply to both, Include globs
+// only to files; the last IgnoreFile rule matching a path decides it
+func (f FileFilter) Excluded(filepath string, dir bool) bool {
+	if filepath == IgnoreFile && !dir {
+		return true
+	}
+	if MatchGlob(filepath, f.Exclude) {
+		return true
+	}
+
+	ignored := false
+	segments := strings.Split(filepath, "/")
+	for _, rule := range f.ignore {
+		if rule.dirOnly && !dir {
+			continue
+		}
+		if matchSegments(rule.segments, segments) {
+			ignored = !rule.negate
+		}
+	}
+	if ignored {
+		return true
+	}
+
+	return !dir && len(f.Include) > 0 && !MatchGlob(filepath, f.Include)
+}
+
+// ExcludedPaths walks source and returns the paths populate leaves out, in walk
+// order. Directories end in '/' and stand for everything beneath them
+func (f FileFilter) ExcludedPaths(source fs.FS) ([]string, error) {
+	excluded := []string{}
+	err := fs.WalkDir(source, ".", func(filepath string, d fs.DirEntry, err error) error {
+		if err != nil || filepath == "." {
+			return err
+		}
+		if !f.Excluded(filepath, d.IsDir()) {
+			return nil
+		}
+		if d.IsDir() {
+			excluded = append(excluded, filepath+"/")
+			return fs.SkipDir
+		}
+		excluded = append(excluded, filepath)
+		return nil
+	})
+	return excluded, err
+}
+
+// FilterFS returns source without the paths filter excludes, which neither
+// appear in directory listings nor open, so populate walks only what it uploads
+func FilterFS(source fs.FS, filter FileFilter) fs.FS {
+	return filteredFS{source: source, filter: filter}
+}
+
+type filteredFS struct {
+	source fs.FS
+	filter FileFilter
+}
+
+// hidden reports whether name or one of its parent directories is excluded
+func (f filteredFS) hidden(name string) (bool, error) {
+	if name == "." {
+		return false, nil
+	}
+	segments := strings.Split(name, "/")
+	for i := 1; i < len(segments); i++ {
+		if f.filter.Excluded(strings.Join(segments[:i], "/"), true) {
+			return true, nil
+		}
+	}
+	info, err := fs.Stat(f.source, name)
+	if err != nil {
+		return false, err
+	}
+	return f.filter.Excluded(name, info.IsDir()), nil
+}
+
+func (f filteredFS) Open(name string) (fs.File, error) {
+	hidden, err := f.hidden(name)
+	if err != nil {
+		return nil, err
+	}
+	if hidden {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return f.source.Open(name)
+}
+
+func (f filteredFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	hidden, err := f.hidden(name)
+	if err != nil {
+		return nil, err
+	}
+	if hidden {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	entries, err := fs.ReadDir(f.source, name)
+	kept := entries[:0]
+	for _, entry := range entries {
+		if !f.filter.Excluded(path.Join(name, entry.Name()), entry.IsDir()) {
+			kept = append(kept, entry)
+		}
+	}
+	return kept, err
+}
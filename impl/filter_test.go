@@ -0,0 +1,119 @@
+package impl_test
+
+import (
+	"io/fs"
+	"testing/fstest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/RedHatInsights/valpop/impl"
+)
+
+var _ = Describe("File filter", func() {
+	source := fstest.MapFS{
+		"index.html":              {Data: []byte("<html></html>")},
+		".DS_Store":               {Data: []byte("junk")},
+		"app.js":                  {Data: []byte("app")},
+		"app.js.map":              {Data: []byte("{}")},
+		"vendor.js.map":           {Data: []byte("{}")},
+		".git/HEAD":               {Data: []byte("ref")},
+		"static/logo.png":         {Data: []byte("png")},
+		"static/fixtures/a.json":  {Data: []byte("{}")},
+		"test/fixtures/data.json": {Data: []byte("{}")},
+		"build/stats.json":        {Data: []byte("{}")},
+		"nested/build/keep.js":    {Data: []byte("keep")},
+		impl.IgnoreFile: {Data: []byte(`# editor and VCS leftovers
+.DS_Store
+.git/
+
+# source maps, except the vendor one
+*.map
+!vendor.js.map
+
+/build
+**/fixtures/*.json
+`)},
+	}
+
+	Context("NewFileFilter", func() {
+		It("should split comma separated globs", func() {
+			filter, err := impl.NewFileFilter(fstest.MapFS{}, []string{"*.js, *.css"}, []string{"*.map"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(filter.Include).To(Equal([]string{"*.js", "*.css"}))
+			Expect(filter.Exclude).To(Equal([]string{"*.map"}))
+		})
+
+		It("should reject invalid globs", func() {
+			_, err := impl.NewFileFilter(fstest.MapFS{}, []string{"[a-"}, nil)
+			Expect(err).To(MatchError(ContainSubstring(`invalid include pattern "[a-"`)))
+		})
+
+		It("should report the line of an invalid ignore pattern", func() {
+			_, err := impl.NewFileFilter(fstest.MapFS{impl.IgnoreFile: {Data: []byte("*.map\nstatic/[a-\n")}}, nil, nil)
+			Expect(err).To(MatchError(ContainSubstring(`.valpopignore:2: invalid pattern "static/[a-"`)))
+		})
+	})
+
+	Context("Excluded", func() {
+		filter, err := impl.NewFileFilter(source, nil, nil)
+
+		DescribeTable("should follow gitignore rules",
+			func(filepath string, dir, excluded bool) {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(filter.Excluded(filepath, dir)).To(Equal(excluded))
+			},
+			Entry("plain file", "index.html", false, false),
+			Entry("name at the root", ".DS_Store", false, true),
+			Entry("name at any depth", "static/.DS_Store", false, true),
+			Entry("directory rule on a directory", ".git", true, true),
+			Entry("directory rule on a file", "static/.git", false, false),
+			Entry("glob", "app.js.map", false, true),
+			Entry("negated glob", "vendor.js.map", false, false),
+			Entry("anchored to the root", "build", true, true),
+			Entry("anchored rule at depth", "nested/build", true, false),
+			Entry("double star", "test/fixtures/data.json", false, true),
+			Entry("double star at the root", "fixtures/data.json", false, true),
+			Entry("the ignore file itself", impl.IgnoreFile, false, true),
+		)
+
+		It("should apply include globs to files only", func() {
+			filter := impl.FileFilter{Include: []string{"*.js"}, Exclude: []string{"static/*"}}
+			Expect(filter.Excluded("app.js", false)).To(BeFalse())
+			Expect(filter.Excluded("nested/build/keep.js", false)).To(BeFalse())
+			Expect(filter.Excluded("nested", true)).To(BeFalse())
+			Expect(filter.Excluded("index.html", false)).To(BeTrue())
+			Expect(filter.Excluded("static/app.js", false)).To(BeTrue())
+		})
+
+		It("should exclude nothing by default", func() {
+			Expect(impl.FileFilter{}.Excluded(".git", true)).To(BeFalse())
+			Expect(impl.FileFilter{}.Excluded("app.js.map", false)).To(BeFalse())
+		})
+	})
+
+	Context("FilterFS", func() {
+		filter, err := impl.NewFileFilter(source, nil, []string{"*.png"})
+
+		It("should list excluded paths in walk order", func() {
+			Expect(err).ToNot(HaveOccurred())
+			excluded, err := filter.ExcludedPaths(source)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(excluded).To(Equal([]string{
+				".DS_Store", ".git/", impl.IgnoreFile, "app.js.map", "build/",
+				"static/fixtures/a.json", "static/logo.png", "test/fixtures/data.json",
+			}))
+		})
+
+		It("should only walk and open the files left in", func() {
+			files, _, err := impl.ProcessFiles(impl.FilterFS(source, filter), 1, func(impl.FileInfo) error { return nil })
+			Expect(err).ToNot(HaveOccurred())
+			Expect(impl.FilePaths(files)).To(Equal([]string{"app.js", "index.html", "nested/build/keep.js", "vendor.js.map"}))
+
+			_, err = impl.FilterFS(source, filter).Open(".git/HEAD")
+			Expect(err).To(MatchError(fs.ErrNotExist))
+			_, err = fs.Stat(impl.FilterFS(source, filter), "static/logo.png")
+			Expect(err).To(MatchError(fs.ErrNotExist))
+		})
+	})
+})
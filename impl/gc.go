@@ -0,0 +1,93 @@
+package impl
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrDeletionCap is returned when gc would delete more keys than allowed
+var ErrDeletionCap = errors.New("deletion cap exceeded")
+
+// GCOptions carries the per-run settings of a gc
+type GCOptions struct {
+	Timeout         int64
+	MinAssetRecords int64
+	// MaxDeletions refuses a gc that would delete more keys from the prefix,
+	// 0 for no cap. Dry runs report every key regardless
+	MaxDeletions int
+	DryRun       bool
+	// Orphans also removes data keys no retained manifest references once they
+	// are older than OrphanGrace seconds
+	Orphans     bool
+	OrphanGrace int64
+}
+
+// GCResult lists the keys gc removed from a prefix, or would remove on a dry run
+type GCResult struct {
+	Prefix  string          `json:"prefix"`
+	DryRun  bool            `json:"dryRun"`
+	Deletes []PlannedChange `json:"deletes"`
+	// Bytes is the total size of the deleted keys
+	Bytes int64 `json:"bytes"`
+}
+
+// NewGCResult returns an empty result, whose deletes encode as [] rather than null
+func NewGCResult(prefix string, dryRun bool) GCResult {
+	return GCResult{Prefix: prefix, DryRun: dryRun, Deletes: []PlannedChange{}}
+}
+
+// Add records the deletion of key, size bytes
+func (r *GCResult) Add(key string, size int64) {
+	r.add(ActionDelete, key, size)
+}
+
+// AddOrphan records the deletion of an unreferenced data key, size bytes
+func (r *GCResult) AddOrphan(key string, size int64) {
+	r.add(ActionOrphan, key, size)
+}
+
+func (r *GCResult) add(action, key string, size int64) {
+	r.Deletes = append(r.Deletes, PlannedChange{Action: action, Key: key, Size: size})
+	r.Bytes += size
+}
+
+// CheckCap returns ErrDeletionCap when the result deletes more than maxDeletions
+// keys; a cap of 0 allows any number
+func (r GCResult) CheckCap(maxDeletions int) error {
+	if maxDeletions > 0 && len(r.Deletes) > maxDeletions {
+		return fmt.Errorf("%w: gc of %s would delete %d keys, more than %d", ErrDeletionCap, r.Prefix, len(r.Deletes), maxDeletions)
+	}
+	return nil
+}
+
+// GCReport is printed as a summary per prefix, or as a JSON array with --json
+type GCReport []GCResult
+
+func (r GCReport) String() string {
+	var sb strings.Builder
+	keys, bytes, dryRun := 0, int64(0), false
+	for _, result := range r {
+		verb := "removed"
+		if result.DryRun {
+			verb, dryRun = "would remove", true
+		}
+		fmt.Fprintf(&sb, "%s: %s %d keys (%d bytes)\n", result.Prefix, verb, len(result.Deletes), result.Bytes)
+		for _, change := range result.Deletes {
+			if change.Action == ActionOrphan {
+				fmt.Fprintf(&sb, "  %s (%d bytes, orphan)\n", change.Key, change.Size)
+				continue
+			}
+			fmt.Fprintf(&sb, "  %s (%d bytes)\n", change.Key, change.Size)
+		}
+		keys += len(result.Deletes)
+		bytes += result.Bytes
+	}
+
+	verb := "Reclaimed"
+	if dryRun {
+		verb = "Would reclaim"
+	}
+	fmt.Fprintf(&sb, "%s %d bytes from %d keys in %d prefixes\n", verb, bytes, keys, len(r))
+	return sb.String()
+}
@@ -0,0 +1,54 @@
+package impl_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/RedHatInsights/valpop/impl"
+)
+
+var _ = Describe("GC", func() {
+	var result impl.GCResult
+
+	BeforeEach(func() {
+		result = impl.NewGCResult("myapp", false)
+		result.Add("data/myapp/old.js", 100)
+		result.Add("manifests/myapp/1000", 50)
+	})
+
+	It("should total the deleted bytes", func() {
+		Expect(result.Deletes).To(HaveLen(2))
+		Expect(result.Bytes).To(Equal(int64(150)))
+	})
+
+	DescribeTable("should enforce the deletion cap",
+		func(maxDeletions int, exceeded bool) {
+			err := result.CheckCap(maxDeletions)
+			Expect(errors.Is(err, impl.ErrDeletionCap)).To(Equal(exceeded))
+		},
+		Entry("no cap", 0, false),
+		Entry("cap equal to the deletions", 2, false),
+		Entry("cap below the deletions", 1, true),
+	)
+
+	It("should mark orphans", func() {
+		result.AddOrphan("data/myapp/zombie.js", 25)
+
+		Expect(result.Bytes).To(Equal(int64(175)))
+		Expect(result.Deletes[2].Action).To(Equal(impl.ActionOrphan))
+		Expect(impl.GCReport{result}.String()).To(ContainSubstring("  data/myapp/zombie.js (25 bytes, orphan)\n"))
+	})
+
+	It("should summarise every prefix", func() {
+		report := impl.GCReport{result, impl.NewGCResult("otherapp", false)}
+
+		Expect(report.String()).To(Equal(`myapp: removed 2 keys (150 bytes)
+  data/myapp/old.js (100 bytes)
+  manifests/myapp/1000 (50 bytes)
+otherapp: removed 0 keys (0 bytes)
+Reclaimed 150 bytes from 2 keys in 2 prefixes
+`))
+	})
+})
@@ -0,0 +1,23 @@
+package impl
+
+import (
+	"path"
+	"strings"
+)
+
+// MatchGlob reports whether filepath matches one of the glob patterns, as
+// --protect, cache rules, --include and --exclude match them. Patterns
+// containing a '/' match the whole path, others match the file name at any
+// depth, so "*.html" matches every HTML file. Invalid patterns never match
+func MatchGlob(filepath string, patterns []string) bool {
+	for _, pattern := range patterns {
+		name := filepath
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(filepath)
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,31 @@
+package impl_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/RedHatInsights/valpop/impl"
+)
+
+var _ = Describe("Globs", func() {
+	Context("MatchGlob", func() {
+		patterns := []string{"fed-mods.json", "*.html", "static/entry-*.js"}
+
+		DescribeTable("should match names at any depth and paths from the root",
+			func(filepath string, matched bool) {
+				Expect(impl.MatchGlob(filepath, patterns)).To(Equal(matched))
+			},
+			Entry("exact name", "fed-mods.json", true),
+			Entry("nested name", "apps/chrome/fed-mods.json", true),
+			Entry("name glob", "index.html", true),
+			Entry("nested name glob", "admin/index.html", true),
+			Entry("path glob", "static/entry-1a2b.js", true),
+			Entry("path glob at another depth", "js/static/entry-1a2b.js", false),
+			Entry("unmatched file", "static/chunk.js", false),
+		)
+
+		It("should never match invalid patterns", func() {
+			Expect(impl.MatchGlob("index.html", []string{"[index.html"})).To(BeFalse())
+		})
+	})
+})
@@ -1,11 +1,20 @@
 package impl
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"os"
+	fp "path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 // AllItems maps namespace to Items
@@ -23,6 +32,8 @@ type Implementation interface {
 
 	// Item operations
 	SetItem(namespace, filepath, contentType, bucket string, timestamp int64, content string) error
+	// PutItem stores size bytes read from r, without holding the whole file in memory
+	PutItem(namespace, filepath, contentType, bucket string, timestamp int64, r io.Reader, size int64) error
 	GetItem(namespace, filepath string, timestamp int64) (string, error)
 	DelKeys(allItems AllItems) error
 	PopulateFromDir(namespace, bucket, basepath string, timestamp int64) error
@@ -35,32 +46,40 @@ func MakeDataKey(namespace, filepath string) string {
 	return fmt.Sprintf("data/%s/%s", namespace, filepath)
 }
 
+// MakeReleaseDataKey generates the key of a data item in the release layout,
+// where every release has its own copy of each file
+// Format: releases/{namespace}/{timestamp}/{filepath}
+func MakeReleaseDataKey(namespace string, timestamp int64, filepath string) string {
+	return fmt.Sprintf("releases/%s/%d/%s", namespace, timestamp, filepath)
+}
+
+// MakeCurrentKey generates the key of the pointer to the release being served
+// Format: current/{namespace}
+func MakeCurrentKey(namespace string) string {
+	return fmt.Sprintf("current/%s", namespace)
+}
+
+// Storage layouts of data items, recorded in each manifest
+const (
+	// LayoutShared stores every release under the same data keys, see MakeDataKey
+	LayoutShared = "shared"
+	// LayoutRelease stores each release under its own keys, see MakeReleaseDataKey
+	LayoutRelease = "release"
+)
+
 // MakeManifestKey generates a consistent key format for manifests
 // Format: manifests/{namespace}/{timestamp}
 func MakeManifestKey(namespace string, timestamp int64) string {
 	return fmt.Sprintf("manifests/%s/%d", namespace, timestamp)
 }
 
+// GetContentType returns the default Content-Type of filepath from its extension
 func GetContentType(filepath string) string {
-	switch {
-	case strings.HasSuffix(filepath, ".html"):
-		return "text/html; charset=utf-8"
-	case strings.HasSuffix(filepath, ".css"):
-		return "text/css; charset=utf-8"
-	case strings.HasSuffix(filepath, ".js"):
-		return "application/javascript"
-	case strings.HasSuffix(filepath, ".woff2"):
-		return "font/woff2"
-	case strings.HasSuffix(filepath, ".svg"):
-		return "image/svg+xml"
-	case strings.HasSuffix(filepath, ".png"):
-		return "image/png"
-	case strings.HasSuffix(filepath, ".jpeg") || strings.HasSuffix(filepath, ".jpg"):
-		return "image/jpeg"
-	case strings.HasSuffix(filepath, ".json"):
-		return "application/json"
-	}
-	return "application/octet-stream"
+	contentType := ContentTypes{}.ByExtension(filepath)
+	if contentType == "" {
+		return DefaultContentType
+	}
+	return contentType
 }
 
 // ManifestInfo represents a manifest with its metadata
@@ -93,6 +112,7 @@ func DetermineManifestsToDelete(allManifests []ManifestInfo, currentTime, timeou
 
 // DetermineFilesToDelete returns files that should be deleted
 // Files are only deleted if they're in old manifests but not in any kept manifests
+// and match none of the protected glob patterns, see IsProtected
 func DetermineFilesToDelete(oldManifests, keptManifests []ManifestInfo, protectedFiles []string) []string {
 	oldFiles := make(map[string]bool)
 	newFiles := make(map[string]bool)
@@ -117,8 +137,10 @@ func DetermineFilesToDelete(oldManifests, keptManifests []ManifestInfo, protecte
 	}
 
 	// Protect specific files
-	for _, file := range protectedFiles {
-		delete(oldFiles, file)
+	for file := range oldFiles {
+		if IsProtected(file, protectedFiles) {
+			delete(oldFiles, file)
+		}
 	}
 
 	// Convert to slice
@@ -160,18 +182,80 @@ type FileSystemReader interface {
 	ReadFile(name string) ([]byte, error)
 }
 
-// FileInfo represents a file discovered during population
+// FileInfo describes a file handed to a populate callback
+// Reader is only valid for the duration of the callback and yields exactly Size bytes
 type FileInfo struct {
 	Path        string
-	Content     string
 	ContentType string
+	Size        int64
+	// SHA256 is the hex encoded content hash, filled in before the callback runs
+	SHA256 string
+	// ContentEncoding is set on precompressed variants, see ProcessVariants
+	ContentEncoding string
+	Reader          io.Reader
 }
 
 // BuildPopulateManifest walks a filesystem and collects files into a manifest
 // This is the core business logic for populate operations, independent of storage implementation
 func BuildPopulateManifest(fileSystem fs.FS, callback func(FileInfo) error) ([]string, error) {
-	manifest := []string{}
+	files, _, err := ProcessFiles(fileSystem, 1, callback)
+	return FilePaths(files), err
+}
+
+// FilePaths returns the path of each file, in order
+func FilePaths(files []FileInfo) []string {
+	paths := make([]string, len(files))
+	for i, file := range files {
+		paths[i] = file.Path
+	}
+	return paths
+}
 
+// ErrUnchanged is returned by a populate callback that decided a file does not
+// need uploading; it is counted as skipped rather than treated as a failure
+var ErrUnchanged = errors.New("file unchanged")
+
+// UploadStats summarises the files handed to a populate callback
+type UploadStats struct {
+	Files   int
+	Bytes   int64
+	Skipped int
+	// SkippedBytes counts the bytes of files whose callback returned ErrUnchanged
+	SkippedBytes int64
+	Duration     time.Duration
+}
+
+// Throughput returns the average bytes per second over the run
+func (s UploadStats) Throughput() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Duration.Seconds()
+}
+
+// Add sums the counts and durations of two runs
+func (s UploadStats) Add(other UploadStats) UploadStats {
+	return UploadStats{
+		Files:        s.Files + other.Files,
+		Bytes:        s.Bytes + other.Bytes,
+		Skipped:      s.Skipped + other.Skipped,
+		SkippedBytes: s.SkippedBytes + other.SkippedBytes,
+		Duration:     s.Duration + other.Duration,
+	}
+}
+
+func (s UploadStats) String() string {
+	skipped := ""
+	if s.Skipped > 0 {
+		skipped = fmt.Sprintf(", skipped %d unchanged files (%d bytes)", s.Skipped, s.SkippedBytes)
+	}
+	return fmt.Sprintf("Uploaded %d files (%d bytes)%s in %s (%.1f KiB/s)", s.Files, s.Bytes, skipped, s.Duration.Round(time.Millisecond), s.Throughput()/1024)
+}
+
+// walkFiles lists every regular file in fileSystem in walk order
+// Files whose type is not known by extension are left without a type for processFile
+func walkFiles(fileSystem fs.FS, types ContentTypes) ([]FileInfo, error) {
+	files := []FileInfo{}
 	err := fs.WalkDir(fileSystem, ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
@@ -181,46 +265,312 @@ func BuildPopulateManifest(fileSystem fs.FS, callback func(FileInfo) error) ([]s
 			return nil
 		}
 
-		contents, readErr := fs.ReadFile(fileSystem, path)
-		if readErr != nil {
-			return readErr
+		info, err := d.Info()
+		if err != nil {
+			return err
 		}
 
-		manifest = append(manifest, path)
-		contentType := GetContentType(path)
-
-		// Call the callback with file info
-		return callback(FileInfo{
+		files = append(files, FileInfo{
 			Path:        path,
-			Content:     string(contents),
-			ContentType: contentType,
+			ContentType: types.ByExtension(path),
+			Size:        info.Size(),
 		})
+		return nil
+	})
+	return files, err
+}
+
+// HashContent returns the hex encoded SHA-256 of everything read from r
+func HashContent(r io.Reader) (string, error) {
+	hash := sha256.New()
+	_, err := io.Copy(hash, r)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// processFile hashes file, then hands it to callback positioned at the start
+// Files that cannot seek are opened a second time rather than buffered. Files
+// without a type get one from types.Detect, sniffing their first bytes
+func processFile(fileSystem fs.FS, file *FileInfo, types ContentTypes, callback func(FileInfo) error) error {
+	f, err := fileSystem.Open(file.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	file.SHA256, err = HashContent(f)
+	if err != nil {
+		return fmt.Errorf("could not hash %s: %w", file.Path, err)
+	}
+
+	var reader io.Reader
+	if seeker, ok := f.(io.Seeker); ok {
+		_, err = seeker.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		reader = f
+	} else {
+		reopened, err := fileSystem.Open(file.Path)
+		if err != nil {
+			return err
+		}
+		defer reopened.Close()
+		reader = reopened
+	}
+
+	if file.ContentType == "" {
+		var head []byte
+		if types.Sniff {
+			head = make([]byte, sniffLength)
+			n, err := io.ReadFull(reader, head)
+			if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				return fmt.Errorf("could not read %s: %w", file.Path, err)
+			}
+			head = head[:n]
+			reader = io.MultiReader(bytes.NewReader(head), reader)
+		}
+		file.ContentType = types.Detect(head)
+	}
+
+	info := *file
+	info.Reader = reader
+	return callback(info)
+}
+
+// ProcessFiles walks fileSystem and hands every file to callback using up to
+// concurrency workers. The returned files are always in walk order, however the
+// uploads complete, and carry their SHA-256. The first error stops any further
+// files being dispatched and is returned once in-flight callbacks have finished
+func ProcessFiles(fileSystem fs.FS, concurrency int, callback func(FileInfo) error) ([]FileInfo, UploadStats, error) {
+	return ProcessFilesWithTypes(fileSystem, concurrency, ContentTypes{}, callback)
+}
+
+// ProcessFilesWithTypes is ProcessFiles resolving each file's Content-Type with types
+func ProcessFilesWithTypes(fileSystem fs.FS, concurrency int, types ContentTypes, callback func(FileInfo) error) ([]FileInfo, UploadStats, error) {
+	start := time.Now()
+
+	files, err := walkFiles(fileSystem, types)
+	if err != nil {
+		return files, UploadStats{}, err
+	}
+
+	stats, err := processAll(files, concurrency, func(file *FileInfo) error {
+		return processFile(fileSystem, file, types, callback)
 	})
+	stats.Duration = time.Since(start)
+	return files, stats, err
+}
+
+// processAll runs process on every file using up to concurrency workers, counting
+// the files it stores and those it skips with ErrUnchanged. The first error stops
+// any further files being dispatched and is returned once in-flight ones finish
+func processAll(files []FileInfo, concurrency int, process func(file *FileInfo) error) (UploadStats, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		once     sync.Once
+		firstErr error
+		stats    UploadStats
+	)
+	jobs := make(chan int)
+	failed := make(chan struct{})
+
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				// Each index is handed to exactly one worker, so writing the hash back is safe
+				file := &files[i]
+				err := process(file)
+				if errors.Is(err, ErrUnchanged) {
+					mu.Lock()
+					stats.Skipped++
+					stats.SkippedBytes += file.Size
+					mu.Unlock()
+					continue
+				}
+				if err != nil {
+					once.Do(func() {
+						firstErr = err
+						close(failed)
+					})
+					continue
+				}
+
+				mu.Lock()
+				stats.Files++
+				stats.Bytes += file.Size
+				mu.Unlock()
+			}
+		}()
+	}
+
+dispatch:
+	for i := range files {
+		// Check for a failure first so nothing new starts once one has been seen
+		select {
+		case <-failed:
+			break dispatch
+		default:
+		}
 
-	return manifest, err
+		select {
+		case jobs <- i:
+		case <-failed:
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return stats, firstErr
+}
+
+// WriteFile copies the contents of r to filepath under root, creating any missing
+// parent directories so the source directory layout is reproduced
+func WriteFile(root, filepath string, r io.Reader) error {
+	// Manifest paths come from fs.WalkDir and are always relative; refuse anything
+	// that would escape the destination directory
+	if !fp.IsLocal(filepath) {
+		return fmt.Errorf("refusing to write non-local path: %s", filepath)
+	}
+
+	path := fp.Join(root, fp.FromSlash(filepath))
+	err := os.MkdirAll(fp.Dir(path), os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("could not create directory: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0664)
+	if err != nil {
+		return fmt.Errorf("could not create file: %w", err)
+	}
+
+	_, err = io.Copy(file, r)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("could not write file: %w", err)
+	}
+	return file.Close()
+}
+
+// ManifestVersion is the manifest schema written by this version of valpop
+// Version 1 is the object format with only a file list; unversioned manifests are treated as 1
+const ManifestVersion = 2
+
+// FileEntry records what was stored for a single file of a release
+type FileEntry struct {
+	Path         string `json:"path"`
+	Size         int64  `json:"size"`
+	SHA256       string `json:"sha256,omitempty"`
+	ContentType  string `json:"contentType,omitempty"`
+	CacheControl string `json:"cacheControl,omitempty"`
+	// ContentEncoding marks a precompressed variant of the file without its extension
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+	// CacheRule is the pattern of the cache rule that chose CacheControl
+	CacheRule string `json:"cacheRule,omitempty"`
+	// VersionID is the object version holding this content, when the bucket is versioned
+	VersionID string `json:"versionId,omitempty"`
 }
 
 // Manifest represents the structure of a manifest
+// Files is still written alongside Entries so older valpop releases can pop v2
+// manifests of the shared layout; they do not know the release layout keys
 type Manifest struct {
-	Files       []string `json:"files"`
-	Image       string   `json:"image"`
-	ValpopImage string   `json:"valpopImage,omitempty"`
-	Timestamp   int64    `json:"timestamp"`
+	Version     int         `json:"version,omitempty"`
+	Files       []string    `json:"files"`
+	Entries     []FileEntry `json:"entries,omitempty"`
+	Image       string      `json:"image"`
+	ValpopImage string      `json:"valpopImage,omitempty"`
+	Timestamp   int64       `json:"timestamp"`
+	// RolledBackFrom is the timestamp of the release this one restored, if any
+	RolledBackFrom int64 `json:"rolledBackFrom,omitempty"`
+	// Layout is where the release's data is stored; empty means LayoutShared
+	Layout string `json:"layout,omitempty"`
+}
+
+// DataKey returns the key holding filepath for this release, following its layout
+func (m Manifest) DataKey(namespace, filepath string) string {
+	if m.Layout == LayoutRelease {
+		return MakeReleaseDataKey(namespace, m.Timestamp, filepath)
+	}
+	return MakeDataKey(namespace, filepath)
+}
+
+// NewManifest builds a current-version manifest for files in walk order
+// cacheControl may be nil for backends that do not set per-file headers
+func NewManifest(files []FileInfo, image, valpopImage string, timestamp int64, cacheControl func(path string) string) Manifest {
+	manifest := Manifest{
+		Version:     ManifestVersion,
+		Files:       FilePaths(files),
+		Entries:     make([]FileEntry, len(files)),
+		Image:       image,
+		ValpopImage: valpopImage,
+		Timestamp:   timestamp,
+	}
+	for i, file := range files {
+		manifest.Entries[i] = FileEntry{
+			Path:            file.Path,
+			Size:            file.Size,
+			SHA256:          file.SHA256,
+			ContentType:     file.ContentType,
+			ContentEncoding: file.ContentEncoding,
+		}
+		if cacheControl != nil {
+			manifest.Entries[i].CacheControl = cacheControl(file.Path)
+		}
+	}
+	return manifest
+}
+
+// Entry returns the entry recorded for path
+func (m Manifest) Entry(path string) (FileEntry, bool) {
+	for _, entry := range m.Entries {
+		if entry.Path == path {
+			return entry, true
+		}
+	}
+	return FileEntry{}, false
 }
 
 // ParseManifest unmarshals a manifest from JSON bytes
-// Returns the manifest data, handling both old (array) and new (object) formats
+// It reads the legacy array format, the version 1 object format and the current
+// versioned format; the result always has both Files and Entries filled in
 func ParseManifest(rawData []byte) (Manifest, error) {
 	// Trim whitespace to check format
 	trimmed := strings.TrimSpace(string(rawData))
 
-	// Check if it's the new object format (starts with '{')
+	// Check if it's an object format (starts with '{')
 	if strings.HasPrefix(trimmed, "{") {
 		var manifest Manifest
 		err := json.Unmarshal(rawData, &manifest)
 		if err != nil {
 			return Manifest{}, fmt.Errorf("could not unmarshal manifest: %w", err)
 		}
+
+		if manifest.Version > ManifestVersion {
+			return Manifest{}, fmt.Errorf("unsupported manifest version %d, this valpop reads up to %d", manifest.Version, ManifestVersion)
+		}
+		if manifest.Version == 0 {
+			manifest.Version = 1
+		}
+
+		if len(manifest.Entries) == 0 {
+			manifest.Entries = legacyEntries(manifest.Files)
+		} else if len(manifest.Files) == 0 {
+			manifest.Files = make([]string, len(manifest.Entries))
+			for i, entry := range manifest.Entries {
+				manifest.Files[i] = entry.Path
+			}
+		}
 		return manifest, nil
 	}
 
@@ -233,8 +583,23 @@ func ParseManifest(rawData []byte) (Manifest, error) {
 
 	// Convert old format to new format
 	return Manifest{
+		Version:   1,
 		Files:     files,
+		Entries:   legacyEntries(files),
 		Image:     "",
 		Timestamp: 0,
 	}, nil
 }
+
+// legacyEntries fills in what older manifests know about each file; sizes
+// and hashes were never recorded, so they stay empty
+func legacyEntries(files []string) []FileEntry {
+	entries := make([]FileEntry, len(files))
+	for i, file := range files {
+		entries[i] = FileEntry{
+			Path:        file,
+			ContentType: GetContentType(file),
+		}
+	}
+	return entries
+}
@@ -1,15 +1,23 @@
 package impl_test
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"testing/fstest"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
 	"github.com/RedHatInsights/valpop/impl"
+	"github.com/RedHatInsights/valpop/impl/mock"
+	"github.com/RedHatInsights/valpop/impl/s3"
 )
 
 func TestStorageBackends(t *testing.T) {
@@ -61,6 +69,14 @@ func (m *MockStorage) SetItem(namespace, filepath, contentType, bucket string, t
 	return nil
 }
 
+func (m *MockStorage) PutItem(namespace, filepath, contentType, bucket string, timestamp int64, r io.Reader, size int64) error {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return m.SetItem(namespace, filepath, contentType, bucket, timestamp, string(content))
+}
+
 func (m *MockStorage) GetItem(namespace, filepath string, timestamp int64) (string, error) {
 	if m.closed {
 		return "", fmt.Errorf("storage is closed")
@@ -126,6 +142,12 @@ func (m *MockStorage) Close() {
 	m.namespaces = make(map[string]bool)
 }
 
+// newMinioBackend returns the real S3 backend wired to an in-memory S3 client
+func newMinioBackend() impl.Implementation {
+	minio := s3.NewMinioWithClient(mock.NewS3Client(), "test-bucket", 86400)
+	return &minio
+}
+
 var _ = Describe("Storage Backend Drop-in Replacements", func() {
 	var (
 		testNamespace = "test-app"
@@ -249,6 +271,7 @@ var _ = Describe("Storage Backend Drop-in Replacements", func() {
 				backend impl.Implementation
 			}{
 				{"MockStorage", NewMockStorage()},
+				{"S3 (mock client)", newMinioBackend()},
 			}
 
 			for _, b := range backends {
@@ -509,6 +532,24 @@ var _ = Describe("Storage Backend Drop-in Replacements", func() {
 			})
 		})
 
+		Context("Release layout keys", func() {
+			It("should scope data keys to the release", func() {
+				Expect(impl.MakeReleaseDataKey("myapp", 1234567890, "static/app.js")).To(Equal("releases/myapp/1234567890/static/app.js"))
+			})
+
+			It("should generate the current pointer key", func() {
+				Expect(impl.MakeCurrentKey("myapp")).To(Equal("current/myapp"))
+			})
+
+			It("should resolve data keys from the manifest layout", func() {
+				shared := impl.Manifest{Timestamp: 1000}
+				release := impl.Manifest{Timestamp: 1000, Layout: impl.LayoutRelease}
+
+				Expect(shared.DataKey("myapp", "index.html")).To(Equal("data/myapp/index.html"))
+				Expect(release.DataKey("myapp", "index.html")).To(Equal("releases/myapp/1000/index.html"))
+			})
+		})
+
 		Context("GetContentType", func() {
 			It("should return correct content type for HTML", func() {
 				contentType := impl.GetContentType("index.html")
@@ -702,6 +743,17 @@ var _ = Describe("Storage Backend Drop-in Replacements", func() {
 
 				Expect(filesToDelete).To(ConsistOf("index.html"))
 			})
+
+			It("should protect files matching glob patterns", func() {
+				oldManifests := []impl.ManifestInfo{
+					{Key: "m1", Timestamp: 1000, Files: []string{"index.html", "admin/index.html", "static/entry-1.js", "static/chunk.js"}},
+				}
+				keptManifests := []impl.ManifestInfo{}
+
+				filesToDelete := impl.DetermineFilesToDelete(oldManifests, keptManifests, []string{"*.html", "static/entry-*.js"})
+
+				Expect(filesToDelete).To(ConsistOf("static/chunk.js"))
+			})
 		})
 
 		Context("BuildPopulateManifest", func() {
@@ -798,14 +850,190 @@ var _ = Describe("Storage Backend Drop-in Replacements", func() {
 				}
 
 				var capturedContent string
+				var capturedSize int64
 				_, err := impl.BuildPopulateManifest(mockFS, func(file impl.FileInfo) error {
-					capturedContent = file.Content
-					return nil
+					content, err := io.ReadAll(file.Reader)
+					capturedContent = string(content)
+					capturedSize = file.Size
+					return err
 				})
 
 				Expect(err).ToNot(HaveOccurred())
 				Expect(capturedContent).To(Equal(expectedContent))
+				Expect(capturedSize).To(Equal(int64(len(expectedContent))))
+			})
+
+			It("should stream files without reading them up front", func() {
+				mockFS := fstest.MapFS{
+					"big.wasm":  {Data: make([]byte, 1<<20)},
+					"small.txt": {Data: []byte("small")},
+				}
+
+				seen := map[string]int64{}
+				_, err := impl.BuildPopulateManifest(mockFS, func(file impl.FileInfo) error {
+					// Only read a prefix; the rest of the file is never loaded
+					n, err := io.CopyN(io.Discard, file.Reader, 4)
+					seen[file.Path] = file.Size
+					Expect(n).To(Equal(int64(4)))
+					return err
+				})
+
+				Expect(err).ToNot(HaveOccurred())
+				Expect(seen).To(Equal(map[string]int64{"big.wasm": 1 << 20, "small.txt": 5}))
+			})
+		})
+
+		Context("ProcessFiles", func() {
+			var mockFS fstest.MapFS
+
+			BeforeEach(func() {
+				mockFS = fstest.MapFS{}
+				for i := range 20 {
+					mockFS[fmt.Sprintf("static/chunk-%02d.js", i)] = &fstest.MapFile{Data: []byte("chunk")}
+				}
+			})
+
+			It("should keep walk order whatever order uploads finish in", func() {
+				walked, err := impl.BuildPopulateManifest(mockFS, func(file impl.FileInfo) error {
+					return nil
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				files, stats, err := impl.ProcessFiles(mockFS, 8, func(file impl.FileInfo) error {
+					// Later files finish first
+					time.Sleep(time.Duration(20-len(file.Path)%20) * time.Millisecond)
+					return nil
+				})
+
+				Expect(err).ToNot(HaveOccurred())
+				Expect(impl.FilePaths(files)).To(Equal(walked))
+				Expect(stats.Files).To(Equal(20))
+				Expect(stats.Bytes).To(Equal(int64(100)))
+			})
+
+			It("should never run more callbacks than the concurrency limit", func() {
+				var running, peak int32
+				_, _, err := impl.ProcessFiles(mockFS, 3, func(file impl.FileInfo) error {
+					now := atomic.AddInt32(&running, 1)
+					for {
+						old := atomic.LoadInt32(&peak)
+						if now <= old || atomic.CompareAndSwapInt32(&peak, old, now) {
+							break
+						}
+					}
+					time.Sleep(5 * time.Millisecond)
+					atomic.AddInt32(&running, -1)
+					return nil
+				})
+
+				Expect(err).ToNot(HaveOccurred())
+				Expect(peak).To(BeNumerically("<=", 3))
+				Expect(peak).To(BeNumerically(">", 1))
+			})
+
+			It("should stop dispatching after the first error", func() {
+				expectedErr := fmt.Errorf("upload failed")
+				var calls int32
+				_, stats, err := impl.ProcessFiles(mockFS, 2, func(file impl.FileInfo) error {
+					atomic.AddInt32(&calls, 1)
+					if file.Path == "static/chunk-01.js" {
+						return expectedErr
+					}
+					return nil
+				})
+
+				Expect(err).To(Equal(expectedErr))
+				Expect(calls).To(BeNumerically("<", 20))
+				Expect(stats.Files).To(BeNumerically("<", 20))
+			})
+
+			It("should treat a concurrency below one as sequential", func() {
+				order := []string{}
+				files, _, err := impl.ProcessFiles(mockFS, 0, func(file impl.FileInfo) error {
+					order = append(order, file.Path)
+					return nil
+				})
+
+				Expect(err).ToNot(HaveOccurred())
+				Expect(order).To(Equal(impl.FilePaths(files)))
+			})
+
+			It("should hash every file and hand over a reader at the start", func() {
+				hashFS := fstest.MapFS{"app.js": {Data: []byte("hello")}}
+
+				var content string
+				files, _, err := impl.ProcessFiles(hashFS, 1, func(file impl.FileInfo) error {
+					raw, err := io.ReadAll(file.Reader)
+					content = string(raw)
+					return err
+				})
+
+				Expect(err).ToNot(HaveOccurred())
+				Expect(content).To(Equal("hello"))
+				Expect(files[0].SHA256).To(Equal("2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"))
+				Expect(impl.NewManifest(files, "", "", 0, nil).Entries[0].SHA256).To(Equal(files[0].SHA256))
+			})
+
+			It("should count unchanged files as skipped rather than failed", func() {
+				files, stats, err := impl.ProcessFiles(mockFS, 4, func(file impl.FileInfo) error {
+					if file.Path == "static/chunk-00.js" {
+						return nil
+					}
+					return impl.ErrUnchanged
+				})
+
+				Expect(err).ToNot(HaveOccurred())
+				Expect(files).To(HaveLen(20))
+				Expect(stats.Files).To(Equal(1))
+				Expect(stats.Skipped).To(Equal(19))
+				Expect(stats.SkippedBytes).To(Equal(int64(19 * 5)))
+			})
+
+			It("should report throughput", func() {
+				stats := impl.UploadStats{Files: 2, Bytes: 2048, Duration: time.Second}
+
+				Expect(stats.Throughput()).To(Equal(2048.0))
+				Expect(stats.String()).To(Equal("Uploaded 2 files (2048 bytes) in 1s (2.0 KiB/s)"))
+				Expect(impl.UploadStats{}.Throughput()).To(BeZero())
+
+				stats.Skipped, stats.SkippedBytes = 3, 4096
+				Expect(stats.String()).To(Equal("Uploaded 2 files (2048 bytes), skipped 3 unchanged files (4096 bytes) in 1s (2.0 KiB/s)"))
+			})
+		})
+
+		Context("WriteFile", func() {
+			It("should recreate the directory layout under root", func() {
+				root := GinkgoT().TempDir()
+
+				err := impl.WriteFile(root, "static/js/app.js", strings.NewReader("console.log('hi')"))
+				Expect(err).ToNot(HaveOccurred())
+
+				contents, err := os.ReadFile(filepath.Join(root, "static", "js", "app.js"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(contents)).To(Equal("console.log('hi')"))
+			})
+
+			It("should overwrite existing files", func() {
+				root := GinkgoT().TempDir()
+
+				Expect(impl.WriteFile(root, "index.html", strings.NewReader("<html>old version</html>"))).To(Succeed())
+				Expect(impl.WriteFile(root, "index.html", strings.NewReader("<html>new</html>"))).To(Succeed())
+
+				contents, err := os.ReadFile(filepath.Join(root, "index.html"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(contents)).To(Equal("<html>new</html>"))
 			})
+
+			DescribeTable("should refuse paths outside root",
+				func(path string) {
+					err := impl.WriteFile(GinkgoT().TempDir(), path, strings.NewReader("x"))
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("refusing to write non-local path"))
+				},
+				Entry("parent traversal", "../escape.txt"),
+				Entry("absolute path", "/etc/passwd"),
+				Entry("empty path", ""),
+			)
 		})
 
 		Context("ParseManifest", func() {
@@ -831,6 +1059,68 @@ var _ = Describe("Storage Backend Drop-in Replacements", func() {
 				Expect(manifest.Timestamp).To(Equal(int64(1742472000)))
 			})
 
+			It("should fill in entries for legacy manifests", func() {
+				manifest, err := impl.ParseManifest([]byte(`["index.html", "app.js"]`))
+
+				Expect(err).ToNot(HaveOccurred())
+				Expect(manifest.Version).To(Equal(1))
+				Expect(manifest.Entries).To(Equal([]impl.FileEntry{
+					{Path: "index.html", ContentType: "text/html; charset=utf-8"},
+					{Path: "app.js", ContentType: "application/javascript"},
+				}))
+			})
+
+			It("should parse version 2 manifests", func() {
+				jsonData := []byte(`{
+					"version": 2,
+					"entries": [
+						{"path": "index.html", "size": 13, "sha256": "abc", "contentType": "text/html; charset=utf-8", "cacheControl": "public, max-age=60, stale-while-revalidate=300"},
+						{"path": "app.js", "size": 42, "sha256": "def", "contentType": "application/javascript", "cacheControl": "public, max-age=86400"}
+					],
+					"image": "myapp:v2",
+					"timestamp": 1742472000
+				}`)
+
+				manifest, err := impl.ParseManifest(jsonData)
+
+				Expect(err).ToNot(HaveOccurred())
+				Expect(manifest.Version).To(Equal(2))
+				Expect(manifest.Files).To(Equal([]string{"index.html", "app.js"}))
+				entry, found := manifest.Entry("app.js")
+				Expect(found).To(BeTrue())
+				Expect(entry.Size).To(Equal(int64(42)))
+				Expect(entry.CacheControl).To(Equal("public, max-age=86400"))
+				Expect(entry.SHA256).To(Equal("def"))
+			})
+
+			It("should reject manifests newer than it understands", func() {
+				_, err := impl.ParseManifest([]byte(`{"version": 99, "files": []}`))
+
+				Expect(err).To(MatchError(ContainSubstring("unsupported manifest version 99")))
+			})
+
+			It("should round-trip manifests built by NewManifest", func() {
+				files := []impl.FileInfo{
+					{Path: "index.html", ContentType: "text/html; charset=utf-8", Size: 13, SHA256: "abc"},
+					{Path: "static/app.js", ContentType: "application/javascript", Size: 42, SHA256: "def"},
+				}
+				built := impl.NewManifest(files, "myapp:v2", "valpop:abc", 1742472000, func(path string) string {
+					return "max-age=" + path
+				})
+
+				raw, err := json.Marshal(built)
+				Expect(err).ToNot(HaveOccurred())
+				parsed, err := impl.ParseManifest(raw)
+
+				Expect(err).ToNot(HaveOccurred())
+				Expect(parsed).To(Equal(built))
+				Expect(parsed.Version).To(Equal(impl.ManifestVersion))
+				Expect(parsed.Files).To(Equal([]string{"index.html", "static/app.js"}))
+				Expect(parsed.Entries[1]).To(Equal(impl.FileEntry{
+					Path: "static/app.js", Size: 42, SHA256: "def", ContentType: "application/javascript", CacheControl: "max-age=static/app.js",
+				}))
+			})
+
 			It("should parse manifest with valpopImage field", func() {
 				jsonData := []byte(`{"files": ["file1.txt"], "image": "myapp:v1", "valpopImage": "valpop:abc123", "timestamp": 1742472000}`)
 
@@ -0,0 +1,161 @@
+package impl
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// ErrLocked is returned when another populate holds the lock of a prefix
+var ErrLocked = errors.New("prefix is locked")
+
+// DefaultLockLease is the populate lock lease when none is configured
+const DefaultLockLease = 15 * time.Minute
+
+// Lock describes who holds the populate lock of a prefix and until when
+type Lock struct {
+	Prefix string `json:"prefix"`
+	// Timestamp is the release being populated, for backends that lock per release
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Owner     string `json:"owner"`
+	// Expires is the unix time the lease ends; an expired lock may be taken over
+	// or cleared. Locks without a lease, as written by older valpop, have 0
+	Expires int64 `json:"expires"`
+}
+
+// Expired reports whether the lease has ended at now
+func (l Lock) Expired(now int64) bool {
+	return now >= l.Expires
+}
+
+func (l Lock) String() string {
+	name := l.Prefix
+	if l.Timestamp != 0 {
+		name = fmt.Sprintf("%s:%d", l.Prefix, l.Timestamp)
+	}
+	return fmt.Sprintf("%s (owner %s, expires %s)", name, l.Owner, formatExpiry(l.Expires))
+}
+
+func formatExpiry(expires int64) string {
+	if expires == 0 {
+		return "never"
+	}
+	return time.Unix(expires, 0).UTC().Format(time.RFC3339)
+}
+
+// LockList is printed as a table, or as a JSON array with --json
+type LockList []Lock
+
+func (l LockList) String() string {
+	if len(l) == 0 {
+		return "No locks found\n"
+	}
+
+	now := time.Now().Unix()
+	var sb strings.Builder
+	w := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PREFIX\tTIMESTAMP\tOWNER\tEXPIRES\tSTATUS")
+	for _, lock := range l {
+		status := "active"
+		if lock.Expired(now) {
+			status = "stale"
+		}
+		timestamp := "-"
+		if lock.Timestamp != 0 {
+			timestamp = fmt.Sprintf("%d", lock.Timestamp)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", lock.Prefix, timestamp, lock.Owner, formatExpiry(lock.Expires), status)
+	}
+	w.Flush()
+	return sb.String()
+}
+
+// LockedError wraps ErrLocked with the lock that is in the way
+func LockedError(lock Lock) error {
+	return fmt.Errorf("%w: %s is held by %s until %s", ErrLocked, lock.Prefix, lock.Owner, formatExpiry(lock.Expires))
+}
+
+// NewLockOwner returns an owner id for this process: the hostname, which is the
+// pod name in a cluster, the pid and a random suffix
+func NewLockOwner() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(suffix))
+}
+
+// WaitForLock calls try until it acquires the lock or wait has passed, sleeping
+// up to poll between attempts. try returns the lock in the way, or nil once the
+// lock is held
+func WaitForLock(wait, poll time.Duration, try func() (*Lock, error)) error {
+	deadline := time.Now().Add(wait)
+	for {
+		held, err := try()
+		if err != nil {
+			return err
+		}
+		if held == nil {
+			return nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return LockedError(*held)
+		}
+		time.Sleep(min(poll, remaining))
+	}
+}
+
+// errLeaseReleased is the cause of a KeepAlive context once stop was called
+var errLeaseReleased = errors.New("lease released")
+
+// KeepAlive calls renew every interval, extending a lease during long uploads,
+// until the returned stop is called. Renewals end at the first error, which
+// stop returns and which cancels the returned context, derived from ctx, with
+// the error as its cause, so work done under the lease stops instead of racing
+// whoever takes the lock over
+func KeepAlive(ctx context.Context, interval time.Duration, renew func() error) (context.Context, func() error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	done := make(chan struct{})
+	result := make(chan error, 1)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				result <- nil
+				return
+			case <-ticker.C:
+				err := renew()
+				if err != nil {
+					cancel(err)
+					result <- err
+					return
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	var err error
+	return ctx, func() error {
+		once.Do(func() {
+			close(done)
+			err = <-result
+			cancel(errLeaseReleased)
+		})
+		return err
+	}
+}
@@ -0,0 +1,139 @@
+package impl_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/RedHatInsights/valpop/impl"
+)
+
+var _ = Describe("Locks", func() {
+	Context("Lock", func() {
+		It("should expire at the end of its lease", func() {
+			lock := impl.Lock{Prefix: "myapp", Owner: "pod-a", Expires: 1000}
+
+			Expect(lock.Expired(999)).To(BeFalse())
+			Expect(lock.Expired(1000)).To(BeTrue())
+		})
+
+		It("should describe the holder in errors", func() {
+			err := impl.LockedError(impl.Lock{Prefix: "myapp", Owner: "pod-a", Expires: 1000})
+
+			Expect(errors.Is(err, impl.ErrLocked)).To(BeTrue())
+			Expect(err).To(MatchError("prefix is locked: myapp is held by pod-a until 1970-01-01T00:16:40Z"))
+		})
+
+		It("should never expire without a lease", func() {
+			lock := impl.Lock{Prefix: "myapp", Timestamp: 1742472000, Owner: "in-progress"}
+
+			Expect(lock.String()).To(Equal("myapp:1742472000 (owner in-progress, expires never)"))
+		})
+
+		It("should generate distinct owners", func() {
+			Expect(impl.NewLockOwner()).ToNot(Equal(impl.NewLockOwner()))
+		})
+	})
+
+	Context("LockList", func() {
+		It("should print a table marking stale locks", func() {
+			table := impl.LockList{
+				{Prefix: "myapp", Owner: "pod-a", Expires: 1000},
+				{Prefix: "otherapp", Timestamp: 1742472000, Owner: "pod-b", Expires: time.Now().Add(time.Hour).Unix()},
+			}.String()
+
+			Expect(table).To(HavePrefix("PREFIX"))
+			Expect(table).To(MatchRegexp(`myapp +- +pod-a +1970-01-01T00:16:40Z +stale\n`))
+			Expect(table).To(MatchRegexp(`otherapp +1742472000 +pod-b .* active\n`))
+		})
+
+		It("should handle no locks", func() {
+			Expect(impl.LockList{}.String()).To(Equal("No locks found\n"))
+		})
+	})
+
+	Context("WaitForLock", func() {
+		held := &impl.Lock{Prefix: "myapp", Owner: "pod-a"}
+
+		It("should retry until the lock is free", func() {
+			attempts := 0
+			err := impl.WaitForLock(time.Second, time.Millisecond, func() (*impl.Lock, error) {
+				attempts++
+				if attempts < 3 {
+					return held, nil
+				}
+				return nil, nil
+			})
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(attempts).To(Equal(3))
+		})
+
+		It("should give up once the wait has passed", func() {
+			start := time.Now()
+			err := impl.WaitForLock(20*time.Millisecond, 5*time.Millisecond, func() (*impl.Lock, error) {
+				return held, nil
+			})
+
+			Expect(err).To(MatchError(impl.ErrLocked))
+			Expect(time.Since(start)).To(BeNumerically(">=", 20*time.Millisecond))
+		})
+
+		It("should try once without a wait", func() {
+			attempts := 0
+			err := impl.WaitForLock(0, time.Second, func() (*impl.Lock, error) {
+				attempts++
+				return held, nil
+			})
+
+			Expect(err).To(MatchError(impl.ErrLocked))
+			Expect(attempts).To(Equal(1))
+		})
+
+		It("should stop on errors", func() {
+			err := impl.WaitForLock(time.Second, time.Millisecond, func() (*impl.Lock, error) {
+				return nil, errors.New("s3 unavailable")
+			})
+
+			Expect(err).To(MatchError("s3 unavailable"))
+		})
+	})
+
+	Context("KeepAlive", func() {
+		It("should renew until stopped", func() {
+			var renewals atomic.Int32
+			ctx, stop := impl.KeepAlive(context.Background(), time.Millisecond, func() error {
+				renewals.Add(1)
+				return nil
+			})
+
+			Eventually(renewals.Load).Should(BeNumerically(">=", 3))
+			Expect(ctx.Err()).ToNot(HaveOccurred())
+			Expect(stop()).To(Succeed())
+			Expect(ctx.Err()).To(HaveOccurred())
+			stopped := renewals.Load()
+			time.Sleep(5 * time.Millisecond)
+			Expect(renewals.Load()).To(Equal(stopped))
+		})
+
+		It("should stop at the first failed renewal and report it", func() {
+			var renewals atomic.Int32
+			ctx, stop := impl.KeepAlive(context.Background(), time.Millisecond, func() error {
+				renewals.Add(1)
+				return errors.New("lock lost")
+			})
+
+			Eventually(renewals.Load).Should(Equal(int32(1)))
+			Eventually(ctx.Done()).Should(BeClosed())
+			Expect(context.Cause(ctx)).To(MatchError("lock lost"))
+			time.Sleep(5 * time.Millisecond)
+			Expect(renewals.Load()).To(Equal(int32(1)))
+			Expect(stop()).To(MatchError("lock lost"))
+			Expect(stop()).To(MatchError("lock lost"))
+		})
+	})
+})
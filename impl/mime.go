@@ -0,0 +1,132 @@
+package impl
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// DefaultContentType is served for files whose type cannot be resolved
+const DefaultContentType = "application/octet-stream"
+
+// sniffLength is how much of a file content sniffing looks at
+const sniffLength = 512
+
+// builtinContentTypes covers the files frontends ship; it takes precedence over
+// the system MIME database, which differs between base images
+var builtinContentTypes = map[string]string{
+	".html":        "text/html; charset=utf-8",
+	".htm":         "text/html; charset=utf-8",
+	".css":         "text/css; charset=utf-8",
+	".js":          "application/javascript",
+	".mjs":         "application/javascript",
+	".cjs":         "application/javascript",
+	".json":        "application/json",
+	".map":         "application/json",
+	".webmanifest": "application/manifest+json",
+	".txt":         "text/plain; charset=utf-8",
+	".xml":         "application/xml",
+	".csv":         "text/csv; charset=utf-8",
+	".md":          "text/markdown; charset=utf-8",
+	".svg":         "image/svg+xml",
+	".png":         "image/png",
+	".jpg":         "image/jpeg",
+	".jpeg":        "image/jpeg",
+	".gif":         "image/gif",
+	".webp":        "image/webp",
+	".avif":        "image/avif",
+	".ico":         "image/x-icon",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+	".ttf":         "font/ttf",
+	".otf":         "font/otf",
+	".eot":         "application/vnd.ms-fontobject",
+	".wasm":        "application/wasm",
+	".pdf":         "application/pdf",
+	".mp4":         "video/mp4",
+	".webm":        "video/webm",
+	".mp3":         "audio/mpeg",
+}
+
+// ContentTypes resolves the Content-Type stored for each file. The zero value
+// uses the built-in table and the system MIME database
+type ContentTypes struct {
+	// Overrides map extensions, such as ".map", to the type to use instead
+	Overrides map[string]string
+	// Sniff detects the type of files with an unknown extension from their content
+	Sniff bool
+}
+
+// ByExtension returns the type of filepath from its extension, looked up in the
+// overrides, the built-in table and the system MIME database in that order.
+// Extensions match case-insensitively; it returns empty when none knows it
+func (t ContentTypes) ByExtension(filepath string) string {
+	ext := strings.ToLower(path.Ext(filepath))
+	if ext == "" {
+		return ""
+	}
+	if contentType, ok := t.Overrides[ext]; ok {
+		return contentType
+	}
+	if contentType, ok := builtinContentTypes[ext]; ok {
+		return contentType
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// Detect returns the type of a file with an unknown extension: sniffed from the
+// first bytes of its content when Sniff is set, DefaultContentType otherwise
+func (t ContentTypes) Detect(head []byte) string {
+	if !t.Sniff || len(head) == 0 {
+		return DefaultContentType
+	}
+	return http.DetectContentType(head)
+}
+
+// ContentTypesFromConfig reads the content-types map of the config file and the
+// repeated --content-type ext=type flag, which wins over it, and --sniff-content-type
+func ContentTypesFromConfig(cfg Config) (ContentTypes, error) {
+	types := ContentTypes{Overrides: map[string]string{}, Sniff: cfg.GetBool("sniff-content-type")}
+
+	switch raw := cfg.Get("content-types").(type) {
+	case nil:
+	case map[string]string:
+		for ext, contentType := range raw {
+			types.Overrides[normalizeExtension(ext)] = contentType
+		}
+	case map[string]any:
+		for ext, value := range raw {
+			contentType, ok := value.(string)
+			if !ok {
+				return ContentTypes{}, fmt.Errorf("content type of %s must be a string, got %T", ext, value)
+			}
+			types.Overrides[normalizeExtension(ext)] = contentType
+		}
+	default:
+		return ContentTypes{}, fmt.Errorf("content-types must map extensions to types, got %T", raw)
+	}
+
+	for _, entry := range cfg.GetStringSlice("content-type") {
+		ext, contentType, ok := strings.Cut(entry, "=")
+		if !ok || strings.Trim(ext, ".") == "" {
+			return ContentTypes{}, fmt.Errorf("invalid content-type %q, must be ext=type", entry)
+		}
+		types.Overrides[normalizeExtension(ext)] = contentType
+	}
+
+	for ext, contentType := range types.Overrides {
+		_, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return ContentTypes{}, fmt.Errorf("invalid content type %q for %s: %w", contentType, ext, err)
+		}
+	}
+	return types, nil
+}
+
+// normalizeExtension lowercases ext and makes sure it starts with a dot, so
+// "MAP" and ".map" are the same override
+func normalizeExtension(ext string) string {
+	return "." + strings.TrimPrefix(strings.ToLower(strings.TrimSpace(ext)), ".")
+}
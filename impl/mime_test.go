@@ -0,0 +1,119 @@
+package impl_test
+
+import (
+	"io"
+	"mime"
+	"strings"
+	"testing/fstest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+
+	"github.com/RedHatInsights/valpop/impl"
+)
+
+var _ = Describe("Content types", func() {
+	Context("ByExtension", func() {
+		DescribeTable("should know the files frontends ship",
+			func(filepath, expected string) {
+				Expect(impl.ContentTypes{}.ByExtension(filepath)).To(Equal(expected))
+			},
+			Entry("source map", "app.js.map", "application/json"),
+			Entry("webp", "hero.webp", "image/webp"),
+			Entry("wasm", "module.wasm", "application/wasm"),
+			Entry("ico", "favicon.ico", "image/x-icon"),
+			Entry("txt", "robots.txt", "text/plain; charset=utf-8"),
+			Entry("woff", "font.woff", "font/woff"),
+			Entry("mjs", "chunk.mjs", "application/javascript"),
+			Entry("avif", "hero.avif", "image/avif"),
+			Entry("webmanifest", "site.webmanifest", "application/manifest+json"),
+			Entry("uppercase extension", "LOGO.PNG", "image/png"),
+			Entry("no extension", "LICENSE", ""),
+		)
+
+		It("should prefer overrides to the built-in table", func() {
+			types := impl.ContentTypes{Overrides: map[string]string{".js": "text/javascript; charset=utf-8"}}
+			Expect(types.ByExtension("app.js")).To(Equal("text/javascript; charset=utf-8"))
+			Expect(types.ByExtension("app.css")).To(Equal("text/css; charset=utf-8"))
+		})
+
+		It("should fall back to the system MIME database", func() {
+			Expect(mime.AddExtensionType(".valpoptest", "application/x-valpop")).To(Succeed())
+			Expect(impl.ContentTypes{}.ByExtension("release.valpoptest")).To(Equal("application/x-valpop"))
+		})
+	})
+
+	Context("Detect", func() {
+		It("should only sniff when asked to", func() {
+			head := []byte("<!DOCTYPE html><html></html>")
+			Expect(impl.ContentTypes{}.Detect(head)).To(Equal(impl.DefaultContentType))
+			Expect(impl.ContentTypes{Sniff: true}.Detect(head)).To(Equal("text/html; charset=utf-8"))
+			Expect(impl.ContentTypes{Sniff: true}.Detect(nil)).To(Equal(impl.DefaultContentType))
+		})
+	})
+
+	Context("ProcessFilesWithTypes", func() {
+		mockFS := fstest.MapFS{
+			"LICENSE":    {Data: []byte("Apache License, Version 2.0")},
+			"app.js.map": {Data: []byte("{}")},
+			"blob":       {Data: []byte{0x00, 0x01, 0x02}},
+		}
+
+		It("should sniff unknown extensions and hand over the whole content", func() {
+			contents := map[string]string{}
+			files, _, err := impl.ProcessFilesWithTypes(mockFS, 1, impl.ContentTypes{Sniff: true}, func(file impl.FileInfo) error {
+				content, err := io.ReadAll(file.Reader)
+				contents[file.Path] = string(content)
+				return err
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files[0].ContentType).To(Equal("text/plain; charset=utf-8"))
+			Expect(files[1].ContentType).To(Equal("application/json"))
+			Expect(files[2].ContentType).To(Equal(impl.DefaultContentType))
+			Expect(contents["LICENSE"]).To(Equal("Apache License, Version 2.0"))
+
+			manifest := impl.NewManifest(files, "", "", 0, nil)
+			Expect(manifest.Entries[0].ContentType).To(Equal("text/plain; charset=utf-8"))
+		})
+
+		It("should not sniff by default", func() {
+			files, _, err := impl.ProcessFiles(mockFS, 1, func(impl.FileInfo) error { return nil })
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files[0].ContentType).To(Equal(impl.DefaultContentType))
+		})
+	})
+
+	Context("ContentTypesFromConfig", func() {
+		It("should merge the config file map and the flag", func() {
+			cfg := viper.New()
+			cfg.Set("content-types", map[string]any{"map": "application/json", ".WebManifest": "application/manifest+json", ".js": "text/plain"})
+			cfg.Set("content-type", []string{"js=text/javascript", ".data=application/octet-stream"})
+			cfg.Set("sniff-content-type", true)
+
+			types, err := impl.ContentTypesFromConfig(cfg)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(types.Sniff).To(BeTrue())
+			Expect(types.Overrides).To(Equal(map[string]string{
+				".map":         "application/json",
+				".webmanifest": "application/manifest+json",
+				".js":          "text/javascript",
+				".data":        "application/octet-stream",
+			}))
+		})
+
+		DescribeTable("should reject malformed overrides",
+			func(key string, value any, message string) {
+				cfg := viper.New()
+				cfg.Set(key, value)
+				_, err := impl.ContentTypesFromConfig(cfg)
+				Expect(err).To(MatchError(ContainSubstring(message)))
+			},
+			Entry("flag without a type", "content-type", []string{"map"}, "must be ext=type"),
+			Entry("flag without an extension", "content-type", []string{".=text/plain"}, "must be ext=type"),
+			Entry("invalid media type", "content-type", []string{"map=not a type"}, `invalid content type "not a type"`),
+			Entry("not a map", "content-types", strings.Repeat("x", 3), "content-types must map extensions to types"),
+			Entry("not a string", "content-types", map[string]any{"map": 1}, "content type of map must be a string"),
+		)
+	})
+})
@@ -2,21 +2,46 @@ package mock
 
 import (
 	"context"
+	"crypto/md5"
 	"fmt"
 	"io"
+	"net/http"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	impl "github.com/RedHatInsights/valpop/impl"
+	"github.com/RedHatInsights/valpop/impl/s3"
 	minio "github.com/minio/minio-go/v7"
 )
 
+// Compile-time checks that the mocks stay in line with the interfaces they stand in for
+var _ s3.S3Client = (*S3Client)(nil)
+var _ s3.S3Service = (*S3Service)(nil)
+
 // S3Client implements the s3.S3Client interface for testing
+// It is safe for concurrent use, as populate uploads files in parallel
 type S3Client struct {
+	mu         sync.Mutex
 	Objects    map[string][]byte // bucketName/objectName -> content
 	ObjectInfo map[string]minio.ObjectInfo
 	Errors     map[string]error // operation -> error to return
+	// Versioning makes writes keep every object version, like a versioned bucket
+	Versioning bool
+	// NoConditionalWrites makes writes with If-Match or If-None-Match fail with
+	// NotImplemented, like servers without conditional writes
+	NoConditionalWrites bool
+	// Removed lists the keys RemoveObject deleted, in order
+	Removed     []string
+	versions    map[string]mockVersion // bucketName/objectName?versionId -> version
+	nextVersion int
+}
+
+type mockVersion struct {
+	data []byte
+	info minio.ObjectInfo
 }
 
 func NewS3Client() *S3Client {
@@ -24,77 +49,180 @@ func NewS3Client() *S3Client {
 		Objects:    make(map[string][]byte),
 		ObjectInfo: make(map[string]minio.ObjectInfo),
 		Errors:     make(map[string]error),
+		versions:   make(map[string]mockVersion),
+	}
+}
+
+// store writes an object, keeping a version of it when Versioning is set
+// Callers must hold mu
+func (m *S3Client) store(key string, data []byte, info minio.ObjectInfo) minio.ObjectInfo {
+	info.ETag = fmt.Sprintf("%x", md5.Sum(data))
+	info.Size = int64(len(data))
+	info.LastModified = time.Now()
+	if m.Versioning {
+		m.nextVersion++
+		info.VersionID = fmt.Sprintf("v%d", m.nextVersion)
+		m.versions[key+"?"+info.VersionID] = mockVersion{data: data, info: info}
 	}
+	m.Objects[key] = data
+	m.ObjectInfo[key] = info
+	return info
 }
 
 func (m *S3Client) PutObject(ctx context.Context, bucketName, objectName string, reader io.Reader, objectSize int64, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
 	key := bucketName + "/" + objectName
-	if err, exists := m.Errors["PutObject"]; exists {
+	data, err := io.ReadAll(reader)
+	if err != nil {
 		return minio.UploadInfo{}, err
 	}
 
-	data, err := io.ReadAll(reader)
-	if err != nil {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err, exists := m.Errors["PutObject"]; exists {
 		return minio.UploadInfo{}, err
 	}
 
-	m.Objects[key] = data
-	m.ObjectInfo[key] = minio.ObjectInfo{
-		Key:  objectName,
-		Size: int64(len(data)),
+	// Conditional writes, as set by SetMatchETagExcept and SetMatchETag
+	current, exists := m.ObjectInfo[key]
+	header := opts.Header()
+	if m.NoConditionalWrites && (header.Get("If-None-Match") != "" || header.Get("If-Match") != "") {
+		return minio.UploadInfo{}, minio.ErrorResponse{Code: "NotImplemented", Message: "conditional writes are not supported", StatusCode: 501}
+	}
+	if header.Get("If-None-Match") == "*" && exists {
+		return minio.UploadInfo{}, minio.ErrorResponse{Code: "PreconditionFailed", Message: "object exists", StatusCode: 412}
+	}
+	if match := header.Get("If-Match"); match != "" && (!exists || strings.Trim(match, `"`) != current.ETag) {
+		return minio.UploadInfo{}, minio.ErrorResponse{Code: "PreconditionFailed", Message: "etag mismatch", StatusCode: 412}
 	}
 
+	// Metadata holds the response headers, as StatObject returns them
+	metadata := http.Header{}
+	if opts.CacheControl != "" {
+		metadata.Set("Cache-Control", opts.CacheControl)
+	}
+	if opts.ContentEncoding != "" {
+		metadata.Set("Content-Encoding", opts.ContentEncoding)
+	}
+	info := m.store(key, data, minio.ObjectInfo{
+		Key:          objectName,
+		Size:         int64(len(data)),
+		ContentType:  opts.ContentType,
+		Metadata:     metadata,
+		UserMetadata: opts.UserMetadata,
+	})
+
 	return minio.UploadInfo{
-		Size: int64(len(data)),
-		Key:  objectName,
+		Size:      int64(len(data)),
+		Key:       objectName,
+		ETag:      info.ETag,
+		VersionID: info.VersionID,
 	}, nil
 }
 
 func (m *S3Client) GetObject(ctx context.Context, bucketName, objectName string, opts minio.GetObjectOptions) (*minio.Object, error) {
 	key := bucketName + "/" + objectName
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if err, exists := m.Errors["GetObject"]; exists {
 		return nil, err
 	}
 
 	_, exists := m.Objects[key]
 	if !exists {
-		return nil, fmt.Errorf("object not found")
+		return nil, minio.ErrorResponse{Code: "NoSuchKey", Message: "object not found", StatusCode: 404}
 	}
 
 	// Create a mock object that implements the required interface
 	return &minio.Object{}, nil // Note: This is simplified for testing
 }
 
+func (m *S3Client) StatObject(ctx context.Context, bucketName, objectName string, opts minio.StatObjectOptions) (minio.ObjectInfo, error) {
+	key := bucketName + "/" + objectName
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err, exists := m.Errors["StatObject"]; exists {
+		return minio.ObjectInfo{}, err
+	}
+
+	info, exists := m.ObjectInfo[key]
+	if !exists {
+		// Match the error minio returns for a missing key
+		return minio.ObjectInfo{}, minio.ErrorResponse{Code: "NoSuchKey", Message: "object not found", StatusCode: 404}
+	}
+	return info, nil
+}
+
+// CopyObject copies the current object, or src.VersionID of it, keeping its
+// content type and metadata as S3 does by default
+func (m *S3Client) CopyObject(ctx context.Context, dst minio.CopyDestOptions, src minio.CopySrcOptions) (minio.UploadInfo, error) {
+	srcKey := src.Bucket + "/" + src.Object
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err, exists := m.Errors["CopyObject"]; exists {
+		return minio.UploadInfo{}, err
+	}
+
+	source := mockVersion{data: m.Objects[srcKey], info: m.ObjectInfo[srcKey]}
+	_, exists := m.ObjectInfo[srcKey]
+	if src.VersionID != "" {
+		source, exists = m.versions[srcKey+"?"+src.VersionID]
+	}
+	if !exists {
+		return minio.UploadInfo{}, minio.ErrorResponse{Code: "NoSuchKey", Message: "object not found", StatusCode: 404}
+	}
+
+	info := source.info
+	info.Key = dst.Object
+	info = m.store(dst.Bucket+"/"+dst.Object, source.data, info)
+	return minio.UploadInfo{
+		Size:      info.Size,
+		Key:       dst.Object,
+		VersionID: info.VersionID,
+	}, nil
+}
+
 func (m *S3Client) RemoveObject(ctx context.Context, bucketName, objectName string, opts minio.RemoveObjectOptions) error {
 	key := bucketName + "/" + objectName
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if err, exists := m.Errors["RemoveObject"]; exists {
 		return err
 	}
 
 	delete(m.Objects, key)
 	delete(m.ObjectInfo, key)
+	m.Removed = append(m.Removed, objectName)
 	return nil
 }
 
 func (m *S3Client) ListObjects(ctx context.Context, bucketName string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
 	ch := make(chan minio.ObjectInfo)
 
+	// Snapshot under the lock so callers may modify the client while consuming the channel
+	m.mu.Lock()
+	listErr, failing := m.Errors["ListObjects"]
+	infos := []minio.ObjectInfo{}
+	for key, info := range m.ObjectInfo {
+		if strings.HasPrefix(key, bucketName+"/") {
+			objectName := strings.TrimPrefix(key, bucketName+"/")
+			if strings.HasPrefix(objectName, opts.Prefix) {
+				info.Key = objectName
+				infos = append(infos, info)
+			}
+		}
+	}
+	m.mu.Unlock()
+
 	go func() {
 		defer close(ch)
 
-		if err, exists := m.Errors["ListObjects"]; exists {
-			ch <- minio.ObjectInfo{Err: err}
+		if failing {
+			ch <- minio.ObjectInfo{Err: listErr}
 			return
 		}
 
-		for key, info := range m.ObjectInfo {
-			if strings.HasPrefix(key, bucketName+"/") {
-				objectName := strings.TrimPrefix(key, bucketName+"/")
-				if strings.HasPrefix(objectName, opts.Prefix) {
-					info.Key = objectName
-					ch <- info
-				}
-			}
+		for _, info := range infos {
+			ch <- info
 		}
 	}()
 
@@ -103,16 +231,23 @@ func (m *S3Client) ListObjects(ctx context.Context, bucketName string, opts mini
 
 // S3Service implements the s3.S3Service interface for testing
 type S3Service struct {
-	StoredItems     map[string]string            // key -> content
+	StoredItems     map[string]string        // key -> content
 	StoredManifests map[string]impl.Manifest // key -> manifest
-	Operations      []string                     // Track operations called
-	Errors          map[string]error             // operation -> error to return
+	StoredLocks     map[string]impl.Lock     // prefix -> lock
+	GCResults       map[string]impl.GCResult // prefix -> result returned by GC
+	CurrentReleases map[string]int64         // prefix -> current pointer
+	Output          io.Writer                // writer passed to SetOutput
+	Operations      []string                 // Track operations called
+	Errors          map[string]error         // operation -> error to return
 }
 
 func NewS3Service() *S3Service {
 	return &S3Service{
 		StoredItems:     make(map[string]string),
 		StoredManifests: make(map[string]impl.Manifest),
+		StoredLocks:     make(map[string]impl.Lock),
+		GCResults:       make(map[string]impl.GCResult),
+		CurrentReleases: make(map[string]int64),
 		Operations:      []string{},
 		Errors:          make(map[string]error),
 	}
@@ -129,6 +264,80 @@ func (m *S3Service) SetItem(namespace, filepath, contentType, bucket string, tim
 	return nil
 }
 
+func (m *S3Service) PutItem(namespace, filepath, contentType, bucket string, timestamp int64, r io.Reader, size int64) error {
+	m.Operations = append(m.Operations, "PutItem")
+	if err, exists := m.Errors["PutItem"]; exists && err != nil {
+		return err
+	}
+
+	contents, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.StoredItems[impl.MakeDataKey(namespace, filepath)] = string(contents)
+	return nil
+}
+
+func (m *S3Service) GetItem(namespace, filepath string, timestamp int64) (string, error) {
+	m.Operations = append(m.Operations, "GetItem")
+	if err, exists := m.Errors["GetItem"]; exists {
+		return "", err
+	}
+
+	content, exists := m.StoredItems[impl.MakeDataKey(namespace, filepath)]
+	if !exists {
+		return "", fmt.Errorf("object not found")
+	}
+	return content, nil
+}
+
+func (m *S3Service) DelKeys(allItems impl.AllItems) error {
+	m.Operations = append(m.Operations, "DelKeys")
+	if err, exists := m.Errors["DelKeys"]; exists {
+		return err
+	}
+
+	for namespace, items := range allItems {
+		for filepath := range items {
+			delete(m.StoredItems, impl.MakeDataKey(namespace, filepath))
+		}
+	}
+	return nil
+}
+
+func (m *S3Service) PopulateFromDir(namespace, bucket, basepath string, timestamp int64) error {
+	m.Operations = append(m.Operations, "PopulateFromDir")
+	if err, exists := m.Errors["PopulateFromDir"]; exists {
+		return err
+	}
+
+	// Like PopulateFn, only track the operation without filesystem access
+	return nil
+}
+
+func (m *S3Service) Pop(namespace string, timestamp int64) (impl.AllItems, error) {
+	m.Operations = append(m.Operations, "Pop")
+	if err, exists := m.Errors["Pop"]; exists {
+		return impl.AllItems{}, err
+	}
+
+	// Resolve the newest manifest when no timestamp is given, as production does
+	if timestamp == 0 {
+		timestamp = m.latestTimestamp(namespace)
+	}
+
+	manifest, exists := m.GetStoredManifest(namespace, timestamp)
+	if !exists {
+		return impl.AllItems{}, fmt.Errorf("no manifests found")
+	}
+
+	items := impl.Items{}
+	for _, file := range manifest.Files {
+		items[file] = []int64{timestamp}
+	}
+	return impl.AllItems{namespace: items}, nil
+}
+
 func (m *S3Service) SetManifest(namespace, bucket string, timestamp int64, files impl.Manifest) error {
 	m.Operations = append(m.Operations, "SetManifest")
 	if err, exists := m.Errors["SetManifest"]; exists {
@@ -140,7 +349,7 @@ func (m *S3Service) SetManifest(namespace, bucket string, timestamp int64, files
 	return nil
 }
 
-func (m *S3Service) PopulateFn(addr, bucket, source, prefix, image, valpopImage string, timeout int64, minAssetRecords int64, cacheMaxAge int64) error {
+func (m *S3Service) PopulateFn(opts impl.PopulateOptions) error {
 	m.Operations = append(m.Operations, "PopulateFn")
 	if err, exists := m.Errors["PopulateFn"]; exists {
 		return err
@@ -151,6 +360,198 @@ func (m *S3Service) PopulateFn(addr, bucket, source, prefix, image, valpopImage
 	return nil
 }
 
+// GC returns the GCResults entry of prefix, or an empty result, checked
+// against opts.MaxDeletions; retention itself is covered by the s3 tests
+func (m *S3Service) GC(prefix string, opts impl.GCOptions) (impl.GCResult, error) {
+	m.Operations = append(m.Operations, "GC")
+	if err, exists := m.Errors["GC"]; exists {
+		return impl.GCResult{}, err
+	}
+
+	result, exists := m.GCResults[prefix]
+	if !exists {
+		result = impl.NewGCResult(prefix, false)
+	}
+	result.DryRun = opts.DryRun
+	if !opts.DryRun {
+		err := result.CheckCap(opts.MaxDeletions)
+		if err != nil {
+			return impl.GCResult{}, err
+		}
+	}
+	return result, nil
+}
+
+// PlanPopulate returns an empty plan; like PopulateFn it does not read opts.Source
+func (m *S3Service) PlanPopulate(opts impl.PopulateOptions) (impl.Plan, error) {
+	m.Operations = append(m.Operations, "PlanPopulate")
+	if err, exists := m.Errors["PlanPopulate"]; exists {
+		return impl.Plan{}, err
+	}
+	return impl.NewPlan(opts.Prefix, time.Now().Unix()), nil
+}
+
+// latestTimestamp returns the timestamp of the newest stored manifest for namespace
+func (m *S3Service) latestTimestamp(namespace string) int64 {
+	var latest int64
+	for key := range m.StoredManifests {
+		timestampStr := strings.TrimPrefix(key, fmt.Sprintf("manifests/%s/", namespace))
+		if stamp, err := strconv.ParseInt(timestampStr, 10, 64); err == nil && stamp > latest {
+			latest = stamp
+		}
+	}
+	return latest
+}
+
+// Prefixes returns the prefixes of StoredManifests
+func (m *S3Service) Prefixes() ([]string, error) {
+	m.Operations = append(m.Operations, "Prefixes")
+	if err, exists := m.Errors["Prefixes"]; exists {
+		return nil, err
+	}
+
+	prefixes := []string{}
+	for key := range m.StoredManifests {
+		prefix, _, ok := impl.ParseManifestKey(key)
+		if ok && !slices.Contains(prefixes, prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	slices.Sort(prefixes)
+	return prefixes, nil
+}
+
+// Manifests returns the StoredManifests of prefix
+func (m *S3Service) Manifests(prefix string) ([]impl.Manifest, error) {
+	m.Operations = append(m.Operations, "Manifests")
+	if err, exists := m.Errors["Manifests"]; exists {
+		return nil, err
+	}
+
+	manifests := []impl.Manifest{}
+	for key, manifest := range m.StoredManifests {
+		keyPrefix, timestamp, ok := impl.ParseManifestKey(key)
+		if !ok || keyPrefix != prefix {
+			continue
+		}
+		if manifest.Timestamp == 0 {
+			manifest.Timestamp = timestamp
+		}
+		manifests = append(manifests, manifest)
+	}
+	return manifests, nil
+}
+
+// SetOutput records w in Output; the mock prints no progress
+func (m *S3Service) SetOutput(w io.Writer) {
+	m.Operations = append(m.Operations, "SetOutput")
+	m.Output = w
+}
+
+// Current returns the CurrentReleases entry of prefix
+func (m *S3Service) Current(prefix string) (int64, error) {
+	m.Operations = append(m.Operations, "Current")
+	if err, exists := m.Errors["Current"]; exists {
+		return 0, err
+	}
+	return m.CurrentReleases[prefix], nil
+}
+
+// Verify checks a stored manifest against StoredItems
+func (m *S3Service) Verify(prefix string, timestamp int64) (impl.VerifyReport, error) {
+	m.Operations = append(m.Operations, "Verify")
+	if err, exists := m.Errors["Verify"]; exists {
+		return impl.VerifyReport{}, err
+	}
+
+	if timestamp == 0 {
+		timestamp = m.latestTimestamp(prefix)
+	}
+	manifest, exists := m.GetStoredManifest(prefix, timestamp)
+	if !exists {
+		return impl.VerifyReport{}, fmt.Errorf("no manifests found")
+	}
+
+	return impl.VerifyManifest(prefix, manifest, func(entry impl.FileEntry) (impl.StoredObject, bool, error) {
+		content, exists := m.StoredItems[impl.MakeDataKey(prefix, entry.Path)]
+		if !exists {
+			return impl.StoredObject{}, false, nil
+		}
+		hash, err := impl.HashContent(strings.NewReader(content))
+		return impl.StoredObject{Size: int64(len(content)), SHA256: hash}, true, err
+	})
+}
+
+// Rollback stores a copy of target as the manifest at timestamp; StoredItems
+// keep a single version, so data is left as it is
+func (m *S3Service) Rollback(prefix string, target impl.Manifest, timestamp int64) (impl.Manifest, error) {
+	m.Operations = append(m.Operations, "Rollback")
+	if err, exists := m.Errors["Rollback"]; exists {
+		return impl.Manifest{}, err
+	}
+
+	restored := target
+	restored.Timestamp = timestamp
+	restored.RolledBackFrom = target.Timestamp
+	m.StoredManifests[impl.MakeManifestKey(prefix, timestamp)] = restored
+	return restored, nil
+}
+
+// Locks returns the StoredLocks of prefix, or all of them when it is empty
+func (m *S3Service) Locks(prefix string) ([]impl.Lock, error) {
+	m.Operations = append(m.Operations, "Locks")
+	if err, exists := m.Errors["Locks"]; exists {
+		return nil, err
+	}
+
+	locks := []impl.Lock{}
+	for lockPrefix, lock := range m.StoredLocks {
+		if prefix == "" || lockPrefix == prefix {
+			locks = append(locks, lock)
+		}
+	}
+	slices.SortFunc(locks, func(a, b impl.Lock) int {
+		return strings.Compare(a.Prefix, b.Prefix)
+	})
+	return locks, nil
+}
+
+// ClearLock removes a stored lock if it is unchanged and expired
+func (m *S3Service) ClearLock(lock impl.Lock) error {
+	m.Operations = append(m.Operations, "ClearLock")
+	if err, exists := m.Errors["ClearLock"]; exists {
+		return err
+	}
+
+	current, exists := m.StoredLocks[lock.Prefix]
+	if !exists {
+		return nil
+	}
+	if current.Owner != lock.Owner || !current.Expired(time.Now().Unix()) {
+		return fmt.Errorf("lock %s is no longer stale", current)
+	}
+	delete(m.StoredLocks, lock.Prefix)
+	return nil
+}
+
+func (m *S3Service) PopFn(prefix, dest string) error {
+	m.Operations = append(m.Operations, "PopFn")
+	if err, exists := m.Errors["PopFn"]; exists {
+		return err
+	}
+
+	// Like PopulateFn, only track the operation without writing to the filesystem
+	return nil
+}
+
+func (m *S3Service) PopTo(prefix string, target impl.PopTarget) error {
+	m.Operations = append(m.Operations, "PopTo")
+	if err, exists := m.Errors["PopTo"]; exists {
+		return err
+	}
+	return nil
+}
+
 func (m *S3Service) CleanupCache(prefix, bucket string, timeout int64, minAssetRecords int64) error {
 	m.Operations = append(m.Operations, "CleanupCache")
 	if err, exists := m.Errors["CleanupCache"]; exists {
@@ -13,7 +13,7 @@ func Example_usingMockS3Client() {
 	mockClient := mock.NewS3Client()
 
 	// Inject the mock client into the S3 implementation
-	minioService := s3.NewMinioWithClient(mockClient)
+	minioService := s3.NewMinioWithClient(mockClient, "bucket", 86400)
 
 	// Now you can use the minioService with the mock client
 	// This allows you to test S3 logic without hitting real S3
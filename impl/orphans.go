@@ -0,0 +1,46 @@
+package impl
+
+import (
+	"slices"
+	"strings"
+)
+
+// ActionOrphan marks a gc deletion of a data key no retained manifest references
+const ActionOrphan = "orphan"
+
+// StoredKey is a data key found in storage
+type StoredKey struct {
+	Key  string
+	Size int64
+	// Modified is the unix time the key was written
+	Modified int64
+}
+
+// DetermineOrphans returns the stored keys that are not referenced and were
+// written more than grace seconds before currentTime, sorted by key. The grace
+// period keeps the uploads of a populate that has not written its manifest yet
+func DetermineOrphans(stored []StoredKey, referenced map[string]bool, currentTime, grace int64) []StoredKey {
+	orphans := []StoredKey{}
+	for _, key := range stored {
+		if referenced[key.Key] || currentTime-key.Modified <= grace {
+			continue
+		}
+		orphans = append(orphans, key)
+	}
+	slices.SortFunc(orphans, func(a, b StoredKey) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return orphans
+}
+
+// ReferencedKeys returns the S3 data key of every file of manifests, following
+// the layout each manifest records
+func ReferencedKeys(namespace string, manifests []Manifest) map[string]bool {
+	referenced := map[string]bool{}
+	for _, manifest := range manifests {
+		for _, file := range manifest.Files {
+			referenced[manifest.DataKey(namespace, file)] = true
+		}
+	}
+	return referenced
+}
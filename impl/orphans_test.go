@@ -0,0 +1,47 @@
+package impl_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/RedHatInsights/valpop/impl"
+)
+
+var _ = Describe("Orphans", func() {
+	Context("DetermineOrphans", func() {
+		stored := []impl.StoredKey{
+			{Key: "data/myapp/zombie.js", Size: 10, Modified: 1000},
+			{Key: "data/myapp/index.html", Size: 20, Modified: 1000},
+			{Key: "data/myapp/fresh.js", Size: 30, Modified: 9500},
+			{Key: "data/myapp/abandoned.js", Size: 40, Modified: 2000},
+		}
+		referenced := map[string]bool{"data/myapp/index.html": true}
+
+		It("should return unreferenced keys older than the grace period, sorted", func() {
+			orphans := impl.DetermineOrphans(stored, referenced, 10000, 3600)
+
+			Expect(orphans).To(Equal([]impl.StoredKey{
+				{Key: "data/myapp/abandoned.js", Size: 40, Modified: 2000},
+				{Key: "data/myapp/zombie.js", Size: 10, Modified: 1000},
+			}))
+		})
+
+		It("should keep everything within the grace period", func() {
+			Expect(impl.DetermineOrphans(stored, referenced, 10000, 9000)).To(BeEmpty())
+		})
+	})
+
+	Context("ReferencedKeys", func() {
+		It("should follow the layout of each manifest", func() {
+			referenced := impl.ReferencedKeys("myapp", []impl.Manifest{
+				{Timestamp: 1000, Files: []string{"index.html"}},
+				{Timestamp: 2000, Files: []string{"app.js"}, Layout: impl.LayoutRelease},
+			})
+
+			Expect(referenced).To(Equal(map[string]bool{
+				"data/myapp/index.html":      true,
+				"releases/myapp/2000/app.js": true,
+			}))
+		})
+	})
+})
@@ -0,0 +1,83 @@
+package impl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Planned changes to a storage key reported by a dry run
+const (
+	ActionUpload    = "upload"
+	ActionCopy      = "copy"
+	ActionUnchanged = "unchanged"
+	ActionWrite     = "write"
+	ActionDelete    = "delete"
+)
+
+// PlannedChange is one storage key a dry run found would be touched
+type PlannedChange struct {
+	Action string `json:"action"`
+	Key    string `json:"key"`
+	// Size is the file size of uploads, copies and unchanged files
+	Size int64 `json:"size,omitempty"`
+}
+
+// Plan is the result of a dry run: the data keys populate would upload, the
+// manifests and pointers it would write or remove, and the data keys cleanup
+// would delete, each in the order they would be changed
+type Plan struct {
+	Prefix    string `json:"prefix"`
+	Timestamp int64  `json:"timestamp"`
+	// Skipped explains why populate would upload nothing, e.g. a duplicate image
+	Skipped string `json:"skipped,omitempty"`
+	// Excluded lists the source paths the populate filter leaves out
+	Excluded  []string        `json:"excluded,omitempty"`
+	Uploads   []PlannedChange `json:"uploads"`
+	Manifests []PlannedChange `json:"manifests"`
+	Deletes   []PlannedChange `json:"deletes"`
+}
+
+// NewPlan returns an empty plan, whose lists encode as [] rather than null
+func NewPlan(prefix string, timestamp int64) Plan {
+	return Plan{Prefix: prefix, Timestamp: timestamp, Uploads: []PlannedChange{}, Manifests: []PlannedChange{}, Deletes: []PlannedChange{}}
+}
+
+// Summary counts the planned uploads, skipped files and deletions
+func (p Plan) Summary() (uploads int, uploadBytes int64, unchanged int, deletes int) {
+	for _, change := range p.Uploads {
+		if change.Action == ActionUnchanged {
+			unchanged++
+			continue
+		}
+		uploads++
+		uploadBytes += change.Size
+	}
+	return uploads, uploadBytes, unchanged, len(p.Deletes)
+}
+
+func (p Plan) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Dry run of %s:%d, nothing was changed\n", p.Prefix, p.Timestamp)
+	if p.Skipped != "" {
+		fmt.Fprintf(&sb, "Skipping upload: %s\n", p.Skipped)
+	}
+	for _, excluded := range p.Excluded {
+		fmt.Fprintf(&sb, "  %-9s %s\n", "exclude", excluded)
+	}
+	for _, changes := range [][]PlannedChange{p.Uploads, p.Manifests, p.Deletes} {
+		for _, change := range changes {
+			if change.Size > 0 {
+				fmt.Fprintf(&sb, "  %-9s %s (%d bytes)\n", change.Action, change.Key, change.Size)
+				continue
+			}
+			fmt.Fprintf(&sb, "  %-9s %s\n", change.Action, change.Key)
+		}
+	}
+	uploads, uploadBytes, unchanged, deletes := p.Summary()
+	fmt.Fprintf(&sb, "Would upload %d files (%d bytes), keep %d unchanged and delete %d keys", uploads, uploadBytes, unchanged, deletes)
+	if len(p.Excluded) > 0 {
+		fmt.Fprintf(&sb, ", excluding %d paths", len(p.Excluded))
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
@@ -0,0 +1,61 @@
+package impl_test
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/RedHatInsights/valpop/impl"
+)
+
+var _ = Describe("Plan", func() {
+	plan := impl.Plan{
+		Prefix:    "myapp",
+		Timestamp: 2000,
+		Uploads: []impl.PlannedChange{
+			{Action: impl.ActionUpload, Key: "data/myapp/index.html", Size: 100},
+			{Action: impl.ActionUnchanged, Key: "data/myapp/vendor.js", Size: 900},
+		},
+		Manifests: []impl.PlannedChange{{Action: impl.ActionWrite, Key: "manifests/myapp/2000"}},
+		Deletes:   []impl.PlannedChange{{Action: impl.ActionDelete, Key: "manifests/myapp/1000"}},
+	}
+
+	It("should count uploads separately from unchanged files", func() {
+		uploads, uploadBytes, unchanged, deletes := plan.Summary()
+		Expect(uploads).To(Equal(1))
+		Expect(uploadBytes).To(Equal(int64(100)))
+		Expect(unchanged).To(Equal(1))
+		Expect(deletes).To(Equal(1))
+	})
+
+	It("should list every key in the order it would change", func() {
+		Expect(plan.String()).To(Equal(`Dry run of myapp:2000, nothing was changed
+  upload    data/myapp/index.html (100 bytes)
+  unchanged data/myapp/vendor.js (900 bytes)
+  write     manifests/myapp/2000
+  delete    manifests/myapp/1000
+Would upload 1 files (100 bytes), keep 1 unchanged and delete 1 keys
+`))
+	})
+
+	It("should list excluded paths ahead of the changes", func() {
+		excluded := plan
+		excluded.Excluded = []string{".git/", "app.js.map"}
+		Expect(excluded.String()).To(Equal(`Dry run of myapp:2000, nothing was changed
+  exclude   .git/
+  exclude   app.js.map
+  upload    data/myapp/index.html (100 bytes)
+  unchanged data/myapp/vendor.js (900 bytes)
+  write     manifests/myapp/2000
+  delete    manifests/myapp/1000
+Would upload 1 files (100 bytes), keep 1 unchanged and delete 1 keys, excluding 2 paths
+`))
+	})
+
+	It("should encode empty lists as arrays", func() {
+		raw, err := json.Marshal(impl.NewPlan("myapp", 2000))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(raw)).To(Equal(`{"prefix":"myapp","timestamp":2000,"uploads":[],"manifests":[],"deletes":[]}`))
+	})
+})
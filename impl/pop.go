@@ -0,0 +1,129 @@
+package impl
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	fp "path/filepath"
+	"time"
+)
+
+// Formats pop writes a release in
+const (
+	PopFormatDir   = "dir"
+	PopFormatTar   = "tar"
+	PopFormatTarGz = "tar.gz"
+)
+
+// PopFormats lists every format --format accepts
+var PopFormats = []string{PopFormatDir, PopFormatTar, PopFormatTarGz}
+
+// PoppedFile describes a file of the release pop resolved
+type PoppedFile struct {
+	Path string
+	Size int64
+	// Timestamp is the release the file was popped from; archives use it as
+	// the mtime of every entry so the same release always packs the same bytes
+	Timestamp int64
+}
+
+// PopTarget receives the files of a popped release, one at a time and in a
+// stable order. Close finishes the output, it does not close what it writes to
+type PopTarget interface {
+	WriteFile(file PoppedFile, r io.Reader) error
+	Close() error
+}
+
+// DirTarget writes popped files below root, as pop --dest does
+func DirTarget(root string) PopTarget {
+	return dirTarget(root)
+}
+
+type dirTarget string
+
+func (d dirTarget) WriteFile(file PoppedFile, r io.Reader) error {
+	return WriteFile(string(d), file.Path, r)
+}
+
+func (d dirTarget) Close() error {
+	return nil
+}
+
+// NewArchiveTarget returns a target writing a tar or tar.gz archive of the
+// popped files to w. Entries are owned by root, files have mode 0644 and
+// directories 0755, and all of them the release timestamp as mtime
+func NewArchiveTarget(w io.Writer, format string) (PopTarget, error) {
+	target := &archiveTarget{dirs: map[string]bool{}}
+	switch format {
+	case PopFormatTar:
+		target.tw = tar.NewWriter(w)
+	case PopFormatTarGz:
+		target.gz = gzip.NewWriter(w)
+		target.tw = tar.NewWriter(target.gz)
+	default:
+		return nil, fmt.Errorf("unknown archive format %q, must be %s or %s", format, PopFormatTar, PopFormatTarGz)
+	}
+	return target, nil
+}
+
+type archiveTarget struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+	// dirs holds the directories already written, so each gets one entry
+	dirs map[string]bool
+}
+
+func (a *archiveTarget) WriteFile(file PoppedFile, r io.Reader) error {
+	if !fp.IsLocal(file.Path) {
+		return fmt.Errorf("refusing to write non-local path: %s", file.Path)
+	}
+	mtime := time.Unix(file.Timestamp, 0).UTC()
+
+	err := a.writeDirs(path.Dir(file.Path), mtime)
+	if err != nil {
+		return err
+	}
+	err = a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     file.Path,
+		Size:     file.Size,
+		Mode:     0644,
+		ModTime:  mtime,
+	})
+	if err != nil {
+		return fmt.Errorf("could not write %s: %w", file.Path, err)
+	}
+	_, err = io.Copy(a.tw, r)
+	if err != nil {
+		return fmt.Errorf("could not write %s: %w", file.Path, err)
+	}
+	return nil
+}
+
+// writeDirs writes an entry for dir and each of its parents not written yet
+func (a *archiveTarget) writeDirs(dir string, mtime time.Time) error {
+	if dir == "." || a.dirs[dir] {
+		return nil
+	}
+	err := a.writeDirs(path.Dir(dir), mtime)
+	if err != nil {
+		return err
+	}
+	a.dirs[dir] = true
+	return a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     dir + "/",
+		Mode:     0755,
+		ModTime:  mtime,
+	})
+}
+
+func (a *archiveTarget) Close() error {
+	err := a.tw.Close()
+	if err != nil || a.gz == nil {
+		return err
+	}
+	return a.gz.Close()
+}
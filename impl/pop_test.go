@@ -0,0 +1,97 @@
+package impl_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/RedHatInsights/valpop/impl"
+)
+
+var _ = Describe("Pop targets", func() {
+	files := map[string]string{
+		"index.html":         "<html></html>",
+		"static/js/app.js":   "app",
+		"static/css/app.css": "body{}",
+	}
+	order := []string{"index.html", "static/js/app.js", "static/css/app.css"}
+
+	pop := func(target impl.PopTarget) {
+		for _, path := range order {
+			file := impl.PoppedFile{Path: path, Size: int64(len(files[path])), Timestamp: 1742472000}
+			Expect(target.WriteFile(file, strings.NewReader(files[path]))).To(Succeed())
+		}
+		Expect(target.Close()).To(Succeed())
+	}
+
+	archive := func(format string) []byte {
+		var buf bytes.Buffer
+		target, err := impl.NewArchiveTarget(&buf, format)
+		Expect(err).ToNot(HaveOccurred())
+		pop(target)
+		return buf.Bytes()
+	}
+
+	It("should write files below a directory", func() {
+		dest := GinkgoT().TempDir()
+		pop(impl.DirTarget(dest))
+
+		content, err := os.ReadFile(filepath.Join(dest, "static", "css", "app.css"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(content)).To(Equal("body{}"))
+	})
+
+	It("should write a tar archive stamped with the release timestamp", func() {
+		reader := tar.NewReader(bytes.NewReader(archive(impl.PopFormatTar)))
+		entries := []string{}
+		for {
+			header, err := reader.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			Expect(err).ToNot(HaveOccurred())
+			entries = append(entries, header.Name)
+			Expect(header.ModTime).To(Equal(time.Unix(1742472000, 0)))
+			Expect(header.Uid).To(BeZero())
+			if header.Typeflag == tar.TypeDir {
+				Expect(header.Mode).To(Equal(int64(0755)))
+				continue
+			}
+			Expect(header.Mode).To(Equal(int64(0644)))
+			content, err := io.ReadAll(reader)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(content)).To(Equal(files[header.Name]))
+		}
+		Expect(entries).To(Equal([]string{
+			"index.html", "static/", "static/js/", "static/js/app.js", "static/css/", "static/css/app.css",
+		}))
+	})
+
+	It("should produce the same bytes for the same release", func() {
+		Expect(archive(impl.PopFormatTarGz)).To(Equal(archive(impl.PopFormatTarGz)))
+
+		gz, err := gzip.NewReader(bytes.NewReader(archive(impl.PopFormatTarGz)))
+		Expect(err).ToNot(HaveOccurred())
+		raw, err := io.ReadAll(gz)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(raw).To(Equal(archive(impl.PopFormatTar)))
+	})
+
+	It("should refuse non-local paths and unknown formats", func() {
+		target, err := impl.NewArchiveTarget(io.Discard, impl.PopFormatTar)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(target.WriteFile(impl.PoppedFile{Path: "../etc/passwd", Size: 1}, strings.NewReader("x"))).To(MatchError(ContainSubstring("refusing to write non-local path")))
+
+		_, err = impl.NewArchiveTarget(io.Discard, "zip")
+		Expect(err).To(MatchError(ContainSubstring(`unknown archive format "zip"`)))
+	})
+})
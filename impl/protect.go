@@ -0,0 +1,48 @@
+package impl
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// DefaultProtectedFiles are protected from cleanup whatever --protect adds
+var DefaultProtectedFiles = []string{"fed-mods.json"}
+
+// ProtectedPatterns returns DefaultProtectedFiles followed by the --protect
+// patterns of cfg. Entries may hold several comma separated patterns, as
+// VALPOP_PROTECT does
+func ProtectedPatterns(cfg Config) []string {
+	return append(append([]string{}, DefaultProtectedFiles...), splitPatterns(cfg.GetStringSlice("protect"))...)
+}
+
+// splitPatterns splits entries holding comma separated patterns, dropping blanks
+func splitPatterns(entries []string) []string {
+	patterns := []string{}
+	for _, entry := range entries {
+		for _, pattern := range strings.Split(entry, ",") {
+			pattern = strings.TrimSpace(pattern)
+			if pattern != "" {
+				patterns = append(patterns, pattern)
+			}
+		}
+	}
+	return patterns
+}
+
+// ValidateProtected rejects patterns that are not valid globs
+func ValidateProtected(patterns []string) error {
+	for _, pattern := range patterns {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("invalid protect pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// IsProtected reports whether filepath matches one of the protected glob
+// patterns, see MatchGlob
+func IsProtected(filepath string, patterns []string) bool {
+	return MatchGlob(filepath, patterns)
+}
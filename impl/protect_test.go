@@ -0,0 +1,39 @@
+package impl_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/RedHatInsights/valpop/impl"
+)
+
+var _ = Describe("Protected files", func() {
+	Context("IsProtected", func() {
+		It("should protect the files matching a pattern", func() {
+			patterns := []string{"fed-mods.json", "static/entry-*.js"}
+			Expect(impl.IsProtected("apps/chrome/fed-mods.json", patterns)).To(BeTrue())
+			Expect(impl.IsProtected("static/chunk.js", patterns)).To(BeFalse())
+		})
+	})
+
+	Context("ProtectedPatterns", func() {
+		It("should always include the default protected files", func() {
+			Expect(impl.ProtectedPatterns(mapConfig{})).To(Equal([]string{"fed-mods.json"}))
+		})
+
+		It("should split comma separated patterns", func() {
+			cfg := mapConfig{"protect": "*.html, app-info.json,,static/entry-*.js"}
+			Expect(impl.ProtectedPatterns(cfg)).To(Equal([]string{"fed-mods.json", "*.html", "app-info.json", "static/entry-*.js"}))
+		})
+	})
+
+	Context("ValidateProtected", func() {
+		It("should accept globs", func() {
+			Expect(impl.ValidateProtected([]string{"*.html", "static/entry-?.js", "[ab].json"})).To(Succeed())
+		})
+
+		It("should reject malformed globs", func() {
+			Expect(impl.ValidateProtected([]string{"*.html", "[index.html"})).To(MatchError(ContainSubstring(`invalid protect pattern "[index.html"`)))
+		})
+	})
+})
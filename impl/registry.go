@@ -0,0 +1,173 @@
+package impl
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// Config exposes the settings a backend reads when it is constructed
+// *viper.Viper satisfies this interface, so the CLI can pass its config straight through
+type Config interface {
+	GetString(key string) string
+	GetBool(key string) bool
+	GetInt64(key string) int64
+	GetStringSlice(key string) []string
+	Get(key string) any
+}
+
+// PopulateOptions carries the per-run settings of a populate
+type PopulateOptions struct {
+	Source string
+	// Files is Source opened by OpenSource; when nil Source is read as a directory
+	Files           fs.FS
+	Prefix          string
+	Image           string
+	ValpopImage     string
+	Timeout         int64
+	MinAssetRecords int64
+	// Concurrency bounds the number of parallel uploads, values below 1 mean 1
+	Concurrency int
+	// Precompress selects the compressed variants stored next to each file
+	Precompress PrecompressOptions
+	// Filter leaves files of Source out of the release
+	Filter FileFilter
+}
+
+// SourceFS returns the files populate uploads, before filtering
+func (o PopulateOptions) SourceFS() fs.FS {
+	if o.Files != nil {
+		return o.Files
+	}
+	return os.DirFS(o.Source)
+}
+
+// Backend is a storage Implementation that the CLI commands can drive directly
+type Backend interface {
+	Implementation
+
+	PopulateFn(opts PopulateOptions) error
+	// PlanPopulate reports what PopulateFn would change, without changing anything
+	PlanPopulate(opts PopulateOptions) (Plan, error)
+	PopFn(prefix, dest string) error
+	// PopTo hands the files PopFn would write to target instead, e.g. an archive
+	PopTo(prefix string, target PopTarget) error
+	// Verify checks the release at timestamp, or the newest when timestamp is 0
+	Verify(prefix string, timestamp int64) (VerifyReport, error)
+	// Prefixes returns every prefix with at least one stored manifest, sorted
+	Prefixes() ([]string, error)
+	// Manifests returns every stored manifest of prefix with its timestamp filled in
+	Manifests(prefix string) ([]Manifest, error)
+	// Current returns the release the current pointer of prefix refers to, 0
+	// when there is none and pop serves the newest release
+	Current(prefix string) (int64, error)
+	// Rollback makes the files of target live again and records them as a new
+	// release at timestamp, which it returns
+	Rollback(prefix string, target Manifest, timestamp int64) (Manifest, error)
+	// GC removes the releases of prefix the retention policy expires, the same
+	// cleanup a populate runs, or only reports them on a dry run
+	GC(prefix string, opts GCOptions) (GCResult, error)
+	// Locks returns the populate locks of prefix, or of every prefix when it is empty
+	Locks(prefix string) ([]Lock, error)
+	// ClearLock removes lock if it is still held by the same owner and expired
+	ClearLock(lock Lock) error
+	// SetOutput sends progress messages to w instead of stdout, e.g. to keep
+	// them out of an archive pop streams to stdout
+	SetOutput(w io.Writer)
+}
+
+// Factory describes a storage backend selectable with --mode
+type Factory struct {
+	Name        string
+	Description string
+	// Required lists config keys that must be set before New is called
+	Required []string
+	// Flags optionally defines the backend's own settings, such as --s3-region;
+	// the CLI adds them to its global flags and binds them to the config
+	Flags func(flags *pflag.FlagSet)
+	// Validate optionally checks requirements that depend on other settings
+	Validate func(cfg Config) error
+	New      func(cfg Config) (Backend, error)
+}
+
+var factories = map[string]Factory{}
+
+// Register makes a backend available under factory.Name
+// Backend packages call this from init(); registering the same name twice panics
+func Register(factory Factory) {
+	if factory.Name == "" || factory.New == nil {
+		panic("impl: Register called with incomplete factory")
+	}
+	if _, exists := factories[factory.Name]; exists {
+		panic(fmt.Sprintf("impl: backend %q registered twice", factory.Name))
+	}
+	factories[factory.Name] = factory
+}
+
+// Factories returns all registered backends sorted by name
+func Factories() []Factory {
+	all := make([]Factory, 0, len(factories))
+	for _, factory := range factories {
+		all = append(all, factory)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Name < all[j].Name
+	})
+	return all
+}
+
+// FactoryNames returns the names of all registered backends sorted alphabetically
+func FactoryNames() []string {
+	names := []string{}
+	for _, factory := range Factories() {
+		names = append(names, factory.Name)
+	}
+	return names
+}
+
+// LookupFactory returns the backend registered under name
+func LookupFactory(name string) (Factory, error) {
+	factory, exists := factories[name]
+	if !exists {
+		return Factory{}, fmt.Errorf("unknown mode %q, must be one of: %s", name, strings.Join(FactoryNames(), ", "))
+	}
+	return factory, nil
+}
+
+// Check verifies that every config key the backend requires is set, then runs
+// the backend's own Validate hook if it has one
+func (f Factory) Check(cfg Config) error {
+	for _, key := range f.Required {
+		if cfg.GetString(key) == "" {
+			return fmt.Errorf("can't have %s with no %s", f.Name, key)
+		}
+	}
+	if f.Validate != nil {
+		return f.Validate(cfg)
+	}
+	return nil
+}
+
+// NewBackend validates cfg and constructs the backend registered under name
+func NewBackend(name string, cfg Config) (Backend, error) {
+	factory, err := LookupFactory(name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = factory.Check(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return factory.New(cfg)
+}
+
+// Address builds the host:port storage address from cfg
+func Address(cfg Config) string {
+	return fmt.Sprintf("%s:%s", cfg.GetString("hostname"), cfg.GetString("port"))
+}
@@ -0,0 +1,93 @@
+package impl_test
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/RedHatInsights/valpop/impl"
+)
+
+// mapConfig is a minimal impl.Config backed by a map
+type mapConfig map[string]string
+
+func (c mapConfig) GetString(key string) string { return c[key] }
+func (c mapConfig) GetBool(key string) bool     { return c[key] == "true" }
+func (c mapConfig) GetInt64(key string) int64 {
+	var value int64
+	fmt.Sscan(c[key], &value)
+	return value
+}
+func (c mapConfig) Get(key string) any {
+	if value, exists := c[key]; exists {
+		return value
+	}
+	return nil
+}
+func (c mapConfig) GetStringSlice(key string) []string {
+	if c[key] == "" {
+		return nil
+	}
+	return strings.Split(c[key], ",")
+}
+
+var _ = Describe("Backend registry", func() {
+	// Registrations are global, so register the test backend once for the whole suite
+	var constructed impl.Config
+
+	BeforeEach(func() {
+		if _, err := impl.LookupFactory("registry-test"); err == nil {
+			return
+		}
+		impl.Register(impl.Factory{
+			Name:        "registry-test",
+			Description: "backend used by the registry tests",
+			Required:    []string{"token"},
+			New: func(cfg impl.Config) (impl.Backend, error) {
+				constructed = cfg
+				return nil, nil
+			},
+		})
+	})
+
+	It("should list registered backends sorted by name", func() {
+		names := impl.FactoryNames()
+		Expect(names).To(ContainElement("registry-test"))
+		Expect(names).To(ContainElement("s3"))
+		Expect(sort.StringsAreSorted(names)).To(BeTrue())
+	})
+
+	It("should reject unknown backends with the available names", func() {
+		_, err := impl.LookupFactory("nope")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(`unknown mode "nope"`))
+		Expect(err.Error()).To(ContainSubstring("registry-test"))
+	})
+
+	It("should validate required config before constructing", func() {
+		constructed = nil
+
+		_, err := impl.NewBackend("registry-test", mapConfig{})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(Equal("can't have registry-test with no token"))
+		Expect(constructed).To(BeNil())
+
+		cfg := mapConfig{"token": "abc"}
+		_, err = impl.NewBackend("registry-test", cfg)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(constructed).To(Equal(cfg))
+	})
+
+	It("should panic when a backend is registered twice", func() {
+		Expect(func() {
+			impl.Register(impl.Factory{Name: "registry-test", New: func(impl.Config) (impl.Backend, error) { return nil, nil }})
+		}).To(Panic())
+	})
+
+	It("should build the storage address from hostname and port", func() {
+		Expect(impl.Address(mapConfig{"hostname": "minio", "port": "9000"})).To(Equal("minio:9000"))
+	})
+})
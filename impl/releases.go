@@ -0,0 +1,161 @@
+package impl
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// ReleaseInfo summarises one stored release (manifest) of a prefix
+type ReleaseInfo struct {
+	Prefix      string `json:"prefix"`
+	Timestamp   int64  `json:"timestamp"`
+	Image       string `json:"image"`
+	ValpopImage string `json:"valpopImage,omitempty"`
+	Files       int    `json:"files"`
+	// Size is the total of the recorded file sizes; legacy manifests record none
+	Size int64 `json:"size"`
+	// Latest marks the release pop serves: the one the current pointer refers
+	// to, or the newest when there is no pointer
+	Latest bool `json:"latest"`
+	// Expiring is set when the current retention policy would remove the
+	// release; the release pop serves is never removed
+	Expiring bool `json:"expiring"`
+}
+
+// ReleaseList is printed as a table, or as a JSON array with --json
+type ReleaseList []ReleaseInfo
+
+func (l ReleaseList) String() string {
+	if len(l) == 0 {
+		return "No releases found\n"
+	}
+
+	var sb strings.Builder
+	w := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PREFIX\tTIMESTAMP\tCREATED\tIMAGE\tVALPOP IMAGE\tFILES\tSIZE\tSTATUS")
+	for _, release := range l {
+		status := []string{}
+		if release.Latest {
+			status = append(status, "latest")
+		}
+		if release.Expiring {
+			status = append(status, "expiring")
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%d\t%d\t%s\n",
+			release.Prefix,
+			release.Timestamp,
+			time.Unix(release.Timestamp, 0).UTC().Format(time.RFC3339),
+			orDash(release.Image),
+			orDash(release.ValpopImage),
+			release.Files,
+			release.Size,
+			strings.Join(status, ","),
+		)
+	}
+	w.Flush()
+	return sb.String()
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// DescribeReleases summarises the manifests of prefix, newest first, marking the
+// release pop serves and those the retention policy would remove. current is
+// the release the current pointer refers to, 0 when there is none and the
+// newest release is served
+func DescribeReleases(prefix string, manifests []Manifest, current, currentTime, timeout, minAssetRecords int64) ReleaseList {
+	infos := make([]ManifestInfo, len(manifests))
+	for i, manifest := range manifests {
+		infos[i] = ManifestInfo{Key: strconv.FormatInt(manifest.Timestamp, 10), Timestamp: manifest.Timestamp}
+	}
+	expiring := map[int64]bool{}
+	for _, info := range DetermineManifestsToDelete(infos, currentTime, timeout, minAssetRecords) {
+		expiring[info.Timestamp] = true
+	}
+
+	releases := ReleaseList{}
+	for _, manifest := range manifests {
+		release := ReleaseInfo{
+			Prefix:      prefix,
+			Timestamp:   manifest.Timestamp,
+			Image:       manifest.Image,
+			ValpopImage: manifest.ValpopImage,
+			Files:       len(manifest.Files),
+			Latest:      current != 0 && manifest.Timestamp == current,
+			Expiring:    expiring[manifest.Timestamp] && manifest.Timestamp != current,
+		}
+		for _, entry := range manifest.Entries {
+			release.Size += entry.Size
+		}
+		releases = append(releases, release)
+	}
+
+	sort.Slice(releases, func(i, j int) bool {
+		return releases[i].Timestamp > releases[j].Timestamp
+	})
+	if current == 0 && len(releases) > 0 {
+		releases[0].Latest = true
+	}
+	return releases
+}
+
+// ParseManifestKey splits an S3 manifest key, manifests/{prefix}/{timestamp},
+// into its prefix and timestamp
+func ParseManifestKey(key string) (string, int64, bool) {
+	rest, found := strings.CutPrefix(key, "manifests/")
+	if !found {
+		return "", 0, false
+	}
+
+	slash := strings.LastIndex(rest, "/")
+	if slash <= 0 {
+		return "", 0, false
+	}
+	timestamp, err := strconv.ParseInt(rest[slash+1:], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return rest[:slash], timestamp, true
+}
+
+// FindRelease returns the manifest selected by to, either a manifest timestamp
+// or an image, in which case the newest manifest built from that image is used
+func FindRelease(manifests []Manifest, to string) (Manifest, error) {
+	timestamp, err := strconv.ParseInt(to, 10, 64)
+	isTimestamp := err == nil
+
+	var found *Manifest
+	for i, manifest := range manifests {
+		matches := manifest.Image == to
+		if isTimestamp {
+			matches = manifest.Timestamp == timestamp
+		}
+		if matches && (found == nil || manifest.Timestamp > found.Timestamp) {
+			found = &manifests[i]
+		}
+	}
+
+	if found == nil {
+		return Manifest{}, fmt.Errorf("no retained release matches %q", to)
+	}
+	return *found, nil
+}
+
+// RollbackTimestamp picks the timestamp for a rollback release; it must sort
+// after every existing manifest so it becomes the latest
+func RollbackTimestamp(manifests []Manifest, now int64) int64 {
+	for _, manifest := range manifests {
+		if manifest.Timestamp >= now {
+			now = manifest.Timestamp + 1
+		}
+	}
+	return now
+}
@@ -0,0 +1,118 @@
+package impl_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/RedHatInsights/valpop/impl"
+)
+
+var _ = Describe("Releases", func() {
+	Context("DescribeReleases", func() {
+		manifests := []impl.Manifest{
+			{Timestamp: 1000, Image: "myapp:v1", Files: []string{"index.html"}},
+			{Timestamp: 3000, Image: "myapp:v3", ValpopImage: "valpop:abc", Files: []string{"index.html", "app.js"}, Entries: []impl.FileEntry{
+				{Path: "index.html", Size: 100},
+				{Path: "app.js", Size: 250},
+			}},
+			{Timestamp: 2000, Image: "myapp:v2", Files: []string{"index.html"}},
+		}
+
+		It("should list releases newest first and mark the latest", func() {
+			releases := impl.DescribeReleases("myapp", manifests, 0, 3000, 86400, 3)
+
+			Expect(releases).To(HaveLen(3))
+			Expect(releases[0]).To(Equal(impl.ReleaseInfo{
+				Prefix: "myapp", Timestamp: 3000, Image: "myapp:v3", ValpopImage: "valpop:abc", Files: 2, Size: 350, Latest: true,
+			}))
+			Expect(releases[1].Timestamp).To(Equal(int64(2000)))
+			Expect(releases[2].Timestamp).To(Equal(int64(1000)))
+			Expect(releases[1].Latest).To(BeFalse())
+		})
+
+		It("should mark releases the retention policy would remove", func() {
+			releases := impl.DescribeReleases("myapp", manifests, 0, 5000, 30, 1)
+
+			Expect(releases[0].Expiring).To(BeFalse())
+			Expect(releases[1].Expiring).To(BeTrue())
+			Expect(releases[2].Expiring).To(BeTrue())
+		})
+
+		It("should mark the release of the current pointer and keep it from expiring", func() {
+			releases := impl.DescribeReleases("myapp", manifests, 1000, 5000, 30, 1)
+
+			Expect(releases[0].Latest).To(BeFalse())
+			Expect(releases[2].Latest).To(BeTrue())
+			Expect(releases[2].Expiring).To(BeFalse())
+			Expect(releases[1].Expiring).To(BeTrue())
+		})
+
+		It("should handle a prefix without releases", func() {
+			releases := impl.DescribeReleases("myapp", nil, 0, 5000, 30, 1)
+
+			Expect(releases).To(BeEmpty())
+			Expect(releases.String()).To(Equal("No releases found\n"))
+		})
+
+		It("should print a table", func() {
+			table := impl.DescribeReleases("myapp", manifests, 0, 5000, 30, 1).String()
+
+			Expect(table).To(HavePrefix("PREFIX"))
+			Expect(table).To(ContainSubstring("myapp:v3"))
+			Expect(table).To(ContainSubstring("1970-01-01T00:50:00Z"))
+			Expect(table).To(MatchRegexp(`3000 .* latest\n`))
+			Expect(table).To(MatchRegexp(`1000 .* expiring\n`))
+		})
+	})
+
+	Context("ParseManifestKey", func() {
+		DescribeTable("should split manifest keys",
+			func(key, prefix string, timestamp int64, ok bool) {
+				gotPrefix, gotTimestamp, gotOK := impl.ParseManifestKey(key)
+				Expect(gotOK).To(Equal(ok))
+				Expect(gotPrefix).To(Equal(prefix))
+				Expect(gotTimestamp).To(Equal(timestamp))
+			},
+			Entry("simple prefix", "manifests/myapp/1742472000", "myapp", int64(1742472000), true),
+			Entry("nested prefix", "manifests/apps/admin/1742472000", "apps/admin", int64(1742472000), true),
+			Entry("data key", "data/myapp/index.html", "", int64(0), false),
+			Entry("non-numeric timestamp", "manifests/myapp/latest", "", int64(0), false),
+			Entry("missing prefix", "manifests/1742472000", "", int64(0), false),
+		)
+	})
+
+	Context("FindRelease", func() {
+		manifests := []impl.Manifest{
+			{Timestamp: 1000, Image: "myapp:v1"},
+			{Timestamp: 3000, Image: "myapp:v2"},
+			{Timestamp: 2000, Image: "myapp:v2"},
+		}
+
+		It("should select a release by timestamp", func() {
+			release, err := impl.FindRelease(manifests, "2000")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(release.Timestamp).To(Equal(int64(2000)))
+		})
+
+		It("should select the newest release of an image", func() {
+			release, err := impl.FindRelease(manifests, "myapp:v2")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(release.Timestamp).To(Equal(int64(3000)))
+		})
+
+		It("should fail when no retained release matches", func() {
+			_, err := impl.FindRelease(manifests, "myapp:v0")
+			Expect(err).To(MatchError(`no retained release matches "myapp:v0"`))
+		})
+	})
+
+	Context("RollbackTimestamp", func() {
+		It("should use the current time when it is newest", func() {
+			Expect(impl.RollbackTimestamp([]impl.Manifest{{Timestamp: 1000}}, 5000)).To(Equal(int64(5000)))
+		})
+
+		It("should sort after every existing release", func() {
+			Expect(impl.RollbackTimestamp([]impl.Manifest{{Timestamp: 1000}, {Timestamp: 5000}}, 5000)).To(Equal(int64(5001)))
+		})
+	})
+})
@@ -0,0 +1,94 @@
+package s3
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	creds "github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Credential providers selectable with --s3-credentials
+const (
+	CredentialsStatic      = "static"
+	CredentialsEnv         = "env"
+	CredentialsFile        = "file"
+	CredentialsWebIdentity = "web-identity"
+	CredentialsChain       = "chain"
+)
+
+// CredentialProviders lists the valid --s3-credentials values
+var CredentialProviders = []string{CredentialsStatic, CredentialsEnv, CredentialsFile, CredentialsWebIdentity, CredentialsChain}
+
+// ValidateCredentials checks that opts carries what the selected provider needs
+func ValidateCredentials(opts Options) error {
+	switch opts.Credentials {
+	case "", CredentialsStatic:
+		if opts.Username == "" {
+			return fmt.Errorf("can't have s3 with no username")
+		}
+		if opts.Password == "" {
+			return fmt.Errorf("can't have s3 with no password")
+		}
+	case CredentialsWebIdentity:
+		if opts.WebIdentityTokenFile == "" {
+			return fmt.Errorf("can't have s3 web-identity credentials with no s3-web-identity-token-file")
+		}
+	case CredentialsEnv, CredentialsFile, CredentialsChain:
+	default:
+		return fmt.Errorf("unknown s3 credentials provider %q, must be one of: %s", opts.Credentials, strings.Join(CredentialProviders, ", "))
+	}
+	return nil
+}
+
+// NewCredentials builds the minio credentials for the selected provider
+// The chain tries, in order: static username/password, AWS env vars, the shared
+// credentials file and, when a token file is configured, web identity
+func NewCredentials(opts Options) (*creds.Credentials, error) {
+	err := ValidateCredentials(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	switch opts.Credentials {
+	case CredentialsEnv:
+		return creds.NewEnvAWS(), nil
+	case CredentialsFile:
+		return creds.NewFileAWSCredentials(opts.CredentialsFile, opts.Profile), nil
+	case CredentialsWebIdentity:
+		return creds.New(webIdentityProvider(opts)), nil
+	case CredentialsChain:
+		providers := []creds.Provider{
+			&creds.Static{Value: creds.Value{
+				AccessKeyID:     opts.Username,
+				SecretAccessKey: opts.Password,
+				SessionToken:    opts.SessionToken,
+				SignerType:      creds.SignatureV4,
+			}},
+			&creds.EnvAWS{},
+			&creds.FileAWSCredentials{Filename: opts.CredentialsFile, Profile: opts.Profile},
+		}
+		if opts.WebIdentityTokenFile != "" {
+			providers = append(providers, webIdentityProvider(opts))
+		}
+		return creds.NewChainCredentials(providers), nil
+	}
+	return creds.NewStaticV4(opts.Username, opts.Password, opts.SessionToken), nil
+}
+
+// webIdentityProvider exchanges a projected service account token for
+// temporary credentials; the token file is re-read on every refresh because
+// the kubelet rotates it in place
+func webIdentityProvider(opts Options) *creds.STSWebIdentity {
+	return &creds.STSWebIdentity{
+		STSEndpoint: opts.STSEndpoint,
+		RoleARN:     opts.RoleARN,
+		GetWebIDTokenExpiry: func() (*creds.WebIdentityToken, error) {
+			token, err := os.ReadFile(opts.WebIdentityTokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("could not read web identity token: %w", err)
+			}
+			return &creds.WebIdentityToken{Token: strings.TrimSpace(string(token))}, nil
+		},
+	}
+}
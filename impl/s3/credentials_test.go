@@ -0,0 +1,146 @@
+package s3_test
+
+import (
+	"os"
+	"path/filepath"
+
+	creds "github.com/minio/minio-go/v7/pkg/credentials"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/RedHatInsights/valpop/impl/s3"
+)
+
+// setenv sets an env var for the duration of the current spec
+func setenv(key, value string) {
+	previous, existed := os.LookupEnv(key)
+	Expect(os.Setenv(key, value)).To(Succeed())
+	DeferCleanup(func() {
+		if existed {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+var _ = Describe("S3 credential providers", func() {
+	BeforeEach(func() {
+		// Keep the developer's own AWS setup out of the chain tests
+		for _, key := range []string{"AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY", "AWS_SESSION_TOKEN"} {
+			setenv(key, "")
+		}
+		setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(GinkgoT().TempDir(), "missing"))
+	})
+
+	Context("ValidateCredentials", func() {
+		DescribeTable("should report what each provider is missing",
+			func(opts s3.Options, expectedErr string) {
+				err := s3.ValidateCredentials(opts)
+				if expectedErr == "" {
+					Expect(err).ToNot(HaveOccurred())
+				} else {
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring(expectedErr))
+				}
+			},
+			Entry("static defaults need a username", s3.Options{Password: "secret"}, "can't have s3 with no username"),
+			Entry("static needs a password", s3.Options{Credentials: "static", Username: "admin"}, "can't have s3 with no password"),
+			Entry("static with both", s3.Options{Credentials: "static", Username: "admin", Password: "secret"}, ""),
+			Entry("env needs nothing up front", s3.Options{Credentials: "env"}, ""),
+			Entry("file needs nothing up front", s3.Options{Credentials: "file"}, ""),
+			Entry("chain needs nothing up front", s3.Options{Credentials: "chain"}, ""),
+			Entry("web identity needs a token file", s3.Options{Credentials: "web-identity"}, "no s3-web-identity-token-file"),
+			Entry("web identity with a token file", s3.Options{Credentials: "web-identity", WebIdentityTokenFile: "/var/run/token"}, ""),
+			Entry("unknown provider", s3.Options{Credentials: "vault"}, `unknown s3 credentials provider "vault"`),
+		)
+	})
+
+	Context("NewCredentials", func() {
+		It("should pass the session token through static credentials", func() {
+			credentials, err := s3.NewCredentials(s3.Options{Username: "admin", Password: "secret", SessionToken: "token"})
+			Expect(err).ToNot(HaveOccurred())
+
+			value, err := credentials.Get()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(value.AccessKeyID).To(Equal("admin"))
+			Expect(value.SecretAccessKey).To(Equal("secret"))
+			Expect(value.SessionToken).To(Equal("token"))
+		})
+
+		It("should read AWS env vars", func() {
+			setenv("AWS_ACCESS_KEY_ID", "env-key")
+			setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+			setenv("AWS_SESSION_TOKEN", "env-token")
+
+			credentials, err := s3.NewCredentials(s3.Options{Credentials: "env"})
+			Expect(err).ToNot(HaveOccurred())
+
+			value, err := credentials.Get()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(value.AccessKeyID).To(Equal("env-key"))
+			Expect(value.SessionToken).To(Equal("env-token"))
+		})
+
+		It("should read a profile from a shared credentials file", func() {
+			path := filepath.Join(GinkgoT().TempDir(), "credentials")
+			Expect(os.WriteFile(path, []byte("[default]\naws_access_key_id = default-key\naws_secret_access_key = default-secret\n\n[frontend]\naws_access_key_id = file-key\naws_secret_access_key = file-secret\n"), 0600)).To(Succeed())
+
+			credentials, err := s3.NewCredentials(s3.Options{Credentials: "file", CredentialsFile: path, Profile: "frontend"})
+			Expect(err).ToNot(HaveOccurred())
+
+			value, err := credentials.Get()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(value.AccessKeyID).To(Equal("file-key"))
+			Expect(value.SecretAccessKey).To(Equal("file-secret"))
+		})
+
+		It("should prefer static credentials in the chain", func() {
+			setenv("AWS_ACCESS_KEY_ID", "env-key")
+			setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+
+			credentials, err := s3.NewCredentials(s3.Options{Credentials: "chain", Username: "admin", Password: "secret"})
+			Expect(err).ToNot(HaveOccurred())
+
+			value, err := credentials.Get()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(value.AccessKeyID).To(Equal("admin"))
+		})
+
+		It("should fall back to env vars in the chain", func() {
+			setenv("AWS_ACCESS_KEY_ID", "env-key")
+			setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+
+			credentials, err := s3.NewCredentials(s3.Options{Credentials: "chain"})
+			Expect(err).ToNot(HaveOccurred())
+
+			value, err := credentials.Get()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(value.AccessKeyID).To(Equal("env-key"))
+		})
+
+		It("should be anonymous when the chain finds nothing", func() {
+			credentials, err := s3.NewCredentials(s3.Options{Credentials: "chain"})
+			Expect(err).ToNot(HaveOccurred())
+
+			value, err := credentials.Get()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(value.SignerType).To(Equal(creds.SignatureAnonymous))
+		})
+
+		It("should build web identity credentials without contacting STS", func() {
+			_, err := s3.NewCredentials(s3.Options{
+				Credentials:          "web-identity",
+				WebIdentityTokenFile: "/var/run/secrets/eks.amazonaws.com/serviceaccount/token",
+				RoleARN:              "arn:aws:iam::123456789012:role/frontend",
+				STSEndpoint:          "https://sts.amazonaws.com",
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should refuse to build credentials that fail validation", func() {
+			_, err := s3.NewCredentials(s3.Options{Credentials: "static"})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,55 @@
+package s3
+
+import (
+	"time"
+
+	impl "github.com/RedHatInsights/valpop/impl"
+)
+
+// Test-only access to unexported helpers for the external s3_test package
+
+// PopulateFromDirWithHashes runs the skip-aware upload used by PopulateFn
+var PopulateFromDirWithHashes = (*Minio).populateFromDir
+
+// VerifyManifest checks a manifest against the stored objects, skipping the manifest lookup
+var VerifyManifest = (*Minio).verifyManifest
+
+// SetLayout selects the layout new releases are written in, as --s3-layout does
+func SetLayout(m *Minio, layout string) {
+	m.layout = layout
+}
+
+// SetCurrent points the current pointer at a release, as a finished populate does
+var SetCurrent = (*Minio).setCurrent
+
+// SetLockOptions overrides the populate lock owner, lease and wait
+func SetLockOptions(m *Minio, owner string, lease, wait time.Duration) {
+	m.lockOwner, m.lockLease, m.lockWait = owner, lease, wait
+}
+
+// CheckLock returns why the lock of a prefix was lost, or nil while it is held
+var CheckLock = (*Minio).checkLock
+
+// CleanupKeys works out the keys CleanupCache removes for a set of manifests
+var CleanupKeys = (*Minio).cleanupKeys
+
+// RemoveKeys deletes expired keys as CleanupCache and GC do
+var RemoveKeys = (*Minio).removeKeys
+
+// OrphanKeys finds unreferenced objects for a set of kept manifests
+var OrphanKeys = (*Minio).orphanKeys
+
+// SetProtected overrides the protected file patterns, as --protect does
+func SetProtected(m *Minio, patterns []string) {
+	m.protected = patterns
+}
+
+// SetCacheRules puts rules ahead of the default cache policy, as cache-rules does
+func SetCacheRules(m *Minio, rules []impl.CacheRule, cacheMaxAge int64) {
+	m.cachePolicy = impl.NewCachePolicy(rules, cacheMaxAge)
+}
+
+// SetContentTypes replaces the content type resolver, as --content-type does
+func SetContentTypes(m *Minio, types impl.ContentTypes) {
+	m.contentTypes = types
+}
@@ -12,19 +12,20 @@ import (
 type S3Client interface {
 	PutObject(ctx context.Context, bucketName, objectName string, reader io.Reader, objectSize int64, opts minio.PutObjectOptions) (minio.UploadInfo, error)
 	GetObject(ctx context.Context, bucketName, objectName string, opts minio.GetObjectOptions) (*minio.Object, error)
+	StatObject(ctx context.Context, bucketName, objectName string, opts minio.StatObjectOptions) (minio.ObjectInfo, error)
+	CopyObject(ctx context.Context, dst minio.CopyDestOptions, src minio.CopySrcOptions) (minio.UploadInfo, error)
 	RemoveObject(ctx context.Context, bucketName, objectName string, opts minio.RemoveObjectOptions) error
 	ListObjects(ctx context.Context, bucketName string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo
 }
 
-// S3Service interface extends Implementation with S3-specific operations
+// S3Service interface extends Backend with S3-specific operations
 type S3Service interface {
-	impl.Implementation
+	impl.Backend
 
 	// S3-specific operations
 	SetManifest(namespace, bucket string, timestamp int64, files impl.Manifest) error
-	PopulateFn(addr, bucket, source, prefix, image, valpopImage string, timeout int64, minAssetRecords int64, cacheMaxAge int64) error
 	CleanupCache(prefix, bucket string, timeout int64, minAssetRecords int64) error
 }
 
-// Note: Implementations of S3Service should also implement impl.Implementation
+// Note: Implementations of S3Service should also implement impl.Backend
 // The interface composition provides all the necessary methods for storage operations
@@ -0,0 +1,327 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	impl "github.com/RedHatInsights/valpop/impl"
+	minio "github.com/minio/minio-go/v7"
+)
+
+// Lock object metadata; the JSON body only exists for people inspecting the bucket
+const (
+	lockOwnerMetadataKey   = "owner"
+	lockExpiresMetadataKey = "expires"
+)
+
+// lockPollInterval is how often a waiting populate retries a held lock
+const lockPollInterval = 2 * time.Second
+
+// lockKey is the object guarding populates of prefix
+// Format: locks/{prefix}
+func lockKey(prefix string) string {
+	return fmt.Sprintf("locks/%s", prefix)
+}
+
+// heldLock is a populate lock this process holds: the ETag of its last write,
+// the stop of its lease renewals and the context of the work done under it,
+// which is cancelled once the lock is lost
+type heldLock struct {
+	etag string
+	stop func() error
+	ctx  context.Context
+}
+
+// errLockChanged is returned by writeLock when the lock was written by someone
+// else since it was read
+var errLockChanged = errors.New("lock changed since it was read")
+
+// acquireLock takes the populate lock of prefix, waiting up to the configured
+// lock wait while another owner holds an unexpired lease, and renews its lease
+// every third of the lease until releaseLock
+func (m *Minio) acquireLock(prefix string) error {
+	var etag string
+	err := impl.WaitForLock(m.lockWait, lockPollInterval, func() (held *impl.Lock, err error) {
+		held, etag, err = m.tryLock(prefix)
+		return held, err
+	})
+	if err != nil {
+		return err
+	}
+
+	held := &heldLock{etag: etag, ctx: m.ctx}
+	// A lease that has already ended is not worth renewing
+	if m.lockLease > 0 {
+		held.ctx, held.stop = impl.KeepAlive(m.ctx, m.lockLease/3, func() error {
+			return m.renewLock(prefix, held)
+		})
+	}
+	m.locks[prefix] = held
+	return nil
+}
+
+// lockContext is the context for writes under the lock of prefix: cancelled,
+// with the reason as its cause, once a renewal finds the lock lost
+func (m *Minio) lockContext(prefix string) context.Context {
+	if held, exists := m.locks[prefix]; exists {
+		return held.ctx
+	}
+	return m.ctx
+}
+
+// checkLock returns why the lock of prefix was lost, or nil while it is held
+// Populates check it before each write that another owner could race
+func (m *Minio) checkLock(prefix string) error {
+	return context.Cause(m.lockContext(prefix))
+}
+
+// tryLock makes one attempt at the lock of prefix and returns the lock in the
+// way, or nil and the ETag of the lock once it is held. A missing lock is
+// created, and an expired or released one is taken over, with writeLock so only
+// one writer wins
+func (m *Minio) tryLock(prefix string) (*impl.Lock, string, error) {
+	etag, err := m.writeLock(m.newLock(prefix), "")
+	if err == nil {
+		return m.confirmLock(prefix, etag)
+	}
+	if !errors.Is(err, errLockChanged) {
+		return nil, "", err
+	}
+
+	current, currentETag, found, err := m.readLock(prefix)
+	if err != nil {
+		return nil, "", err
+	}
+	if !found {
+		// Released in between; take it on the next attempt
+		return &impl.Lock{Prefix: prefix}, "", nil
+	}
+	if current.Owner != m.lockOwner && !current.Expired(time.Now().Unix()) {
+		return &current, "", nil
+	}
+
+	etag, err = m.writeLock(m.newLock(prefix), currentETag)
+	if errors.Is(err, errLockChanged) {
+		// Another populate took over the expired lease first
+		return &current, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if current.Owner != "" && current.Owner != m.lockOwner {
+		fmt.Fprintf(m.out, "Took over expired lock %s\n", current)
+	}
+	return m.confirmLock(prefix, etag)
+}
+
+// newLock is a lock of prefix owned by this process for a full lease
+func (m *Minio) newLock(prefix string) impl.Lock {
+	return impl.Lock{Prefix: prefix, Owner: m.lockOwner, Expires: time.Now().Add(m.lockLease).Unix()}
+}
+
+// writeLock writes lock over the lock of its prefix that still has etag, or
+// only when there is no lock when etag is empty, and returns the new ETag
+// It returns errLockChanged when the lock was written in between. The check
+// uses If-Match and If-None-Match; servers that answer NotImplemented fall back
+// to reading the ETag before an unconditional write, which races with other
+// writers in between
+func (m *Minio) writeLock(lock impl.Lock, etag string) (string, error) {
+	raw, err := json.Marshal(lock)
+	if err != nil {
+		return "", fmt.Errorf("could not encode lock:%w", err)
+	}
+	put := func(conditional bool) (string, error) {
+		opts := minio.PutObjectOptions{
+			ContentType: "application/json",
+			UserMetadata: map[string]string{
+				lockOwnerMetadataKey:   lock.Owner,
+				lockExpiresMetadataKey: strconv.FormatInt(lock.Expires, 10),
+			},
+		}
+		if conditional && etag == "" {
+			opts.SetMatchETagExcept("*")
+		} else if conditional {
+			opts.SetMatchETag(etag)
+		}
+		info, err := m.client.PutObject(m.ctx, m.bucket, lockKey(lock.Prefix), bytes.NewReader(raw), int64(len(raw)), opts)
+		return info.ETag, err
+	}
+
+	newETag, err := put(true)
+	if err == nil {
+		return newETag, nil
+	}
+	switch minio.ToErrorResponse(err).Code {
+	case "PreconditionFailed", "ConditionalRequestConflict":
+		return "", errLockChanged
+	case "NotImplemented":
+		// Check the ETag ourselves below
+	default:
+		return "", fmt.Errorf("err from s3:%w", err)
+	}
+
+	_, currentETag, _, err := m.readLock(lock.Prefix)
+	if err != nil {
+		return "", err
+	}
+	if currentETag != etag {
+		return "", errLockChanged
+	}
+	newETag, err = put(false)
+	if err != nil {
+		return "", fmt.Errorf("err from s3:%w", err)
+	}
+	return newETag, nil
+}
+
+// confirmLock reads the lock back and checks it still has the ETag of our
+// write. Where conditional writes are enforced it always does; on servers
+// without them it narrows, but does not close, the window in which two writers
+// both believe they took the lock
+func (m *Minio) confirmLock(prefix, etag string) (*impl.Lock, string, error) {
+	current, currentETag, found, err := m.readLock(prefix)
+	if err != nil {
+		return nil, "", err
+	}
+	if !found {
+		return &impl.Lock{Prefix: prefix}, "", nil
+	}
+	if current.Owner != m.lockOwner || currentETag != etag {
+		return &current, "", nil
+	}
+	fmt.Fprintf(m.out, "Acquired lock %s\n", current)
+	return nil, etag, nil
+}
+
+// readLock returns the lock of prefix and its ETag. A released lock is found
+// with an empty owner
+func (m *Minio) readLock(prefix string) (impl.Lock, string, bool, error) {
+	info, err := m.statObject(m.bucket, lockKey(prefix))
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return impl.Lock{}, "", false, nil
+	}
+	if err != nil {
+		return impl.Lock{}, "", false, fmt.Errorf("err from s3:%w", err)
+	}
+
+	expires, err := strconv.ParseInt(metadataValue(info, lockExpiresMetadataKey), 10, 64)
+	if err != nil {
+		return impl.Lock{}, "", false, fmt.Errorf("invalid lock %s: %w", lockKey(prefix), err)
+	}
+	return impl.Lock{Prefix: prefix, Owner: metadataValue(info, lockOwnerMetadataKey), Expires: expires}, info.ETag, true, nil
+}
+
+// renewLock extends the lease of a held lock, only while nobody took it over
+func (m *Minio) renewLock(prefix string, held *heldLock) error {
+	etag, err := m.writeLock(m.newLock(prefix), held.etag)
+	if errors.Is(err, errLockChanged) {
+		return m.lostLock(prefix)
+	}
+	if err != nil {
+		return err
+	}
+	held.etag = etag
+	return nil
+}
+
+// lostLock is the error of a lock taken over while this process held it
+func (m *Minio) lostLock(prefix string) error {
+	current, _, _, err := m.readLock(prefix)
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("lock of %s was lost during populate, now held by %q: the lease expired, raise --lock-lease", prefix, current.Owner)
+}
+
+// releaseLock stops renewing the lock of prefix and releases it if this
+// process still owns it. Objects cannot be deleted conditionally, so the lock
+// is released by overwriting it with a lock without owner while it still has
+// the ETag of our last write
+func (m *Minio) releaseLock(prefix string) error {
+	held, exists := m.locks[prefix]
+	if !exists {
+		return fmt.Errorf("lock of %s is not held", prefix)
+	}
+	delete(m.locks, prefix)
+	if held.stop != nil {
+		err := held.stop()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := m.writeLock(impl.Lock{Prefix: prefix}, held.etag)
+	if errors.Is(err, errLockChanged) {
+		return m.lostLock(prefix)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(m.out, "Released lock %s\n", lockKey(prefix))
+	return nil
+}
+
+// Locks returns the populate locks of prefix, or of every prefix when it is empty
+func (m *Minio) Locks(prefix string) ([]impl.Lock, error) {
+	listPrefix := "locks/"
+	if prefix != "" {
+		listPrefix = lockKey(prefix)
+	}
+
+	locks := []impl.Lock{}
+	for object := range m.client.ListObjects(m.ctx, m.bucket, minio.ListObjectsOptions{Prefix: listPrefix, Recursive: true}) {
+		if object.Err != nil {
+			return nil, fmt.Errorf("err from s3:%w", object.Err)
+		}
+		lockPrefix := strings.TrimPrefix(object.Key, "locks/")
+		// Only exact matches; a prefix of "app" must not pick up "app/admin"
+		if prefix != "" && lockPrefix != prefix {
+			continue
+		}
+
+		lock, _, found, err := m.readLock(lockPrefix)
+		if err != nil {
+			return nil, err
+		}
+		// Released locks are left behind without an owner
+		if found && lock.Owner != "" {
+			locks = append(locks, lock)
+		}
+	}
+	slices.SortFunc(locks, func(a, b impl.Lock) int {
+		return strings.Compare(a.Prefix, b.Prefix)
+	})
+	return locks, nil
+}
+
+// ClearLock releases an expired lock, after checking it has not been renewed
+// or taken over since it was listed
+func (m *Minio) ClearLock(lock impl.Lock) error {
+	current, etag, found, err := m.readLock(lock.Prefix)
+	if err != nil {
+		return err
+	}
+	if !found || current.Owner == "" {
+		return nil
+	}
+	if current.Owner != lock.Owner || !current.Expired(time.Now().Unix()) {
+		return fmt.Errorf("lock %s is no longer stale", current)
+	}
+
+	_, err = m.writeLock(impl.Lock{Prefix: lock.Prefix}, etag)
+	if errors.Is(err, errLockChanged) {
+		return fmt.Errorf("lock %s is no longer stale", current)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(m.out, "Cleared lock %s\n", current)
+	return nil
+}
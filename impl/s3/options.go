@@ -0,0 +1,216 @@
+package s3
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	impl "github.com/RedHatInsights/valpop/impl"
+	minio "github.com/minio/minio-go/v7"
+	"github.com/spf13/pflag"
+)
+
+// Options configures the connection to an S3 compatible endpoint
+type Options struct {
+	Addr        string
+	Bucket      string
+	CacheMaxAge int64
+	// CacheRules come before the default rules of impl.NewCachePolicy
+	CacheRules []impl.CacheRule
+	// ContentTypes resolves the Content-Type of populated files
+	ContentTypes impl.ContentTypes
+	// PartSize is the multipart upload chunk size in bytes, 0 for the client default
+	PartSize uint64
+	// Layout is impl.LayoutShared or impl.LayoutRelease
+	Layout string
+	// LockLease is how long a populate lock is held before others may take it
+	// over, 0 for impl.DefaultLockLease; LockWait is how long to wait for a held lock
+	LockLease time.Duration
+	LockWait  time.Duration
+	// Protected are the glob patterns of files cleanup never deletes, see
+	// impl.IsProtected; empty for impl.DefaultProtectedFiles
+	Protected []string
+
+	// Credentials selects the provider, see CredentialProviders
+	Credentials          string
+	Username             string
+	Password             string
+	SessionToken         string
+	CredentialsFile      string
+	Profile              string
+	WebIdentityTokenFile string
+	RoleARN              string
+	STSEndpoint          string
+
+	// Secure enables HTTPS; the remaining TLS settings need it, see ValidateTLS
+	Secure             bool
+	Region             string
+	CABundle           string
+	InsecureSkipVerify bool
+	// BucketLookup is one of "auto", "path" or "dns" (virtual-host style)
+	BucketLookup string
+}
+
+// RegisterFlags defines the --s3-* flags that OptionsFromConfig reads
+func RegisterFlags(flags *pflag.FlagSet) {
+	flags.String("s3-credentials", CredentialsStatic, fmt.Sprintf("S3 credentials provider, one of: %s", strings.Join(CredentialProviders, ", ")))
+	flags.String("s3-session-token", "", "Session token for temporary S3 static credentials")
+	flags.String("s3-credentials-file", "", "Shared AWS credentials file (default $AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials)")
+	flags.String("s3-profile", "", "Profile to read from the shared credentials file (default $AWS_PROFILE or default)")
+	flags.String("s3-web-identity-token-file", "", "Web identity token file for STS (default $AWS_WEB_IDENTITY_TOKEN_FILE)")
+	flags.String("s3-role-arn", "", "Role to assume with the web identity token (default $AWS_ROLE_ARN)")
+	flags.String("s3-sts-endpoint", "https://sts.amazonaws.com", "STS endpoint used for web identity credentials")
+	flags.Bool("s3-secure", false, "Use HTTPS to connect to S3")
+	flags.String("s3-region", "", "S3 region, detected from the endpoint when empty")
+	flags.String("s3-ca-bundle", "", "Path to a PEM CA bundle trusted in addition to the system pool")
+	flags.Bool("s3-insecure-skip-verify", false, "Skip TLS certificate verification (development only)")
+	flags.Int64("s3-part-size", 0, "S3 multipart upload part size in bytes, 0 for the client default (16 MiB)")
+	flags.String("s3-layout", impl.LayoutShared, "S3 storage layout: shared (one key per file) or release (keys per release behind a current pointer)")
+	flags.String("s3-bucket-lookup", "auto", "S3 addressing style: auto, path or dns (virtual-host)")
+}
+
+// OptionsFromConfig reads the S3 settings from the CLI config
+// Malformed cache rules and content types are left out here and reported by the
+// factory's Validate
+func OptionsFromConfig(cfg impl.Config) Options {
+	cacheRules, _ := impl.CacheRulesFromConfig(cfg)
+	contentTypes, _ := impl.ContentTypesFromConfig(cfg)
+	return Options{
+		Addr:                 impl.Address(cfg),
+		Bucket:               cfg.GetString("bucket"),
+		CacheMaxAge:          cfg.GetInt64("cache-max-age"),
+		CacheRules:           cacheRules,
+		ContentTypes:         contentTypes,
+		PartSize:             uint64(max(cfg.GetInt64("s3-part-size"), 0)),
+		Layout:               cfg.GetString("s3-layout"),
+		LockLease:            time.Duration(cfg.GetInt64("lock-lease")) * time.Second,
+		LockWait:             time.Duration(cfg.GetInt64("lock-wait")) * time.Second,
+		Protected:            impl.ProtectedPatterns(cfg),
+		Credentials:          cfg.GetString("s3-credentials"),
+		Username:             cfg.GetString("username"),
+		Password:             cfg.GetString("password"),
+		SessionToken:         cfg.GetString("s3-session-token"),
+		CredentialsFile:      cfg.GetString("s3-credentials-file"),
+		Profile:              cfg.GetString("s3-profile"),
+		WebIdentityTokenFile: firstNonEmpty(cfg.GetString("s3-web-identity-token-file"), os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")),
+		RoleARN:              firstNonEmpty(cfg.GetString("s3-role-arn"), os.Getenv("AWS_ROLE_ARN")),
+		STSEndpoint:          cfg.GetString("s3-sts-endpoint"),
+		Secure:               cfg.GetBool("s3-secure"),
+		Region:               cfg.GetString("s3-region"),
+		CABundle:             cfg.GetString("s3-ca-bundle"),
+		InsecureSkipVerify:   cfg.GetBool("s3-insecure-skip-verify"),
+		BucketLookup:         cfg.GetString("s3-bucket-lookup"),
+	}
+}
+
+// firstNonEmpty lets the standard AWS env vars fill in settings left unset in valpop's config
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Multipart part size limits imposed by S3
+const (
+	MinPartSize = 5 * 1024 * 1024
+	MaxPartSize = 5 * 1024 * 1024 * 1024
+)
+
+// ValidatePartSize checks a --s3-part-size value; 0 selects the client default
+func ValidatePartSize(partSize uint64) error {
+	if partSize == 0 {
+		return nil
+	}
+	if partSize < MinPartSize || partSize > MaxPartSize {
+		return fmt.Errorf("s3-part-size must be between %d and %d bytes, got %d", MinPartSize, MaxPartSize, partSize)
+	}
+	return nil
+}
+
+// ValidateLayout checks a --s3-layout value; empty selects the shared layout
+func ValidateLayout(layout string) error {
+	switch layout {
+	case "", impl.LayoutShared, impl.LayoutRelease:
+		return nil
+	}
+	return fmt.Errorf("unknown s3-layout %q, must be one of: %s, %s", layout, impl.LayoutShared, impl.LayoutRelease)
+}
+
+// ValidateTLS rejects --s3-ca-bundle and --s3-insecure-skip-verify without
+// --s3-secure, where plain HTTP would silently ignore them
+func ValidateTLS(opts Options) error {
+	if opts.Secure {
+		return nil
+	}
+	if opts.CABundle != "" {
+		return fmt.Errorf("s3-ca-bundle needs s3-secure, plain HTTP does not use it")
+	}
+	if opts.InsecureSkipVerify {
+		return fmt.Errorf("s3-insecure-skip-verify needs s3-secure, plain HTTP does not use it")
+	}
+	return nil
+}
+
+// ParseBucketLookup maps a --s3-bucket-lookup value to the minio lookup type
+func ParseBucketLookup(lookup string) (minio.BucketLookupType, error) {
+	switch lookup {
+	case "", "auto":
+		return minio.BucketLookupAuto, nil
+	case "path":
+		return minio.BucketLookupPath, nil
+	case "dns", "virtual-host":
+		return minio.BucketLookupDNS, nil
+	}
+	return minio.BucketLookupAuto, fmt.Errorf("unknown bucket lookup %q, must be one of: auto, path, dns", lookup)
+}
+
+// NewTransport builds the HTTP transport for the S3 client
+// A CA bundle is added on top of the system pool so public endpoints keep working
+// The insecure warning goes to stderr, as stdout may be carrying a popped archive
+func NewTransport(secure bool, caBundle string, insecureSkipVerify bool) (*http.Transport, error) {
+	transport, err := minio.DefaultTransport(secure)
+	if err != nil {
+		return nil, fmt.Errorf("could not create transport: %w", err)
+	}
+
+	if !secure {
+		return transport, nil
+	}
+
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	if caBundle != "" {
+		pem, err := os.ReadFile(caBundle)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA bundle: %w", err)
+		}
+
+		rootCAs := transport.TLSClientConfig.RootCAs
+		if rootCAs == nil {
+			rootCAs, err = x509.SystemCertPool()
+			if err != nil {
+				rootCAs = x509.NewCertPool()
+			}
+		}
+		if !rootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", caBundle)
+		}
+		transport.TLSClientConfig.RootCAs = rootCAs
+	}
+
+	if insecureSkipVerify {
+		fmt.Fprintln(os.Stderr, "WARNING: TLS certificate verification is disabled, do not use this in production")
+		transport.TLSClientConfig.InsecureSkipVerify = true
+	}
+
+	return transport, nil
+}
@@ -0,0 +1,219 @@
+package s3_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	minio "github.com/minio/minio-go/v7"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+
+	"github.com/RedHatInsights/valpop/impl"
+	"github.com/RedHatInsights/valpop/impl/s3"
+)
+
+// writeTestCA writes a self-signed CA certificate to dir and returns its path
+func writeTestCA(dir string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "valpop test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+
+	path := filepath.Join(dir, "ca.pem")
+	Expect(os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)).To(Succeed())
+	return path
+}
+
+var _ = Describe("S3 connection options", func() {
+	Context("ParseBucketLookup", func() {
+		DescribeTable("should map addressing styles",
+			func(value string, expected minio.BucketLookupType) {
+				lookup, err := s3.ParseBucketLookup(value)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(lookup).To(Equal(expected))
+			},
+			Entry("empty defaults to auto", "", minio.BucketLookupAuto),
+			Entry("auto", "auto", minio.BucketLookupAuto),
+			Entry("path style", "path", minio.BucketLookupPath),
+			Entry("virtual-host style", "dns", minio.BucketLookupDNS),
+			Entry("virtual-host alias", "virtual-host", minio.BucketLookupDNS),
+		)
+
+		It("should reject unknown styles", func() {
+			_, err := s3.ParseBucketLookup("subdomain")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(`unknown bucket lookup "subdomain"`))
+		})
+	})
+
+	Context("NewTransport", func() {
+		It("should not configure TLS for plain HTTP", func() {
+			transport, err := s3.NewTransport(false, "", true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(transport.TLSClientConfig).To(BeNil())
+		})
+
+		It("should trust a custom CA bundle", func() {
+			caPath := writeTestCA(GinkgoT().TempDir())
+
+			transport, err := s3.NewTransport(true, caPath, false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(transport.TLSClientConfig.RootCAs).ToNot(BeNil())
+			Expect(transport.TLSClientConfig.InsecureSkipVerify).To(BeFalse())
+		})
+
+		It("should fail on a missing CA bundle", func() {
+			_, err := s3.NewTransport(true, "/nonexistent/ca.pem", false)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("could not read CA bundle"))
+		})
+
+		It("should fail on a CA bundle without certificates", func() {
+			path := filepath.Join(GinkgoT().TempDir(), "empty.pem")
+			Expect(os.WriteFile(path, []byte("not a certificate"), 0600)).To(Succeed())
+
+			_, err := s3.NewTransport(true, path, false)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("no certificates found"))
+		})
+
+		It("should allow skipping verification", func() {
+			transport, err := s3.NewTransport(true, "", true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(transport.TLSClientConfig.InsecureSkipVerify).To(BeTrue())
+		})
+	})
+
+	Context("ValidateTLS", func() {
+		DescribeTable("should reject TLS settings without s3-secure",
+			func(opts s3.Options, message string) {
+				err := s3.ValidateTLS(opts)
+				if message == "" {
+					Expect(err).ToNot(HaveOccurred())
+					return
+				}
+				Expect(err).To(MatchError(ContainSubstring(message)))
+			},
+			Entry("plain HTTP", s3.Options{}, ""),
+			Entry("CA bundle over HTTPS", s3.Options{Secure: true, CABundle: "/etc/pki/ca.pem"}, ""),
+			Entry("skipped verification over HTTPS", s3.Options{Secure: true, InsecureSkipVerify: true}, ""),
+			Entry("CA bundle over plain HTTP", s3.Options{CABundle: "/etc/pki/ca.pem"}, "s3-ca-bundle needs s3-secure"),
+			Entry("skipped verification over plain HTTP", s3.Options{InsecureSkipVerify: true}, "s3-insecure-skip-verify needs s3-secure"),
+		)
+	})
+
+	Context("OptionsFromConfig", func() {
+		It("should read every connection setting", func() {
+			cfg := viper.New()
+			cfg.Set("hostname", "s3.example.com")
+			cfg.Set("port", "443")
+			cfg.Set("bucket", "assets")
+			cfg.Set("s3-secure", true)
+			cfg.Set("s3-region", "us-east-1")
+			cfg.Set("s3-ca-bundle", "/etc/pki/ca.pem")
+			cfg.Set("s3-bucket-lookup", "path")
+			cfg.Set("s3-part-size", 64*1024*1024)
+			cfg.Set("s3-layout", "release")
+			cfg.Set("lock-wait", 30)
+			cfg.Set("lock-lease", 600)
+			cfg.Set("protect", []string{"*.html", "static/entry-*.js"})
+			cfg.Set("cache-rules", []any{map[string]any{"pattern": "*.html", "cache-control": "no-cache"}})
+			cfg.Set("content-type", []string{"map=application/json"})
+			cfg.Set("sniff-content-type", true)
+
+			opts := s3.OptionsFromConfig(cfg)
+			Expect(opts.Addr).To(Equal("s3.example.com:443"))
+			Expect(opts.Bucket).To(Equal("assets"))
+			Expect(opts.Secure).To(BeTrue())
+			Expect(opts.Region).To(Equal("us-east-1"))
+			Expect(opts.CABundle).To(Equal("/etc/pki/ca.pem"))
+			Expect(opts.InsecureSkipVerify).To(BeFalse())
+			Expect(opts.BucketLookup).To(Equal("path"))
+			Expect(opts.PartSize).To(Equal(uint64(64 * 1024 * 1024)))
+			Expect(opts.Layout).To(Equal("release"))
+			Expect(opts.LockWait).To(Equal(30 * time.Second))
+			Expect(opts.LockLease).To(Equal(10 * time.Minute))
+			Expect(opts.Protected).To(Equal([]string{"fed-mods.json", "*.html", "static/entry-*.js"}))
+			Expect(opts.CacheRules).To(Equal([]impl.CacheRule{{Pattern: "*.html", CacheControl: "no-cache"}}))
+			Expect(opts.ContentTypes).To(Equal(impl.ContentTypes{Overrides: map[string]string{".map": "application/json"}, Sniff: true}))
+		})
+	})
+
+	Context("ValidatePartSize", func() {
+		DescribeTable("should check multipart part sizes",
+			func(partSize uint64, valid bool) {
+				err := s3.ValidatePartSize(partSize)
+				if valid {
+					Expect(err).ToNot(HaveOccurred())
+				} else {
+					Expect(err).To(MatchError(ContainSubstring("s3-part-size must be between")))
+				}
+			},
+			Entry("client default", uint64(0), true),
+			Entry("minimum", uint64(s3.MinPartSize), true),
+			Entry("64 MiB", uint64(64*1024*1024), true),
+			Entry("below minimum", uint64(1024), false),
+			Entry("above maximum", uint64(s3.MaxPartSize+1), false),
+		)
+	})
+
+	Context("ValidateLayout", func() {
+		DescribeTable("should check storage layouts",
+			func(layout string, valid bool) {
+				err := s3.ValidateLayout(layout)
+				if valid {
+					Expect(err).ToNot(HaveOccurred())
+				} else {
+					Expect(err).To(MatchError(ContainSubstring("unknown s3-layout")))
+				}
+			},
+			Entry("default", "", true),
+			Entry("shared", "shared", true),
+			Entry("release", "release", true),
+			Entry("unknown", "versioned", false),
+		)
+	})
+
+	Context("NewMinio", func() {
+		It("should reject an invalid bucket lookup before connecting", func() {
+			_, err := s3.NewMinio(s3.Options{Addr: "localhost:9000", BucketLookup: "bogus"})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should reject a part size below the S3 minimum", func() {
+			_, err := s3.NewMinio(s3.Options{Addr: "localhost:9000", Username: "admin", Password: "secret", PartSize: 1024})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should build a client for an HTTPS endpoint", func() {
+			_, err := s3.NewMinio(s3.Options{
+				Addr:         "localhost:9000",
+				Username:     "admin",
+				Password:     "secret",
+				Bucket:       "frontend",
+				Secure:       true,
+				Region:       "us-east-1",
+				BucketLookup: "path",
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+})
@@ -6,74 +6,591 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	impl "github.com/RedHatInsights/valpop/impl"
 	minio "github.com/minio/minio-go/v7"
-	creds "github.com/minio/minio-go/v7/pkg/credentials"
 )
 
+// hashMetadataKey is the user metadata entry holding a data object's SHA-256
+const hashMetadataKey = "sha256"
+
 type Minio struct {
-	ctx    context.Context
-	client S3Client
+	ctx         context.Context
+	client      S3Client
+	bucket      string
+	cachePolicy impl.CachePolicy
+	// contentTypes resolves the Content-Type of populated files
+	contentTypes impl.ContentTypes
+	// partSize is the multipart chunk size; 0 leaves it to the client
+	partSize uint64
+	// layout is where new releases are written, impl.LayoutShared or impl.LayoutRelease
+	layout string
+	// lockOwner identifies this process in populate locks, held for lockLease
+	// after waiting up to lockWait for another owner
+	lockOwner string
+	lockLease time.Duration
+	lockWait  time.Duration
+	// locks are the populate locks this process holds, by prefix
+	locks map[string]*heldLock
+	// protected are the glob patterns of shared data files cleanup never deletes
+	protected []string
+	// out receives progress messages
+	out io.Writer
+}
+
+// Compile-time check that Minio satisfies the shared interfaces
+var _ S3Service = (*Minio)(nil)
+
+func init() {
+	impl.Register(impl.Factory{
+		Name:        "s3",
+		Description: "S3 compatible object storage (MinIO, AWS S3, ...)",
+		Flags:       RegisterFlags,
+		Validate: func(cfg impl.Config) error {
+			opts := OptionsFromConfig(cfg)
+			err := ValidatePartSize(opts.PartSize)
+			if err != nil {
+				return err
+			}
+			err = ValidateLayout(opts.Layout)
+			if err != nil {
+				return err
+			}
+			err = ValidateTLS(opts)
+			if err != nil {
+				return err
+			}
+			err = impl.ValidateProtected(opts.Protected)
+			if err != nil {
+				return err
+			}
+			_, err = impl.CacheRulesFromConfig(cfg)
+			if err != nil {
+				return err
+			}
+			_, err = impl.ContentTypesFromConfig(cfg)
+			if err != nil {
+				return err
+			}
+			return ValidateCredentials(opts)
+		},
+		New: func(cfg impl.Config) (impl.Backend, error) {
+			client, err := NewMinio(OptionsFromConfig(cfg))
+			if err != nil {
+				return nil, err
+			}
+			return &client, nil
+		},
+	})
 }
 
 // NewMinio creates a new Minio instance with a real MinIO client
-func NewMinio(addr, username, password string) (Minio, error) {
-	client, err := minio.New(addr, &minio.Options{
-		Creds:  creds.NewStaticV4(username, password, ""),
-		Secure: false, // Change to `true` if using HTTPS
+func NewMinio(opts Options) (Minio, error) {
+	err := ValidatePartSize(opts.PartSize)
+	if err != nil {
+		return Minio{}, err
+	}
+	err = ValidateLayout(opts.Layout)
+	if err != nil {
+		return Minio{}, err
+	}
+	err = ValidateTLS(opts)
+	if err != nil {
+		return Minio{}, err
+	}
+	err = impl.ValidateProtected(opts.Protected)
+	if err != nil {
+		return Minio{}, err
+	}
+	err = impl.ValidateCacheRules(opts.CacheRules)
+	if err != nil {
+		return Minio{}, err
+	}
+
+	bucketLookup, err := ParseBucketLookup(opts.BucketLookup)
+	if err != nil {
+		return Minio{}, err
+	}
+
+	transport, err := NewTransport(opts.Secure, opts.CABundle, opts.InsecureSkipVerify)
+	if err != nil {
+		return Minio{}, err
+	}
+
+	credentials, err := NewCredentials(opts)
+	if err != nil {
+		return Minio{}, err
+	}
+
+	client, err := minio.New(opts.Addr, &minio.Options{
+		Creds:        credentials,
+		Secure:       opts.Secure,
+		Transport:    transport,
+		Region:       opts.Region,
+		BucketLookup: bucketLookup,
 	})
 	if err != nil {
 		return Minio{}, fmt.Errorf("failed to create S3 client: %w", err)
 	}
-	return NewMinioWithClient(client), nil
+	m := NewMinioWithClient(client, opts.Bucket, opts.CacheMaxAge)
+	m.partSize = opts.PartSize
+	m.cachePolicy = impl.NewCachePolicy(opts.CacheRules, opts.CacheMaxAge)
+	m.contentTypes = opts.ContentTypes
+	if opts.Layout != "" {
+		m.layout = opts.Layout
+	}
+	if opts.LockLease > 0 {
+		m.lockLease = opts.LockLease
+	}
+	m.lockWait = opts.LockWait
+	if len(opts.Protected) > 0 {
+		m.protected = opts.Protected
+	}
+	return m, nil
 }
 
 // NewMinioWithClient creates a new Minio instance with a custom S3Client
 // This allows for dependency injection of mock clients for testing
-func NewMinioWithClient(client S3Client) Minio {
+func NewMinioWithClient(client S3Client, bucket string, cacheMaxAge int64) Minio {
 	return Minio{
-		ctx:    context.Background(),
-		client: client,
+		ctx:         context.Background(),
+		client:      client,
+		bucket:      bucket,
+		cachePolicy: impl.NewCachePolicy(nil, cacheMaxAge),
+		layout:      impl.LayoutShared,
+		lockOwner:   impl.NewLockOwner(),
+		lockLease:   impl.DefaultLockLease,
+		locks:       map[string]*heldLock{},
+		protected:   impl.DefaultProtectedFiles,
+		out:         os.Stdout,
 	}
 }
 
+// SetOutput sends progress messages to w instead of stdout
+func (m *Minio) SetOutput(w io.Writer) {
+	m.out = w
+}
+
 func (m *Minio) Close() {
 }
 
+// StartPopulate takes the populate lock of namespace, so concurrent populates of
+// the same prefix run one after another
 func (m *Minio) StartPopulate(namespace, bucket string, timestamp int64) error {
-	return nil
+	return m.acquireLock(namespace)
 }
 
+// EndPopulate releases the populate lock of namespace
 func (m *Minio) EndPopulate(namespace, bucket string, timestamp int64) error {
-	return nil
+	return m.releaseLock(namespace)
 }
 
-func (m *Minio) SetItem(namespace, filepath, contentType, bucket string, timestamp int64, contents string, cacheMaxAge int64) error {
-	key := impl.MakeDataKey(namespace, filepath)
-	content_len := len(contents)
-
-	fmt.Printf("Uploading: %s: %s (%d)\n", filepath, key, content_len)
+// setCurrent makes the release at timestamp the one being served. In the
+// release layout it swaps the current pointer, a single PUT that readers see
+// either before or after; the shared layout removes any stale pointer left by
+// an earlier release layout
+func (m *Minio) setCurrent(namespace, bucket string, timestamp int64) error {
+	key := impl.MakeCurrentKey(namespace)
+	if m.layout != impl.LayoutRelease {
+		err := m.client.RemoveObject(m.ctx, bucket, key, minio.RemoveObjectOptions{})
+		if err != nil {
+			return fmt.Errorf("unable to remove object: %w", err)
+		}
+		return nil
+	}
 
-	cacheControl := getCacheControl(filepath, cacheMaxAge)
-	_, err := m.client.PutObject(m.ctx, bucket, key, bytes.NewReader([]byte(contents)), int64(content_len), minio.PutObjectOptions{
-		ContentType:  contentType,
-		CacheControl: cacheControl,
+	pointer := strconv.FormatInt(timestamp, 10)
+	_, err := m.client.PutObject(m.ctx, bucket, key, strings.NewReader(pointer), int64(len(pointer)), minio.PutObjectOptions{
+		ContentType:  "text/plain; charset=utf-8",
+		CacheControl: "no-cache",
 	})
 	if err != nil {
 		return fmt.Errorf("err from s3:%w", err)
 	}
+	fmt.Fprintf(m.out, "%s -> %d\n", key, timestamp)
 	return nil
 }
 
+// currentRelease reads the timestamp the current pointer of namespace refers to
+func (m *Minio) currentRelease(namespace string) (int64, bool, error) {
+	obj, err := m.client.GetObject(m.ctx, m.bucket, impl.MakeCurrentKey(namespace), minio.GetObjectOptions{})
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("err from s3:%w", err)
+	}
+	defer obj.Close()
+
+	// minio only reports a missing object once it is read
+	raw, err := io.ReadAll(obj)
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("could not read object: %w", err)
+	}
+	timestamp, err := strconv.ParseInt(strings.TrimSpace(string(raw)), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid current pointer for %s: %w", namespace, err)
+	}
+	return timestamp, true, nil
+}
+
+// dataKey returns the key new data for filepath is written to, following the
+// configured layout
+func (m *Minio) dataKey(namespace, filepath string, timestamp int64) string {
+	if m.layout == impl.LayoutRelease {
+		return impl.MakeReleaseDataKey(namespace, timestamp, filepath)
+	}
+	return impl.MakeDataKey(namespace, filepath)
+}
+
+func (m *Minio) SetItem(namespace, filepath, contentType, bucket string, timestamp int64, contents string) error {
+	return m.PutItem(namespace, filepath, contentType, bucket, timestamp, strings.NewReader(contents), int64(len(contents)))
+}
+
+// PutItem streams size bytes from r into the data object for filepath
+// Objects larger than the part size are sent as a multipart upload
+func (m *Minio) PutItem(namespace, filepath, contentType, bucket string, timestamp int64, r io.Reader, size int64) error {
+	_, err := m.putItem(m.ctx, namespace, bucket, timestamp, impl.FileInfo{Path: filepath, ContentType: contentType, Size: size, Reader: r})
+	return err
+}
+
+// putItem uploads a data object, recording its SHA-256 in the metadata when known
+// Precompressed variants get the Content-Encoding and Cache-Control of their file
+// It returns the new object version, which is empty unless the bucket is versioned
+func (m *Minio) putItem(ctx context.Context, namespace, bucket string, timestamp int64, file impl.FileInfo) (string, error) {
+	key := m.dataKey(namespace, file.Path, timestamp)
+
+	fmt.Fprintf(m.out, "Uploading: %s: %s (%d)\n", file.Path, key, file.Size)
+
+	opts := minio.PutObjectOptions{
+		ContentType:     file.ContentType,
+		ContentEncoding: file.ContentEncoding,
+		CacheControl:    m.cachePolicy.CacheControl(impl.SourcePath(file.Path, file.ContentEncoding)),
+		PartSize:        m.partSize,
+	}
+	if file.SHA256 != "" {
+		opts.UserMetadata = map[string]string{hashMetadataKey: file.SHA256}
+	}
+
+	info, err := m.client.PutObject(ctx, bucket, key, file.Reader, file.Size, opts)
+	if err != nil {
+		return "", fmt.Errorf("err from s3:%w", err)
+	}
+	return info.VersionID, nil
+}
+
+// GetItem returns the contents of a data object from the configured bucket
+// In the shared layout data keys are shared across releases, so timestamp is
+// only part of the lookup in the release layout
+func (m *Minio) GetItem(namespace, filepath string, timestamp int64) (string, error) {
+	obj, err := m.client.GetObject(m.ctx, m.bucket, m.dataKey(namespace, filepath, timestamp), minio.GetObjectOptions{})
+	if err != nil {
+		return "", fmt.Errorf("err from s3:%w", err)
+	}
+	defer obj.Close()
+
+	contents, err := io.ReadAll(obj)
+	if err != nil {
+		return "", fmt.Errorf("could not read object: %w", err)
+	}
+	return string(contents), nil
+}
+
+// DelKeys removes the data objects for every file in allItems from the configured bucket
+// In the release layout each listed timestamp has its own object
+func (m *Minio) DelKeys(allItems impl.AllItems) error {
+	for namespace, items := range allItems {
+		for filepath, timestamps := range items {
+			keys := []string{impl.MakeDataKey(namespace, filepath)}
+			if m.layout == impl.LayoutRelease {
+				keys = []string{}
+				for _, timestamp := range timestamps {
+					keys = append(keys, impl.MakeReleaseDataKey(namespace, timestamp, filepath))
+				}
+			}
+
+			for _, key := range keys {
+				err := m.client.RemoveObject(m.ctx, m.bucket, key, minio.RemoveObjectOptions{})
+				if err != nil {
+					return fmt.Errorf("unable to remove object: %w", err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// PopulateFromDir uploads every file under basepath as a data object
+// No manifest is written; use PopulateFn for a full release
+func (m *Minio) PopulateFromDir(namespace, bucket, basepath string, timestamp int64) error {
+	_, _, _, err := m.populateFromDir(namespace, bucket, os.DirFS(basepath), timestamp, 1, impl.Manifest{}, impl.PrecompressOptions{})
+	return err
+}
+
+// populateFromDir uploads every file of fileSystem using up to concurrency
+// parallel uploads, then the variants precompress selects; the returned files
+// keep the walk order, followed by the variants
+// Files whose hash matches the previous release, and whose stored object still
+// carries that hash and the Cache-Control the policy picks, are not uploaded
+// again: the shared layout keeps the object, the release layout copies it
+// server-side into the new release. versions maps each file to the object
+// version holding its content, for versioned buckets
+func (m *Minio) populateFromDir(namespace, bucket string, fileSystem fs.FS, timestamp int64, concurrency int, previous impl.Manifest, precompress impl.PrecompressOptions) (files []impl.FileInfo, versions map[string]string, stats impl.UploadStats, err error) {
+	ctx := m.lockContext(namespace)
+	previousEntries := entriesByPath(previous)
+	versions = map[string]string{}
+	var mu sync.Mutex
+	record := func(path, versionID string) {
+		mu.Lock()
+		versions[path] = versionID
+		mu.Unlock()
+	}
+
+	upload := func(file impl.FileInfo) error {
+		// A lost lock stops the upload, another populate may own the prefix now
+		if err := context.Cause(ctx); err != nil {
+			return err
+		}
+		fmt.Fprintf(m.out, "Finding file: %s\n", file.Path)
+		if source, stored, ok := m.reusableObject(namespace, bucket, file, previous, previousEntries); ok {
+			key := m.dataKey(namespace, file.Path, timestamp)
+			if source == key {
+				fmt.Fprintf(m.out, "Unchanged: %s\n", file.Path)
+				record(file.Path, stored.VersionID)
+				return impl.ErrUnchanged
+			}
+
+			copied, err := m.client.CopyObject(ctx, minio.CopyDestOptions{Bucket: bucket, Object: key}, minio.CopySrcOptions{Bucket: bucket, Object: source})
+			if err == nil {
+				fmt.Fprintf(m.out, "Unchanged, copied: %s\n", file.Path)
+				record(file.Path, copied.VersionID)
+				return impl.ErrUnchanged
+			}
+		}
+
+		versionID, err := m.putItem(ctx, namespace, bucket, timestamp, file)
+		if err != nil {
+			return err
+		}
+		record(file.Path, versionID)
+		return nil
+	}
+
+	// Use common business logic to walk filesystem and collect files
+	files, stats, err = impl.ProcessFilesWithTypes(fileSystem, concurrency, m.contentTypes, upload)
+	if err != nil || len(precompress.Encodings) == 0 {
+		return files, versions, stats, err
+	}
+	variants, variantStats, err := impl.ProcessVariants(fileSystem, files, precompress, concurrency, upload)
+	return append(files, variants...), versions, stats.Add(variantStats), err
+}
+
+// reusableObject returns the key and info of the previous release's object for
+// file when its content is unchanged, so it can be kept or copied instead of
+// uploaded again
+func (m *Minio) reusableObject(namespace, bucket string, file impl.FileInfo, previous impl.Manifest, previousEntries map[string]impl.FileEntry) (string, minio.ObjectInfo, bool) {
+	if previousEntries[file.Path].SHA256 != file.SHA256 {
+		return "", minio.ObjectInfo{}, false
+	}
+	source := previous.DataKey(namespace, file.Path)
+	stored, err := m.statObject(bucket, source)
+	if err != nil || metadataHash(stored) != file.SHA256 {
+		return "", minio.ObjectInfo{}, false
+	}
+	// A changed cache rule or content type needs the object written again with
+	// the new header
+	if stored.Metadata.Get("Cache-Control") != m.cachePolicy.CacheControl(impl.SourcePath(file.Path, file.ContentEncoding)) {
+		return "", minio.ObjectInfo{}, false
+	}
+	if stored.ContentType != file.ContentType {
+		return "", minio.ObjectInfo{}, false
+	}
+	return source, stored, true
+}
+
+// entriesByPath indexes the entries of manifest by their path
+func entriesByPath(manifest impl.Manifest) map[string]impl.FileEntry {
+	entries := make(map[string]impl.FileEntry, len(manifest.Entries))
+	for _, entry := range manifest.Entries {
+		entries[entry.Path] = entry
+	}
+	return entries
+}
+
+// statObject returns the stored object info of key
+// An object uploaded by an interrupted populate may not match the previous
+// manifest, so skipping relies on the hash recorded on the object itself
+func (m *Minio) statObject(bucket, key string) (minio.ObjectInfo, error) {
+	return m.client.StatObject(m.ctx, bucket, key, minio.StatObjectOptions{})
+}
+
+// metadataHash returns the SHA-256 recorded in an object's user metadata
+func metadataHash(info minio.ObjectInfo) string {
+	return metadataValue(info, hashMetadataKey)
+}
+
+// metadataValue returns the user metadata entry key of an object
+func metadataValue(info minio.ObjectInfo, key string) string {
+	for name, value := range info.UserMetadata {
+		// Servers return the metadata key canonicalised, e.g. "Sha256"
+		if strings.EqualFold(name, key) {
+			return value
+		}
+	}
+	return ""
+}
+
+// Verify checks every file of the manifest at timestamp, or of the newest
+// manifest when timestamp is 0, against the stored data objects
+// Objects without a recorded hash are downloaded and hashed when the manifest has one
+func (m *Minio) Verify(prefix string, timestamp int64) (impl.VerifyReport, error) {
+	manifest, err := m.loadManifest(prefix, timestamp)
+	if err != nil {
+		return impl.VerifyReport{}, fmt.Errorf("could not get manifest for %s: %w", prefix, err)
+	}
+	return m.verifyManifest(prefix, manifest)
+}
+
+func (m *Minio) verifyManifest(prefix string, manifest impl.Manifest) (impl.VerifyReport, error) {
+	return impl.VerifyManifest(prefix, manifest, func(entry impl.FileEntry) (impl.StoredObject, bool, error) {
+		key := manifest.DataKey(prefix, entry.Path)
+		info, err := m.statObject(m.bucket, key)
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return impl.StoredObject{}, false, nil
+		}
+		if err != nil {
+			return impl.StoredObject{}, false, fmt.Errorf("err from s3:%w", err)
+		}
+
+		stored := impl.StoredObject{Size: info.Size, SHA256: metadataHash(info)}
+		if stored.SHA256 == "" && entry.SHA256 != "" {
+			obj, err := m.client.GetObject(m.ctx, m.bucket, key, minio.GetObjectOptions{})
+			if err != nil {
+				return impl.StoredObject{}, false, fmt.Errorf("err from s3:%w", err)
+			}
+			defer obj.Close()
+
+			stored.SHA256, err = impl.HashContent(obj)
+			if err != nil {
+				return impl.StoredObject{}, false, fmt.Errorf("could not read object: %w", err)
+			}
+		}
+		return stored, true, nil
+	})
+}
+
+// Pop returns the files of the manifest stored at timestamp, or of the newest
+// manifest when timestamp is 0
+func (m *Minio) Pop(namespace string, timestamp int64) (impl.AllItems, error) {
+	manifest, err := m.loadManifest(namespace, timestamp)
+	if err != nil {
+		return impl.AllItems{}, err
+	}
+
+	items := impl.Items{}
+	for _, file := range manifest.Files {
+		items[file] = []int64{manifest.Timestamp}
+	}
+	return impl.AllItems{namespace: items}, nil
+}
+
+// manifestTimestamps lists the manifest keys under listPrefix, grouped by prefix
+func (m *Minio) manifestTimestamps(listPrefix string) (map[string][]int64, error) {
+	stamps := map[string][]int64{}
+	for object := range m.client.ListObjects(m.ctx, m.bucket, minio.ListObjectsOptions{Prefix: listPrefix, Recursive: true}) {
+		if object.Err != nil {
+			return nil, fmt.Errorf("err from s3:%w", object.Err)
+		}
+		prefix, timestamp, ok := impl.ParseManifestKey(object.Key)
+		if !ok {
+			continue
+		}
+		stamps[prefix] = append(stamps[prefix], timestamp)
+	}
+	return stamps, nil
+}
+
+// Prefixes returns every prefix with at least one manifest in the bucket
+func (m *Minio) Prefixes() ([]string, error) {
+	stamps, err := m.manifestTimestamps("manifests/")
+	if err != nil {
+		return nil, err
+	}
+
+	prefixes := []string{}
+	for prefix := range stamps {
+		prefixes = append(prefixes, prefix)
+	}
+	slices.Sort(prefixes)
+	return prefixes, nil
+}
+
+// Manifests reads every manifest stored for prefix
+func (m *Minio) Manifests(prefix string) ([]impl.Manifest, error) {
+	stamps, err := m.manifestTimestamps("manifests/" + prefix + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := []impl.Manifest{}
+	// Only exact matches; a prefix of "app" must not pick up "app/admin"
+	for _, timestamp := range stamps[prefix] {
+		manifest, err := m.loadManifest(prefix, timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("could not get manifest %d: %w", timestamp, err)
+		}
+		manifests = append(manifests, manifest)
+	}
+	return manifests, nil
+}
+
+// Current returns the release the current pointer of prefix refers to, 0 when
+// there is none, as in the shared layout
+func (m *Minio) Current(prefix string) (int64, error) {
+	current, _, err := m.currentRelease(prefix)
+	return current, err
+}
+
+// loadManifest reads the manifest stored at timestamp. A timestamp of 0 selects
+// the release the current pointer refers to, or the newest manifest when there
+// is no pointer
+func (m *Minio) loadManifest(namespace string, timestamp int64) (impl.Manifest, error) {
+	if timestamp == 0 {
+		current, found, err := m.currentRelease(namespace)
+		if err != nil {
+			return impl.Manifest{}, err
+		}
+		if !found {
+			return m.getLatestManifest(namespace, m.bucket)
+		}
+		timestamp = current
+	}
+
+	manifest, err := m.getManifest(impl.MakeManifestKey(namespace, timestamp), m.bucket)
+	if err != nil {
+		return impl.Manifest{}, err
+	}
+	// Legacy manifests do not record their own timestamp
+	if manifest.Timestamp == 0 {
+		manifest.Timestamp = timestamp
+	}
+	return manifest, nil
+}
+
 func (m *Minio) SetManifest(namespace, bucket string, timestamp int64, manifest impl.Manifest) error {
 	key := impl.MakeManifestKey(namespace, timestamp)
 
-	fmt.Printf("manifest %s: %d files, image: %s, timestamp: %d\n", key, len(manifest.Files), manifest.Image, manifest.Timestamp)
+	fmt.Fprintf(m.out, "manifest %s: %d files, image: %s, timestamp: %d\n", key, len(manifest.Files), manifest.Image, manifest.Timestamp)
 	raw, err := json.Marshal(manifest)
 	if err != nil {
 		return fmt.Errorf("could not encode manifest:%w", err)
@@ -86,68 +603,277 @@ func (m *Minio) SetManifest(namespace, bucket string, timestamp int64, manifest
 	return nil
 }
 
+// Rollback restores the data objects of target and records them as a new
+// release at timestamp, in the configured layout. In the shared layout objects
+// still holding the target content are kept, others are copied back from the
+// object version recorded in the manifest, which needs a versioned bucket.
+// Otherwise the target objects are copied under the new release. Every file is
+// checked before anything is copied, so an unrestorable release leaves the
+// bucket untouched
+func (m *Minio) Rollback(prefix string, target impl.Manifest, timestamp int64) (_ impl.Manifest, err error) {
+	err = m.StartPopulate(prefix, m.bucket, timestamp)
+	if err != nil {
+		return impl.Manifest{}, err
+	}
+	defer func() {
+		endErr := m.EndPopulate(prefix, m.bucket, timestamp)
+		if err == nil {
+			err = endErr
+		}
+	}()
+
+	restored := target
+	restored.Timestamp = timestamp
+	restored.RolledBackFrom = target.Timestamp
+	restored.Layout = ""
+	if m.layout == impl.LayoutRelease {
+		restored.Layout = impl.LayoutRelease
+	}
+	restored.Entries = make([]impl.FileEntry, len(target.Entries))
+
+	sources := map[int]minio.CopySrcOptions{}
+	for i, entry := range target.Entries {
+		restored.Entries[i] = entry
+		source, key := target.DataKey(prefix, entry.Path), restored.DataKey(prefix, entry.Path)
+
+		info, err := m.statObject(m.bucket, source)
+		if err != nil && minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			return impl.Manifest{}, fmt.Errorf("err from s3:%w", err)
+		}
+		unchanged := err == nil && entry.SHA256 != "" && metadataHash(info) == entry.SHA256
+		switch {
+		case unchanged && source == key:
+			restored.Entries[i].VersionID = info.VersionID
+		case source != key && err == nil && (entry.SHA256 == "" || unchanged):
+			// Release layout objects are never overwritten
+			sources[i] = minio.CopySrcOptions{Bucket: m.bucket, Object: source}
+		case entry.VersionID != "":
+			sources[i] = minio.CopySrcOptions{Bucket: m.bucket, Object: source, VersionID: entry.VersionID}
+		case entry.SHA256 == "":
+			// Manifests written before hashes were recorded cannot tell an
+			// unchanged shared object from an overwritten one
+			return impl.Manifest{}, fmt.Errorf("cannot restore %s: release %d records no content hash, so its shared object cannot be checked for changes", entry.Path, target.Timestamp)
+		default:
+			return impl.Manifest{}, fmt.Errorf("cannot restore %s: it has changed since release %d and no object version was recorded, bucket versioning is required", entry.Path, target.Timestamp)
+		}
+	}
+
+	for i, source := range sources {
+		entry := restored.Entries[i]
+		info, err := m.client.CopyObject(m.ctx,
+			minio.CopyDestOptions{Bucket: m.bucket, Object: restored.DataKey(prefix, entry.Path)},
+			source,
+		)
+		if err != nil {
+			return impl.Manifest{}, fmt.Errorf("could not restore %s: %w", entry.Path, err)
+		}
+		restored.Entries[i].VersionID = info.VersionID
+		fmt.Fprintf(m.out, "Restored: %s\n", entry.Path)
+	}
+
+	err = m.checkLock(prefix)
+	if err != nil {
+		return impl.Manifest{}, err
+	}
+	err = m.SetManifest(prefix, m.bucket, timestamp, restored)
+	if err != nil {
+		return impl.Manifest{}, err
+	}
+	err = m.checkLock(prefix)
+	if err != nil {
+		return impl.Manifest{}, err
+	}
+	err = m.setCurrent(prefix, m.bucket, timestamp)
+	if err != nil {
+		return impl.Manifest{}, err
+	}
+	return restored, nil
+}
+
+// PopulateFn uploads opts.Source as a new release of opts.Prefix. The populate
+// lock is held from before the duplicate image check until cleanup has run, so a
+// concurrent populate of the same image waits and then skips
+func (m *Minio) PopulateFn(opts impl.PopulateOptions) (err error) {
+	bucket, prefix, image := m.bucket, opts.Prefix, opts.Image
 
-func (m *Minio) PopulateFn(addr, bucket, source, prefix, image, valpopImage string, timeout int64, minAssetRecords int64, cacheMaxAge int64) error {
+	err = m.StartPopulate(prefix, bucket, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		endErr := m.EndPopulate(prefix, bucket, 0)
+		if err == nil {
+			err = endErr
+		}
+	}()
+	// Taken once the lock is held so releases are ordered like their populates
 	currentTime := time.Now().Unix()
 
 	// Check if latest manifest has the same image to avoid duplicate uploads
-	latestManifest, err := m.getLatestManifest(prefix, bucket)
+	latestManifest, err := m.loadManifest(prefix, 0)
 	if err == nil && latestManifest.Image != "" && latestManifest.Image == image {
-		fmt.Printf("Skipping upload: image %s already exists in latest manifest\n", image)
+		fmt.Fprintf(m.out, "Skipping upload: image %s already exists in latest manifest\n", image)
 		return nil
 	}
 
-	fileSystem := os.DirFS(source)
-	m.StartPopulate(prefix, bucket, currentTime)
-
-	// Use common business logic to walk filesystem and collect files
-	fileList, err := impl.BuildPopulateManifest(fileSystem, func(file impl.FileInfo) error {
-		fmt.Printf("Finding file: %s\n", file.Path)
-		return m.SetItem(prefix, file.Path, file.ContentType, bucket, currentTime, file.Content, cacheMaxAge)
-	})
+	files, versions, stats, err := m.populateFromDir(prefix, bucket, impl.FilterFS(opts.SourceFS(), opts.Filter), currentTime, opts.Concurrency, latestManifest, opts.Precompress)
 	if err != nil {
-		fmt.Printf("%v", err)
+		fmt.Fprintf(m.out, "%v", err)
 		return err
 	}
+	fmt.Fprintln(m.out, stats)
 
-	manifest := impl.Manifest{
-		Files:       fileList,
-		Image:       image,
-		ValpopImage: valpopImage,
-		Timestamp:   currentTime,
+	manifest := impl.NewManifest(files, image, opts.ValpopImage, currentTime, nil)
+	for i := range manifest.Entries {
+		rule, _ := m.cachePolicy.Match(impl.SourcePath(manifest.Entries[i].Path, manifest.Entries[i].ContentEncoding))
+		manifest.Entries[i].CacheControl = rule.CacheControl
+		manifest.Entries[i].CacheRule = rule.Pattern
+		manifest.Entries[i].VersionID = versions[manifest.Entries[i].Path]
+	}
+	if m.layout == impl.LayoutRelease {
+		manifest.Layout = impl.LayoutRelease
 	}
 
+	// Nothing is published or removed once the lock is lost
+	err = m.checkLock(prefix)
+	if err != nil {
+		return err
+	}
 	err = m.SetManifest(prefix, bucket, currentTime, manifest)
 	if err != nil {
 		return err
 	}
 
-	err = m.EndPopulate(prefix, bucket, currentTime)
+	err = m.checkLock(prefix)
+	if err != nil {
+		return err
+	}
+	err = m.setCurrent(prefix, bucket, currentTime)
+	if err != nil {
+		return err
+	}
+
+	err = m.checkLock(prefix)
 	if err != nil {
 		return err
 	}
+	return m.CleanupCache(prefix, bucket, opts.Timeout, opts.MinAssetRecords)
+}
 
-	return m.CleanupCache(prefix, bucket, timeout, minAssetRecords)
+// PopFn copies every file listed in the newest manifest for prefix into dest
+func (m *Minio) PopFn(prefix, dest string) error {
+	return m.PopTo(prefix, impl.DirTarget(dest))
 }
 
+// PopTo hands every file listed in the newest manifest for prefix to target,
+// in manifest order
+func (m *Minio) PopTo(prefix string, target impl.PopTarget) error {
+	fmt.Fprintln(m.out, "Invoking pop...")
+	bucket := m.bucket
+
+	manifest, err := m.loadManifest(prefix, 0)
+	if err != nil {
+		return fmt.Errorf("could not get latest manifest for %s: %w", prefix, err)
+	}
+
+	fmt.Fprintf(m.out, "Popping %d files, image: %s, timestamp: %d\n", len(manifest.Files), manifest.Image, manifest.Timestamp)
+	for _, file := range manifest.Files {
+		key := manifest.DataKey(prefix, file)
+		obj, err := m.client.GetObject(m.ctx, bucket, key, minio.GetObjectOptions{})
+		if err != nil {
+			return fmt.Errorf("err from s3:%w", err)
+		}
+
+		info, err := obj.Stat()
+		if err != nil {
+			obj.Close()
+			return fmt.Errorf("err from s3:%w", err)
+		}
+		err = target.WriteFile(impl.PoppedFile{Path: file, Size: info.Size, Timestamp: manifest.Timestamp}, obj)
+		obj.Close()
+		if err != nil {
+			return fmt.Errorf("could not pop %s: %w", key, err)
+		}
+		fmt.Fprintf(m.out, "Popped: %s\n", file)
+	}
+	return nil
+}
+
+// CleanupCache removes the releases of prefix that the retention policy expires
+// Shared layout files are only removed once no kept shared release lists them
+// and never when they match a protected pattern; release layout releases are
+// removed with everything under their own keys.
+// The release the current pointer refers to is always kept
 func (m *Minio) CleanupCache(prefix, bucket string, timeout int64, minAssetRecords int64) error {
-	currentTime := time.Now().Unix()
-	bucketPrefix := "manifests/" + prefix + "/"
+	current, _, err := m.currentRelease(prefix)
+	if err != nil {
+		return err
+	}
+	allManifests, layouts, err := m.listManifests(prefix, bucket)
+	if err != nil {
+		return err
+	}
 
-	// Collect all manifests with their timestamps
+	dataKeys, manifestKeys, err := m.cleanupKeys(prefix, bucket, allManifests, layouts, current, time.Now().Unix(), timeout, minAssetRecords)
+	if err != nil {
+		return err
+	}
+
+	// Old files include objects a failed populate left behind
+	return m.removeKeys(prefix, bucket, manifestKeys, dataKeys)
+}
+
+// removeKeys deletes manifestKeys and then dataKeys of prefix. Manifests go
+// first so a failure never leaves a manifest without its files, only
+// unreferenced data that the next run removes as orphans. It stops when the
+// lock of prefix is lost
+func (m *Minio) removeKeys(prefix, bucket string, manifestKeys, dataKeys []string) error {
+	ctx := m.lockContext(prefix)
+	remove := func(key string) error {
+		if err := context.Cause(ctx); err != nil {
+			return err
+		}
+		err := m.client.RemoveObject(ctx, bucket, key, minio.RemoveObjectOptions{})
+		if err != nil {
+			return fmt.Errorf("unable to remove object: %w", err)
+		}
+		return nil
+	}
+
+	for _, key := range manifestKeys {
+		err := remove(key)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(m.out, "Removed manifest %s\n", key)
+	}
+	for _, key := range dataKeys {
+		err := remove(key)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(m.out, "Removed file %s\n", key)
+	}
+	return nil
+}
+
+// listManifests returns every manifest of prefix with the files it lists, and
+// the layout each was written in
+func (m *Minio) listManifests(prefix, bucket string) ([]impl.ManifestInfo, map[int64]string, error) {
 	allManifests := []impl.ManifestInfo{}
+	layouts := map[int64]string{}
 
-	for object := range m.client.ListObjects(m.ctx, bucket, minio.ListObjectsOptions{Prefix: bucketPrefix, Recursive: true}) {
+	for object := range m.client.ListObjects(m.ctx, bucket, minio.ListObjectsOptions{Prefix: "manifests/" + prefix + "/", Recursive: true}) {
 		timestampString, _ := strings.CutPrefix(object.Key, "manifests/"+prefix+"/")
 		timestamp, err := strconv.Atoi(timestampString)
 		if err != nil {
-			return fmt.Errorf("could not get timestamp: %w", err)
+			return nil, nil, fmt.Errorf("could not get timestamp: %w", err)
 		}
 
 		// Get manifest contents
 		manifestData, err := m.getManifest(object.Key, bucket)
 		if err != nil {
-			return fmt.Errorf("could not get manifest: %w", err)
+			return nil, nil, fmt.Errorf("could not get manifest: %w", err)
 		}
 
 		allManifests = append(allManifests, impl.ManifestInfo{
@@ -155,48 +881,282 @@ func (m *Minio) CleanupCache(prefix, bucket string, timeout int64, minAssetRecor
 			Timestamp: int64(timestamp),
 			Files:     manifestData.Files,
 		})
+		layouts[int64(timestamp)] = manifestData.Layout
 	}
+	return allManifests, layouts, nil
+}
 
+// cleanupKeys returns the data keys and manifest keys the retention policy
+// expires at currentTime, in the order CleanupCache removes them. current is the
+// release the current pointer refers to, 0 when there is none
+func (m *Minio) cleanupKeys(prefix, bucket string, allManifests []impl.ManifestInfo, layouts map[int64]string, current, currentTime, timeout, minAssetRecords int64) (dataKeys, manifestKeys []string, err error) {
 	// Use common logic to determine what to delete
 	toDelete, toKeep := impl.SeparateManifests(allManifests, currentTime, timeout, minAssetRecords)
 
-	// Determine which files to delete
-	filesToDelete := impl.DetermineFilesToDelete(toDelete, toKeep, []string{"fed-mods.json"})
+	sharedDelete, sharedKeep, releaseDelete := []impl.ManifestInfo{}, []impl.ManifestInfo{}, []impl.ManifestInfo{}
+	for _, manifest := range toDelete {
+		switch {
+		case current != 0 && manifest.Timestamp == current:
+			toKeep = append(toKeep, manifest)
+		case layouts[manifest.Timestamp] == impl.LayoutRelease:
+			releaseDelete = append(releaseDelete, manifest)
+		default:
+			sharedDelete = append(sharedDelete, manifest)
+		}
+	}
+	for _, manifest := range toKeep {
+		if layouts[manifest.Timestamp] != impl.LayoutRelease {
+			sharedKeep = append(sharedKeep, manifest)
+		}
+	}
 
-	// Remove old files
+	// Determine which files to delete
+	filesToDelete := impl.DetermineFilesToDelete(sharedDelete, sharedKeep, m.protected)
+	slices.Sort(filesToDelete)
+	dataKeys = []string{}
 	for _, file := range filesToDelete {
-		err := m.client.RemoveObject(m.ctx, bucket, impl.MakeDataKey(prefix, file), minio.RemoveObjectOptions{})
+		dataKeys = append(dataKeys, impl.MakeDataKey(prefix, file))
+	}
+
+	// Old releases are removed with every object under their keys, including
+	// objects a failed populate left behind
+	for _, manifest := range releaseDelete {
+		releasePrefix := fmt.Sprintf("releases/%s/%d/", prefix, manifest.Timestamp)
+		for object := range m.client.ListObjects(m.ctx, bucket, minio.ListObjectsOptions{Prefix: releasePrefix, Recursive: true}) {
+			if object.Err != nil {
+				return nil, nil, fmt.Errorf("err from s3:%w", object.Err)
+			}
+			dataKeys = append(dataKeys, object.Key)
+		}
+	}
+
+	manifestKeys = []string{}
+	for _, manifest := range append(sharedDelete, releaseDelete...) {
+		manifestKeys = append(manifestKeys, manifest.Key)
+	}
+	return dataKeys, manifestKeys, nil
+}
+
+// GC removes the releases of prefix that the retention policy expires, as the
+// cleanup after a populate does, holding the populate lock so it never races a
+// populate of the same prefix. A dry run takes no lock and removes nothing
+func (m *Minio) GC(prefix string, opts impl.GCOptions) (result impl.GCResult, err error) {
+	bucket := m.bucket
+	if !opts.DryRun {
+		err = m.StartPopulate(prefix, bucket, 0)
 		if err != nil {
-			return fmt.Errorf("unable to remove object: %w", err)
+			return impl.GCResult{}, err
 		}
-		fmt.Printf("Removed file %s\n", file)
+		defer func() {
+			endErr := m.EndPopulate(prefix, bucket, 0)
+			if err == nil && endErr != nil {
+				result, err = impl.GCResult{}, endErr
+			}
+		}()
 	}
 
-	// Remove old manifests
-	for _, manifest := range toDelete {
-		err := m.client.RemoveObject(m.ctx, bucket, manifest.Key, minio.RemoveObjectOptions{})
+	current, _, err := m.currentRelease(prefix)
+	if err != nil {
+		return impl.GCResult{}, err
+	}
+	allManifests, layouts, err := m.listManifests(prefix, bucket)
+	if err != nil {
+		return impl.GCResult{}, err
+	}
+	dataKeys, manifestKeys, err := m.cleanupKeys(prefix, bucket, allManifests, layouts, current, time.Now().Unix(), opts.Timeout, opts.MinAssetRecords)
+	if err != nil {
+		return impl.GCResult{}, err
+	}
+
+	// Without any manifest every object would look unreferenced
+	orphans := []impl.StoredKey{}
+	if opts.Orphans && len(allManifests) > 0 {
+		kept := []impl.Manifest{}
+		for _, info := range allManifests {
+			if !slices.Contains(manifestKeys, info.Key) {
+				kept = append(kept, impl.Manifest{Timestamp: info.Timestamp, Files: info.Files, Layout: layouts[info.Timestamp]})
+			}
+		}
+		orphans, err = m.orphanKeys(prefix, bucket, kept, dataKeys, time.Now().Unix(), opts.OrphanGrace)
 		if err != nil {
-			return fmt.Errorf("unable to remove object: %w", err)
+			return impl.GCResult{}, err
 		}
-		fmt.Printf("Removed manifest %s\n", manifest.Key)
 	}
 
+	result = impl.NewGCResult(prefix, opts.DryRun)
+	err = m.addStatted(&result, bucket, dataKeys)
+	if err != nil {
+		return impl.GCResult{}, err
+	}
+	for _, orphan := range orphans {
+		result.AddOrphan(orphan.Key, orphan.Size)
+	}
+	err = m.addStatted(&result, bucket, manifestKeys)
+	if err != nil {
+		return impl.GCResult{}, err
+	}
+	if opts.DryRun {
+		return result, nil
+	}
+
+	err = result.CheckCap(opts.MaxDeletions)
+	if err != nil {
+		return impl.GCResult{}, err
+	}
+	manifests, data := []string{}, []string{}
+	for _, change := range result.Deletes {
+		if slices.Contains(manifestKeys, change.Key) {
+			manifests = append(manifests, change.Key)
+		} else {
+			data = append(data, change.Key)
+		}
+	}
+	err = m.removeKeys(prefix, bucket, manifests, data)
+	if err != nil {
+		return impl.GCResult{}, err
+	}
+	return result, nil
+}
+
+// addStatted adds keys to result with their stored size, skipping keys that no
+// longer exist
+func (m *Minio) addStatted(result *impl.GCResult, bucket string, keys []string) error {
+	for _, key := range keys {
+		info, err := m.statObject(bucket, key)
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("err from s3:%w", err)
+		}
+		result.Add(key, info.Size)
+	}
 	return nil
 }
 
-func getCacheControl(filepath string, cacheMaxAge int64) string {
-	// Short cache to protect origin
-	// Adding stale-while-revalidate allows CDN to serve the stale file (up to the specified seconds) while new file is fetched in the background
-	// Requests after max-age and stale-while-revalidate will be treated as a cache miss
-	if strings.HasSuffix(filepath, "index.html") ||
-		strings.HasSuffix(filepath, "fed-mods.json") ||
-		strings.HasSuffix(filepath, "app-info.json") ||
-		strings.HasSuffix(filepath, "app-info.deps.json") {
-		return "public, max-age=60, stale-while-revalidate=300"
+// orphanKeys returns the objects under the data and release keys of prefix that
+// no kept manifest references and that are older than grace. Keys already being
+// deleted, protected files and the keys of nested prefixes, such as
+// prefix/admin, are left out
+func (m *Minio) orphanKeys(prefix, bucket string, kept []impl.Manifest, deleting []string, currentTime, grace int64) ([]impl.StoredKey, error) {
+	prefixes, err := m.Prefixes()
+	if err != nil {
+		return nil, err
+	}
+	nested := []string{}
+	for _, other := range prefixes {
+		if strings.HasPrefix(other, prefix+"/") {
+			nested = append(nested, other)
+		}
 	}
 
-	// All other assets use the configured (or default) cache max-age value
-	return fmt.Sprintf("public, max-age=%d", cacheMaxAge)
+	referenced := impl.ReferencedKeys(prefix, kept)
+	for _, key := range deleting {
+		referenced[key] = true
+	}
+
+	stored := []impl.StoredKey{}
+	for _, root := range []string{"data", "releases"} {
+	objects:
+		for object := range m.client.ListObjects(m.ctx, bucket, minio.ListObjectsOptions{Prefix: fmt.Sprintf("%s/%s/", root, prefix), Recursive: true}) {
+			if object.Err != nil {
+				return nil, fmt.Errorf("err from s3:%w", object.Err)
+			}
+			for _, other := range nested {
+				if strings.HasPrefix(object.Key, fmt.Sprintf("%s/%s/", root, other)) {
+					continue objects
+				}
+			}
+			if root == "data" && impl.IsProtected(strings.TrimPrefix(object.Key, fmt.Sprintf("data/%s/", prefix)), m.protected) {
+				continue
+			}
+			stored = append(stored, impl.StoredKey{Key: object.Key, Size: object.Size, Modified: object.LastModified.Unix()})
+		}
+	}
+	return impl.DetermineOrphans(stored, referenced, currentTime, grace), nil
+}
+
+// PlanPopulate works out what PopulateFn would do with opts without changing
+// the bucket: the uploads, the manifest and pointer writes, and the keys
+// cleanup would remove once the new release is stored
+func (m *Minio) PlanPopulate(opts impl.PopulateOptions) (impl.Plan, error) {
+	bucket, prefix := m.bucket, opts.Prefix
+	currentTime := time.Now().Unix()
+	plan := impl.NewPlan(prefix, currentTime)
+
+	latestManifest, err := m.loadManifest(prefix, 0)
+	if err == nil && latestManifest.Image != "" && latestManifest.Image == opts.Image {
+		plan.Skipped = fmt.Sprintf("image %s already exists in latest manifest", opts.Image)
+		return plan, nil
+	}
+
+	previousEntries := entriesByPath(latestManifest)
+	var mu sync.Mutex
+	changes := map[string]impl.PlannedChange{}
+	planFile := func(file impl.FileInfo) error {
+		change := impl.PlannedChange{Action: impl.ActionUpload, Key: m.dataKey(prefix, file.Path, currentTime), Size: file.Size}
+		if source, _, ok := m.reusableObject(prefix, bucket, file, latestManifest, previousEntries); ok {
+			change.Action = impl.ActionCopy
+			if source == change.Key {
+				change.Action = impl.ActionUnchanged
+			}
+		}
+		mu.Lock()
+		changes[file.Path] = change
+		mu.Unlock()
+		return nil
+	}
+	plan.Excluded, err = opts.Filter.ExcludedPaths(opts.SourceFS())
+	if err != nil {
+		return impl.Plan{}, err
+	}
+	fileSystem := impl.FilterFS(opts.SourceFS(), opts.Filter)
+	files, _, err := impl.ProcessFilesWithTypes(fileSystem, opts.Concurrency, m.contentTypes, planFile)
+	if err != nil {
+		return impl.Plan{}, err
+	}
+	variants, _, err := impl.ProcessVariants(fileSystem, files, opts.Precompress, opts.Concurrency, planFile)
+	if err != nil {
+		return impl.Plan{}, err
+	}
+	files = append(files, variants...)
+	for _, file := range files {
+		plan.Uploads = append(plan.Uploads, changes[file.Path])
+	}
+
+	newManifest := impl.ManifestInfo{Key: impl.MakeManifestKey(prefix, currentTime), Timestamp: currentTime, Files: impl.FilePaths(files)}
+	plan.Manifests = append(plan.Manifests, impl.PlannedChange{Action: impl.ActionWrite, Key: newManifest.Key})
+
+	current, hasCurrent, err := m.currentRelease(prefix)
+	if err != nil {
+		return impl.Plan{}, err
+	}
+	switch {
+	case m.layout == impl.LayoutRelease:
+		plan.Manifests = append(plan.Manifests, impl.PlannedChange{Action: impl.ActionWrite, Key: impl.MakeCurrentKey(prefix)})
+		current = currentTime
+	case hasCurrent:
+		plan.Manifests = append(plan.Manifests, impl.PlannedChange{Action: impl.ActionDelete, Key: impl.MakeCurrentKey(prefix)})
+		current = 0
+	}
+
+	allManifests, layouts, err := m.listManifests(prefix, bucket)
+	if err != nil {
+		return impl.Plan{}, err
+	}
+	allManifests = append(allManifests, newManifest)
+	if m.layout == impl.LayoutRelease {
+		layouts[currentTime] = impl.LayoutRelease
+	}
+
+	dataKeys, manifestKeys, err := m.cleanupKeys(prefix, bucket, allManifests, layouts, current, currentTime, opts.Timeout, opts.MinAssetRecords)
+	if err != nil {
+		return impl.Plan{}, err
+	}
+	for _, key := range append(dataKeys, manifestKeys...) {
+		plan.Deletes = append(plan.Deletes, impl.PlannedChange{Action: impl.ActionDelete, Key: key})
+	}
+	return plan, nil
 }
 
 func (m *Minio) getLatestManifest(prefix, bucket string) (impl.Manifest, error) {
@@ -222,7 +1182,15 @@ func (m *Minio) getLatestManifest(prefix, bucket string) (impl.Manifest, error)
 		return impl.Manifest{}, fmt.Errorf("no manifests found")
 	}
 
-	return m.getManifest(latestKey, bucket)
+	manifest, err := m.getManifest(latestKey, bucket)
+	if err != nil {
+		return impl.Manifest{}, err
+	}
+	// Legacy manifests do not record their own timestamp
+	if manifest.Timestamp == 0 {
+		manifest.Timestamp = latestTimestamp
+	}
+	return manifest, nil
 }
 
 func (m *Minio) getManifest(key, bucket string) (impl.Manifest, error) {
@@ -230,6 +1198,7 @@ func (m *Minio) getManifest(key, bucket string) (impl.Manifest, error) {
 	if err != nil {
 		return impl.Manifest{}, fmt.Errorf("could not get object: %w", err)
 	}
+	defer obj.Close()
 
 	rawData, err := io.ReadAll(obj)
 	if err != nil {
@@ -1,14 +1,22 @@
 package s3_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
+	minio "github.com/minio/minio-go/v7"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
 	"github.com/RedHatInsights/valpop/impl"
 	"github.com/RedHatInsights/valpop/impl/mock"
+	"github.com/RedHatInsights/valpop/impl/s3"
 )
 
 var _ = Describe("S3 Implementation with Mocks", func() {
@@ -34,6 +42,181 @@ var _ = Describe("S3 Implementation with Mocks", func() {
 			})
 		})
 
+		Context("PopulateFromDir", func() {
+			It("should stream every file into its data object", func() {
+				source := GinkgoT().TempDir()
+				bundle := bytes.Repeat([]byte("wasm"), 256*1024)
+				Expect(os.MkdirAll(filepath.Join(source, "static"), 0755)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(source, "index.html"), []byte("<html></html>"), 0644)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(source, "static", "app.wasm"), bundle, 0644)).To(Succeed())
+
+				client := mock.NewS3Client()
+				minioService := s3.NewMinioWithClient(client, testBucket, 86400)
+				Expect(minioService.PopulateFromDir(testNamespace, testBucket, source, testTimestamp)).To(Succeed())
+
+				Expect(client.Objects[testBucket+"/data/testapp/index.html"]).To(Equal([]byte("<html></html>")))
+				Expect(client.Objects[testBucket+"/data/testapp/static/app.wasm"]).To(Equal(bundle))
+				Expect(client.ObjectInfo[testBucket+"/data/testapp/static/app.wasm"].Size).To(Equal(int64(len(bundle))))
+			})
+
+			It("should skip files whose hash matches the previous manifest and stored object", func() {
+				source := GinkgoT().TempDir()
+				Expect(os.WriteFile(filepath.Join(source, "index.html"), []byte("<html>v2</html>"), 0644)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(source, "vendor.js"), []byte("unchanged vendor"), 0644)).To(Succeed())
+
+				client := mock.NewS3Client()
+				minioService := s3.NewMinioWithClient(client, testBucket, 86400)
+				first, _, _, err := s3.PopulateFromDirWithHashes(&minioService, testNamespace, testBucket, os.DirFS(source), testTimestamp, 2, impl.Manifest{}, impl.PrecompressOptions{})
+				Expect(err).ToNot(HaveOccurred())
+				previous := impl.NewManifest(first, "", "", testTimestamp, nil)
+				vendor, found := previous.Entry("vendor.js")
+				Expect(found).To(BeTrue())
+				Expect(vendor.SHA256).ToNot(BeEmpty())
+				Expect(client.ObjectInfo[testBucket+"/data/testapp/vendor.js"].UserMetadata).To(HaveKeyWithValue("sha256", vendor.SHA256))
+
+				Expect(os.WriteFile(filepath.Join(source, "index.html"), []byte("<html>v3</html>"), 0644)).To(Succeed())
+				files, _, stats, err := s3.PopulateFromDirWithHashes(&minioService, testNamespace, testBucket, os.DirFS(source), testTimestamp+1, 2, previous, impl.PrecompressOptions{})
+
+				Expect(err).ToNot(HaveOccurred())
+				Expect(impl.FilePaths(files)).To(Equal([]string{"index.html", "vendor.js"}))
+				Expect(stats.Files).To(Equal(1))
+				Expect(stats.Skipped).To(Equal(1))
+				Expect(stats.SkippedBytes).To(Equal(int64(len("unchanged vendor"))))
+				Expect(string(client.Objects[testBucket+"/data/testapp/index.html"])).To(Equal("<html>v3</html>"))
+			})
+
+			It("should re-upload when the stored object no longer carries the manifest hash", func() {
+				source := GinkgoT().TempDir()
+				Expect(os.WriteFile(filepath.Join(source, "app.js"), []byte("release"), 0644)).To(Succeed())
+
+				client := mock.NewS3Client()
+				minioService := s3.NewMinioWithClient(client, testBucket, 86400)
+				first, _, _, err := s3.PopulateFromDirWithHashes(&minioService, testNamespace, testBucket, os.DirFS(source), testTimestamp, 1, impl.Manifest{}, impl.PrecompressOptions{})
+				Expect(err).ToNot(HaveOccurred())
+
+				// An interrupted populate overwrote the object without writing a manifest
+				Expect(minioService.SetItem(testNamespace, "app.js", "application/javascript", testBucket, testTimestamp, "partial")).To(Succeed())
+
+				_, _, stats, err := s3.PopulateFromDirWithHashes(&minioService, testNamespace, testBucket, os.DirFS(source), testTimestamp+1, 1, impl.NewManifest(first, "", "", testTimestamp, nil), impl.PrecompressOptions{})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(stats.Files).To(Equal(1))
+				Expect(stats.Skipped).To(BeZero())
+				Expect(string(client.Objects[testBucket+"/data/testapp/app.js"])).To(Equal("release"))
+			})
+
+			It("should set Cache-Control from the first matching cache rule", func() {
+				source := GinkgoT().TempDir()
+				Expect(os.MkdirAll(filepath.Join(source, "static"), 0755)).To(Succeed())
+				for _, file := range []string{"index.html", "fed-mods.json", "static/app.1a2b3c4d.js", "static/app.js"} {
+					Expect(os.WriteFile(filepath.Join(source, file), []byte(file), 0644)).To(Succeed())
+				}
+
+				client := mock.NewS3Client()
+				minioService := s3.NewMinioWithClient(client, testBucket, 600)
+				s3.SetCacheRules(&minioService, []impl.CacheRule{
+					{Pattern: "*.????????.js", CacheControl: "public, max-age=31536000, immutable"},
+					{Pattern: "*.html", CacheControl: "no-cache"},
+				}, 600)
+				Expect(minioService.PopulateFromDir(testNamespace, testBucket, source, testTimestamp)).To(Succeed())
+
+				cacheControl := func(file string) string {
+					return client.ObjectInfo[testBucket+"/data/testapp/"+file].Metadata.Get("Cache-Control")
+				}
+				Expect(cacheControl("index.html")).To(Equal("no-cache"))
+				Expect(cacheControl("fed-mods.json")).To(Equal(impl.EntrypointCacheControl))
+				Expect(cacheControl("static/app.1a2b3c4d.js")).To(Equal("public, max-age=31536000, immutable"))
+				Expect(cacheControl("static/app.js")).To(Equal("public, max-age=600"))
+			})
+
+			It("should store precompressed variants with their content encoding", func() {
+				source := GinkgoT().TempDir()
+				script := strings.Repeat("console.log('valpop');\n", 100)
+				Expect(os.WriteFile(filepath.Join(source, "app.js"), []byte(script), 0644)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(source, "logo.png"), bytes.Repeat([]byte{0x89}, 4096), 0644)).To(Succeed())
+
+				client := mock.NewS3Client()
+				minioService := s3.NewMinioWithClient(client, testBucket, 600)
+				s3.SetCacheRules(&minioService, []impl.CacheRule{{Pattern: "*.js", CacheControl: "public, max-age=31536000, immutable"}}, 600)
+				precompress := impl.PrecompressOptions{Encodings: []string{impl.EncodingGzip, impl.EncodingBrotli}, MinSize: 1024}
+				files, _, stats, err := s3.PopulateFromDirWithHashes(&minioService, testNamespace, testBucket, os.DirFS(source), testTimestamp, 2, impl.Manifest{}, precompress)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(impl.FilePaths(files)).To(Equal([]string{"app.js", "logo.png", "app.js.br", "app.js.gz"}))
+				Expect(stats.Files).To(Equal(4))
+
+				for path, encoding := range map[string]string{"app.js.gz": "gzip", "app.js.br": "br"} {
+					info := client.ObjectInfo[testBucket+"/data/testapp/"+path]
+					Expect(info.ContentType).To(Equal("application/javascript"))
+					Expect(info.Metadata.Get("Content-Encoding")).To(Equal(encoding))
+					Expect(info.Metadata.Get("Cache-Control")).To(Equal("public, max-age=31536000, immutable"))
+					Expect(info.Size).To(BeNumerically("<", len(script)))
+				}
+				Expect(client.ObjectInfo[testBucket+"/data/testapp/app.js"].Metadata.Get("Content-Encoding")).To(BeEmpty())
+
+				manifest := impl.NewManifest(files, "", "", testTimestamp, nil)
+				Expect(manifest.Entries[3].ContentEncoding).To(Equal("gzip"))
+
+				// Variants of unchanged files compress to the same bytes and are skipped
+				_, _, stats, err = s3.PopulateFromDirWithHashes(&minioService, testNamespace, testBucket, os.DirFS(source), testTimestamp+1, 2, manifest, precompress)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(stats.Files).To(BeZero())
+				Expect(stats.Skipped).To(Equal(4))
+			})
+
+			It("should store objects with the resolved content type", func() {
+				source := GinkgoT().TempDir()
+				Expect(os.WriteFile(filepath.Join(source, "app.js.map"), []byte("{}"), 0644)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(source, "LICENSE"), []byte("Apache License"), 0644)).To(Succeed())
+
+				client := mock.NewS3Client()
+				minioService := s3.NewMinioWithClient(client, testBucket, 600)
+				s3.SetContentTypes(&minioService, impl.ContentTypes{Overrides: map[string]string{".map": "application/x-sourcemap"}, Sniff: true})
+				files, _, _, err := s3.PopulateFromDirWithHashes(&minioService, testNamespace, testBucket, os.DirFS(source), testTimestamp, 1, impl.Manifest{}, impl.PrecompressOptions{})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(client.ObjectInfo[testBucket+"/data/testapp/app.js.map"].ContentType).To(Equal("application/x-sourcemap"))
+				Expect(client.ObjectInfo[testBucket+"/data/testapp/LICENSE"].ContentType).To(Equal("text/plain; charset=utf-8"))
+				Expect(client.ObjectInfo[testBucket+"/data/testapp/LICENSE"].Size).To(Equal(int64(len("Apache License"))))
+				Expect(impl.NewManifest(files, "", "", testTimestamp, nil).Entries[0].ContentType).To(Equal("text/plain; charset=utf-8"))
+			})
+
+			It("should re-upload unchanged files when their cache rule changes", func() {
+				source := GinkgoT().TempDir()
+				Expect(os.WriteFile(filepath.Join(source, "index.html"), []byte("<html></html>"), 0644)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(source, "vendor.js"), []byte("vendor"), 0644)).To(Succeed())
+
+				client := mock.NewS3Client()
+				minioService := s3.NewMinioWithClient(client, testBucket, 600)
+				first, _, _, err := s3.PopulateFromDirWithHashes(&minioService, testNamespace, testBucket, os.DirFS(source), testTimestamp, 1, impl.Manifest{}, impl.PrecompressOptions{})
+				Expect(err).ToNot(HaveOccurred())
+
+				s3.SetCacheRules(&minioService, []impl.CacheRule{{Pattern: "*.html", CacheControl: "no-cache"}}, 600)
+				_, _, stats, err := s3.PopulateFromDirWithHashes(&minioService, testNamespace, testBucket, os.DirFS(source), testTimestamp+1, 1, impl.NewManifest(first, "", "", testTimestamp, nil), impl.PrecompressOptions{})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(stats.Files).To(Equal(1))
+				Expect(stats.Skipped).To(Equal(1))
+				Expect(client.ObjectInfo[testBucket+"/data/testapp/index.html"].Metadata.Get("Cache-Control")).To(Equal("no-cache"))
+			})
+
+			It("should re-upload unchanged files when their content type changes", func() {
+				source := GinkgoT().TempDir()
+				Expect(os.WriteFile(filepath.Join(source, "app.js.map"), []byte("{}"), 0644)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(source, "vendor.js"), []byte("vendor"), 0644)).To(Succeed())
+
+				client := mock.NewS3Client()
+				minioService := s3.NewMinioWithClient(client, testBucket, 600)
+				first, _, _, err := s3.PopulateFromDirWithHashes(&minioService, testNamespace, testBucket, os.DirFS(source), testTimestamp, 1, impl.Manifest{}, impl.PrecompressOptions{})
+				Expect(err).ToNot(HaveOccurred())
+
+				s3.SetContentTypes(&minioService, impl.ContentTypes{Overrides: map[string]string{".map": "application/x-sourcemap"}})
+				second, _, stats, err := s3.PopulateFromDirWithHashes(&minioService, testNamespace, testBucket, os.DirFS(source), testTimestamp+1, 1, impl.NewManifest(first, "", "", testTimestamp, nil), impl.PrecompressOptions{})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(stats.Files).To(Equal(1))
+				Expect(stats.Skipped).To(Equal(1))
+				Expect(client.ObjectInfo[testBucket+"/data/testapp/app.js.map"].ContentType).To(Equal("application/x-sourcemap"))
+				Expect(impl.NewManifest(second, "", "", testTimestamp+1, nil).Entries).To(ContainElement(HaveField("ContentType", "application/x-sourcemap")))
+			})
+		})
+
 		Context("SetManifest", func() {
 			It("should store manifests correctly", func() {
 				manifest := impl.Manifest{
@@ -228,13 +411,667 @@ var _ = Describe("S3 Implementation with Mocks", func() {
 			})
 
 			It("should handle populate function call", func() {
-				err := mockService.PopulateFn("addr", "bucket", "source", "prefix", "test-image:v1", "valpop:v1", 3600, 3, 86400)
+				err := mockService.PopulateFn(impl.PopulateOptions{
+					Source:          "source",
+					Prefix:          "prefix",
+					Image:           "test-image:v1",
+					ValpopImage:     "valpop:v1",
+					Timeout:         3600,
+					MinAssetRecords: 3,
+				})
 				Expect(err).ToNot(HaveOccurred())
 				Expect(mockService.Operations).To(ContainElement("PopulateFn"))
 			})
 		})
 	})
 
+	Describe("Pop Operations", func() {
+		It("should return the files of the newest manifest", func() {
+			for _, ts := range []int64{1000, 3000, 2000} {
+				err := mockService.SetManifest(testNamespace, testBucket, ts, impl.Manifest{
+					Files:     []string{fmt.Sprintf("file-%d.txt", ts), "index.html"},
+					Timestamp: ts,
+				})
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			items, err := mockService.Pop(testNamespace, 0)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(items[testNamespace]).To(HaveKeyWithValue("file-3000.txt", []int64{3000}))
+			Expect(items[testNamespace]).To(HaveKeyWithValue("index.html", []int64{3000}))
+			Expect(items[testNamespace]).To(HaveLen(2))
+		})
+
+		It("should return the files of a specific manifest", func() {
+			err := mockService.SetManifest(testNamespace, testBucket, 1000, impl.Manifest{Files: []string{"old.txt"}, Timestamp: 1000})
+			Expect(err).ToNot(HaveOccurred())
+			err = mockService.SetManifest(testNamespace, testBucket, 2000, impl.Manifest{Files: []string{"new.txt"}, Timestamp: 2000})
+			Expect(err).ToNot(HaveOccurred())
+
+			items, err := mockService.Pop(testNamespace, 1000)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(items[testNamespace]).To(Equal(impl.Items{"old.txt": []int64{1000}}))
+		})
+
+		It("should fail when there is nothing to pop", func() {
+			_, err := mockService.Pop(testNamespace, 0)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("no manifests found"))
+		})
+
+		It("should read back and delete items through the shared interface", func() {
+			err := mockService.SetItem(testNamespace, "app.js", "application/javascript", testBucket, testTimestamp, "console.log(1)")
+			Expect(err).ToNot(HaveOccurred())
+
+			content, err := mockService.GetItem(testNamespace, "app.js", testTimestamp)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(content).To(Equal("console.log(1)"))
+
+			err = mockService.DelKeys(impl.AllItems{testNamespace: impl.Items{"app.js": []int64{testTimestamp}}})
+			Expect(err).ToNot(HaveOccurred())
+
+			_, exists := mockService.GetStoredItem(testNamespace, "app.js")
+			Expect(exists).To(BeFalse())
+		})
+
+		It("should handle pop function call", func() {
+			err := mockService.PopFn("prefix", "/tmp/dest")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mockService.Operations).To(ContainElement("PopFn"))
+		})
+
+		It("should handle PopFn errors", func() {
+			mockService.Errors["PopFn"] = fmt.Errorf("no manifests found")
+
+			err := mockService.PopFn("prefix", "/tmp/dest")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("no manifests found"))
+		})
+	})
+
+	Describe("List Operations", func() {
+		It("should list prefixes and their manifests", func() {
+			Expect(mockService.SetManifest("app-a", testBucket, 1000, impl.Manifest{Files: []string{"index.html"}})).To(Succeed())
+			Expect(mockService.SetManifest("app-a", testBucket, 2000, impl.Manifest{Files: []string{"index.html"}, Timestamp: 2000})).To(Succeed())
+			Expect(mockService.SetManifest("app-b", testBucket, 1500, impl.Manifest{Files: []string{"index.html"}, Timestamp: 1500})).To(Succeed())
+
+			prefixes, err := mockService.Prefixes()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(prefixes).To(Equal([]string{"app-a", "app-b"}))
+
+			manifests, err := mockService.Manifests("app-a")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(manifests).To(HaveLen(2))
+			stamps := []int64{manifests[0].Timestamp, manifests[1].Timestamp}
+			Expect(stamps).To(ConsistOf(int64(1000), int64(2000)))
+		})
+	})
+
+	Describe("Verify Operations", func() {
+		It("should pass when every manifest file is stored", func() {
+			Expect(mockService.SetItem(testNamespace, "index.html", "text/html", testBucket, 1000, "<html></html>")).To(Succeed())
+			Expect(mockService.SetManifest(testNamespace, testBucket, 1000, impl.Manifest{Files: []string{"index.html"}, Timestamp: 1000})).To(Succeed())
+
+			report, err := mockService.Verify(testNamespace, 0)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(report.OK()).To(BeTrue())
+			Expect(report.Timestamp).To(Equal(int64(1000)))
+		})
+
+		It("should check objects against manifest sizes and hashes", func() {
+			source := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(source, "index.html"), []byte("<html></html>"), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(source, "app.js"), []byte("console.log(1)"), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(source, "style.css"), []byte("body{}"), 0644)).To(Succeed())
+
+			client := mock.NewS3Client()
+			minioService := s3.NewMinioWithClient(client, testBucket, 86400)
+			files, _, _, err := s3.PopulateFromDirWithHashes(&minioService, testNamespace, testBucket, os.DirFS(source), testTimestamp, 1, impl.Manifest{}, impl.PrecompressOptions{})
+			Expect(err).ToNot(HaveOccurred())
+			manifest := impl.NewManifest(files, "myapp:v1", "", testTimestamp, nil)
+
+			report, err := s3.VerifyManifest(&minioService, testNamespace, manifest)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(report.OK()).To(BeTrue())
+			Expect(report.Checked).To(Equal(3))
+
+			// A bad cleanup removed one file and a partial upload truncated another
+			Expect(minioService.DelKeys(impl.AllItems{testNamespace: impl.Items{"style.css": nil}})).To(Succeed())
+			client.Objects[testBucket+"/data/testapp/app.js"] = []byte("console")
+			info := client.ObjectInfo[testBucket+"/data/testapp/app.js"]
+			info.Size = 7
+			client.ObjectInfo[testBucket+"/data/testapp/app.js"] = info
+
+			report, err = s3.VerifyManifest(&minioService, testNamespace, manifest)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(report.Problems).To(ConsistOf(
+				impl.VerifyProblem{Path: "style.css", Problem: impl.ProblemMissing},
+				impl.VerifyProblem{Path: "app.js", Problem: impl.ProblemSizeMismatch, Expected: "14", Actual: "7"},
+			))
+		})
+
+		It("should fail when there is no manifest to verify", func() {
+			_, err := mockService.Verify(testNamespace, 0)
+			Expect(err).To(MatchError("no manifests found"))
+		})
+	})
+
+	Describe("Populate locking", func() {
+		var (
+			client *mock.S3Client
+			podA   s3.Minio
+			podB   s3.Minio
+		)
+
+		BeforeEach(func() {
+			client = mock.NewS3Client()
+			podA = s3.NewMinioWithClient(client, testBucket, 86400)
+			podB = s3.NewMinioWithClient(client, testBucket, 86400)
+			s3.SetLockOptions(&podA, "pod-a", time.Minute, 0)
+			s3.SetLockOptions(&podB, "pod-b", time.Minute, 0)
+		})
+
+		It("should let one populate hold the lock of a prefix", func() {
+			Expect(podA.StartPopulate(testNamespace, testBucket, testTimestamp)).To(Succeed())
+			Expect(client.ObjectInfo[testBucket+"/locks/testapp"].UserMetadata).To(HaveKeyWithValue("owner", "pod-a"))
+
+			err := podB.StartPopulate(testNamespace, testBucket, testTimestamp)
+			Expect(err).To(MatchError(impl.ErrLocked))
+			Expect(err.Error()).To(ContainSubstring("held by pod-a"))
+
+			// Other prefixes are not affected
+			Expect(podB.StartPopulate("otherapp", testBucket, testTimestamp)).To(Succeed())
+
+			Expect(podA.EndPopulate(testNamespace, testBucket, testTimestamp)).To(Succeed())
+			Expect(podA.Locks(testNamespace)).To(BeEmpty())
+			Expect(podB.StartPopulate(testNamespace, testBucket, testTimestamp)).To(Succeed())
+		})
+
+		It("should fall back to unconditional writes when the server has none", func() {
+			client.NoConditionalWrites = true
+			Expect(podA.StartPopulate(testNamespace, testBucket, testTimestamp)).To(Succeed())
+			Expect(client.ObjectInfo[testBucket+"/locks/testapp"].UserMetadata).To(HaveKeyWithValue("owner", "pod-a"))
+
+			err := podB.StartPopulate(testNamespace, testBucket, testTimestamp)
+			Expect(err).To(MatchError(impl.ErrLocked))
+			Expect(err.Error()).To(ContainSubstring("held by pod-a"))
+
+			Expect(podA.EndPopulate(testNamespace, testBucket, testTimestamp)).To(Succeed())
+			Expect(podB.StartPopulate(testNamespace, testBucket, testTimestamp)).To(Succeed())
+			Expect(client.ObjectInfo[testBucket+"/locks/testapp"].UserMetadata).To(HaveKeyWithValue("owner", "pod-b"))
+			Expect(podB.EndPopulate(testNamespace, testBucket, testTimestamp)).To(Succeed())
+		})
+
+		It("should renew the lease while the lock is held", func() {
+			s3.SetLockOptions(&podA, "pod-a", 1500*time.Millisecond, 0)
+			Expect(podA.StartPopulate(testNamespace, testBucket, testTimestamp)).To(Succeed())
+			expires := func() string {
+				locks, err := podB.Locks(testNamespace)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(locks).To(HaveLen(1))
+				return fmt.Sprint(locks[0].Expires)
+			}
+			initial := expires()
+
+			Eventually(expires, 2*time.Second, 100*time.Millisecond).ShouldNot(Equal(initial))
+			Expect(podB.StartPopulate(testNamespace, testBucket, testTimestamp)).To(MatchError(impl.ErrLocked))
+			Expect(podA.EndPopulate(testNamespace, testBucket, testTimestamp)).To(Succeed())
+		})
+
+		It("should stop populating once a renewal finds the lock lost", func() {
+			source := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(source, "index.html"), []byte("<html></html>"), 0644)).To(Succeed())
+			s3.SetLockOptions(&podA, "pod-a", 300*time.Millisecond, 0)
+			Expect(podA.StartPopulate(testNamespace, testBucket, testTimestamp)).To(Succeed())
+
+			// pod-b takes the lock over while pod-a is paused past its lease
+			lock := []byte("{}")
+			_, err := client.PutObject(context.Background(), testBucket, "locks/testapp", bytes.NewReader(lock), int64(len(lock)), minio.PutObjectOptions{
+				UserMetadata: map[string]string{"owner": "pod-b", "expires": fmt.Sprint(time.Now().Add(time.Minute).Unix())},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(func() error {
+				return s3.CheckLock(&podA, testNamespace)
+			}, 2*time.Second, 20*time.Millisecond).Should(MatchError(ContainSubstring(`lock of testapp was lost during populate, now held by "pod-b"`)))
+
+			_, _, _, err = s3.PopulateFromDirWithHashes(&podA, testNamespace, testBucket, os.DirFS(source), testTimestamp, 1, impl.Manifest{}, impl.PrecompressOptions{})
+			Expect(err).To(MatchError(ContainSubstring("lock of testapp was lost")))
+			Expect(client.Objects).ToNot(HaveKey(testBucket + "/data/testapp/index.html"))
+			Expect(s3.RemoveKeys(&podA, testNamespace, testBucket, []string{"locks/testapp"}, nil)).To(MatchError(ContainSubstring("lock of testapp was lost")))
+			Expect(podA.EndPopulate(testNamespace, testBucket, testTimestamp)).To(MatchError(ContainSubstring("lock of testapp was lost")))
+			Expect(client.ObjectInfo[testBucket+"/locks/testapp"].UserMetadata).To(HaveKeyWithValue("owner", "pod-b"))
+		})
+
+		It("should wait for the lock up to the lock wait", func() {
+			s3.SetLockOptions(&podB, "pod-b", time.Minute, 50*time.Millisecond)
+			Expect(podA.StartPopulate(testNamespace, testBucket, testTimestamp)).To(Succeed())
+
+			start := time.Now()
+			Expect(podB.StartPopulate(testNamespace, testBucket, testTimestamp)).To(MatchError(impl.ErrLocked))
+			Expect(time.Since(start)).To(BeNumerically(">=", 50*time.Millisecond))
+		})
+
+		It("should take over an expired lease", func() {
+			s3.SetLockOptions(&podA, "pod-a", -time.Second, 0)
+			Expect(podA.StartPopulate(testNamespace, testBucket, testTimestamp)).To(Succeed())
+
+			Expect(podB.StartPopulate(testNamespace, testBucket, testTimestamp)).To(Succeed())
+			Expect(client.ObjectInfo[testBucket+"/locks/testapp"].UserMetadata).To(HaveKeyWithValue("owner", "pod-b"))
+
+			// pod-a must not release the lock it lost
+			Expect(podA.EndPopulate(testNamespace, testBucket, testTimestamp)).To(MatchError(ContainSubstring("lock of testapp was lost")))
+			Expect(client.ObjectInfo[testBucket+"/locks/testapp"].UserMetadata).To(HaveKeyWithValue("owner", "pod-b"))
+		})
+
+		It("should not populate while another populate holds the lock", func() {
+			source := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(source, "index.html"), []byte("<html></html>"), 0644)).To(Succeed())
+			Expect(podA.StartPopulate(testNamespace, testBucket, testTimestamp)).To(Succeed())
+
+			err := podB.PopulateFn(impl.PopulateOptions{Source: source, Prefix: testNamespace, Concurrency: 1})
+			Expect(err).To(MatchError(impl.ErrLocked))
+			Expect(client.Objects).ToNot(HaveKey(testBucket + "/data/testapp/index.html"))
+			Expect(client.ObjectInfo[testBucket+"/locks/testapp"].UserMetadata).To(HaveKeyWithValue("owner", "pod-a"))
+		})
+
+		It("should not gc while another populate holds the lock", func() {
+			Expect(podA.StartPopulate(testNamespace, testBucket, testTimestamp)).To(Succeed())
+
+			_, err := podB.GC(testNamespace, impl.GCOptions{MinAssetRecords: 1})
+			Expect(err).To(MatchError(impl.ErrLocked))
+
+			// A dry run changes nothing and takes no lock
+			result, err := podB.GC(testNamespace, impl.GCOptions{MinAssetRecords: 1, DryRun: true})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Deletes).To(BeEmpty())
+			Expect(client.ObjectInfo[testBucket+"/locks/testapp"].UserMetadata).To(HaveKeyWithValue("owner", "pod-a"))
+
+			Expect(podA.EndPopulate(testNamespace, testBucket, testTimestamp)).To(Succeed())
+			_, err = podB.GC(testNamespace, impl.GCOptions{MinAssetRecords: 1})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(podB.Locks(testNamespace)).To(BeEmpty())
+		})
+
+		It("should list the locks of a prefix", func() {
+			Expect(podA.StartPopulate(testNamespace, testBucket, testTimestamp)).To(Succeed())
+			Expect(podB.StartPopulate(testNamespace+"/admin", testBucket, testTimestamp)).To(Succeed())
+
+			locks, err := podA.Locks("")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(locks).To(HaveLen(2))
+			Expect(locks[0].Owner).To(Equal("pod-a"))
+			Expect(locks[1].Prefix).To(Equal("testapp/admin"))
+
+			locks, err = podA.Locks(testNamespace)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(locks).To(HaveLen(1))
+			Expect(locks[0].Prefix).To(Equal(testNamespace))
+		})
+
+		It("should only clear expired locks", func() {
+			Expect(podB.StartPopulate(testNamespace, testBucket, testTimestamp)).To(Succeed())
+			locks, err := podA.Locks(testNamespace)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(podA.ClearLock(locks[0])).To(MatchError(ContainSubstring("no longer stale")))
+			Expect(client.ObjectInfo[testBucket+"/locks/testapp"].UserMetadata).To(HaveKeyWithValue("owner", "pod-b"))
+
+			s3.SetLockOptions(&podB, "pod-b", -time.Second, 0)
+			Expect(podB.StartPopulate("crashed", testBucket, testTimestamp)).To(Succeed())
+			locks, err = podA.Locks("crashed")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(podA.ClearLock(locks[0])).To(Succeed())
+			Expect(podA.Locks("crashed")).To(BeEmpty())
+		})
+	})
+
+	Describe("Dry run", func() {
+		var (
+			client       *mock.S3Client
+			minioService s3.Minio
+			source       string
+		)
+
+		BeforeEach(func() {
+			client = mock.NewS3Client()
+			minioService = s3.NewMinioWithClient(client, testBucket, 86400)
+			source = GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(source, "index.html"), []byte("<html></html>"), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(source, "app.js"), []byte("app"), 0644)).To(Succeed())
+		})
+
+		It("should plan a populate without touching the bucket", func() {
+			plan, err := minioService.PlanPopulate(impl.PopulateOptions{Source: source, Prefix: testNamespace, Concurrency: 2, MinAssetRecords: 3})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(plan.Uploads).To(Equal([]impl.PlannedChange{
+				{Action: impl.ActionUpload, Key: "data/testapp/app.js", Size: 3},
+				{Action: impl.ActionUpload, Key: "data/testapp/index.html", Size: 13},
+			}))
+			Expect(plan.Manifests).To(Equal([]impl.PlannedChange{
+				{Action: impl.ActionWrite, Key: fmt.Sprintf("manifests/testapp/%d", plan.Timestamp)},
+			}))
+			Expect(plan.Deletes).To(BeEmpty())
+			Expect(client.Objects).To(BeEmpty())
+		})
+
+		It("should report and leave out excluded paths", func() {
+			Expect(os.MkdirAll(filepath.Join(source, ".git"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(source, ".git", "HEAD"), []byte("ref"), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(source, "app.js.map"), []byte("{}"), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(source, impl.IgnoreFile), []byte(".git/\n"), 0644)).To(Succeed())
+			filter, err := impl.NewFileFilter(os.DirFS(source), nil, []string{"*.map"})
+			Expect(err).ToNot(HaveOccurred())
+
+			opts := impl.PopulateOptions{Source: source, Prefix: testNamespace, Concurrency: 1, Filter: filter}
+			plan, err := minioService.PlanPopulate(opts)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(plan.Excluded).To(Equal([]string{".git/", impl.IgnoreFile, "app.js.map"}))
+			Expect(plan.Uploads).To(HaveLen(2))
+
+			files, _, _, err := s3.PopulateFromDirWithHashes(&minioService, testNamespace, testBucket, impl.FilterFS(os.DirFS(source), filter), testTimestamp, 1, impl.Manifest{}, impl.PrecompressOptions{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(impl.FilePaths(files)).To(Equal([]string{"app.js", "index.html"}))
+			Expect(client.Objects).To(HaveLen(2))
+		})
+
+		It("should plan from the files of an opened source", func() {
+			var buf bytes.Buffer
+			w := tar.NewWriter(&buf)
+			for name, content := range map[string]string{"dist/app.js": "app", "dist/bundle.js": "bundle"} {
+				Expect(w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))})).To(Succeed())
+				_, err := w.Write([]byte(content))
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(w.Close()).To(Succeed())
+			archive := filepath.Join(GinkgoT().TempDir(), "dist.tar")
+			Expect(os.WriteFile(archive, buf.Bytes(), 0644)).To(Succeed())
+			opened, err := impl.OpenSource(archive, "dist")
+			Expect(err).ToNot(HaveOccurred())
+			defer opened.Close()
+
+			plan, err := minioService.PlanPopulate(impl.PopulateOptions{Source: archive, Files: opened, Prefix: testNamespace, Concurrency: 1})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(plan.Uploads).To(Equal([]impl.PlannedChange{
+				{Action: impl.ActionUpload, Key: "data/testapp/app.js", Size: 3},
+				{Action: impl.ActionUpload, Key: "data/testapp/bundle.js", Size: 6},
+			}))
+		})
+
+		It("should plan the pointer swap of the release layout", func() {
+			s3.SetLayout(&minioService, impl.LayoutRelease)
+			plan, err := minioService.PlanPopulate(impl.PopulateOptions{Source: source, Prefix: testNamespace, Concurrency: 1})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(plan.Uploads[0].Key).To(Equal(fmt.Sprintf("releases/testapp/%d/app.js", plan.Timestamp)))
+			Expect(plan.Manifests).To(ContainElement(impl.PlannedChange{Action: impl.ActionWrite, Key: "current/testapp"}))
+			Expect(client.Objects).To(BeEmpty())
+		})
+
+		It("should list the keys cleanup would remove", func() {
+			s3.SetLayout(&minioService, impl.LayoutRelease)
+			Expect(minioService.SetItem(testNamespace, "index.html", "text/html", testBucket, 1500, "v15")).To(Succeed())
+			manifests := []impl.ManifestInfo{
+				{Key: "manifests/testapp/1000", Timestamp: 1000, Files: []string{"index.html", "old.js"}},
+				{Key: "manifests/testapp/1500", Timestamp: 1500, Files: []string{"index.html"}},
+				{Key: "manifests/testapp/2000", Timestamp: 2000, Files: []string{"index.html"}},
+			}
+			layouts := map[int64]string{1500: impl.LayoutRelease}
+
+			dataKeys, manifestKeys, err := s3.CleanupKeys(&minioService, testNamespace, testBucket, manifests, layouts, 0, 10000, 10, 1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dataKeys).To(Equal([]string{"data/testapp/old.js", "releases/testapp/1500/index.html"}))
+			Expect(manifestKeys).To(Equal([]string{"manifests/testapp/1000", "manifests/testapp/1500"}))
+
+			// The release the current pointer refers to is kept
+			dataKeys, manifestKeys, err = s3.CleanupKeys(&minioService, testNamespace, testBucket, manifests, layouts, 1500, 10000, 10, 1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dataKeys).To(Equal([]string{"data/testapp/old.js"}))
+			Expect(manifestKeys).To(Equal([]string{"manifests/testapp/1000"}))
+		})
+
+		It("should remove manifests before the data they list", func() {
+			Expect(minioService.SetItem(testNamespace, "old.js", "text/javascript", testBucket, 1000, "old")).To(Succeed())
+			Expect(minioService.SetManifest(testNamespace, testBucket, 1000, impl.Manifest{Files: []string{"old.js"}, Timestamp: 1000})).To(Succeed())
+
+			Expect(s3.RemoveKeys(&minioService, testNamespace, testBucket, []string{"manifests/testapp/1000"}, []string{"data/testapp/old.js"})).To(Succeed())
+			Expect(client.Removed).To(Equal([]string{"manifests/testapp/1000", "data/testapp/old.js"}))
+			Expect(client.Objects).To(BeEmpty())
+		})
+
+		It("should keep files matching protected patterns", func() {
+			s3.SetProtected(&minioService, []string{"fed-mods.json", "*.html", "static/entry-*.js"})
+			manifests := []impl.ManifestInfo{
+				{Key: "manifests/testapp/1000", Timestamp: 1000, Files: []string{"index.html", "fed-mods.json", "old.js", "static/entry-1.js", "static/chunk.js", "admin/index.html"}},
+				{Key: "manifests/testapp/2000", Timestamp: 2000, Files: []string{"app.js"}},
+			}
+
+			dataKeys, _, err := s3.CleanupKeys(&minioService, testNamespace, testBucket, manifests, map[int64]string{}, 0, 10000, 10, 1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dataKeys).To(Equal([]string{"data/testapp/old.js", "data/testapp/static/chunk.js"}))
+		})
+	})
+
+	Describe("Orphans", func() {
+		var (
+			client       *mock.S3Client
+			minioService s3.Minio
+		)
+
+		BeforeEach(func() {
+			client = mock.NewS3Client()
+			minioService = s3.NewMinioWithClient(client, testBucket, 86400)
+			for _, file := range []string{"index.html", "zombie.js", "expiring.js", "fed-mods.json"} {
+				Expect(minioService.SetItem(testNamespace, file, "text/plain", testBucket, 0, file)).To(Succeed())
+			}
+			Expect(minioService.SetItem(testNamespace+"/admin", "admin.js", "text/plain", testBucket, 0, "admin")).To(Succeed())
+			Expect(minioService.SetManifest(testNamespace+"/admin", testBucket, 1000, impl.Manifest{Files: []string{"admin.js"}})).To(Succeed())
+			s3.SetLayout(&minioService, impl.LayoutRelease)
+			Expect(minioService.SetItem(testNamespace, "index.html", "text/plain", testBucket, 1500, "crashed")).To(Succeed())
+			Expect(minioService.SetItem(testNamespace, "index.html", "text/plain", testBucket, 2000, "v2")).To(Succeed())
+		})
+
+		It("should find objects no kept manifest references", func() {
+			kept := []impl.Manifest{
+				{Timestamp: 1000, Files: []string{"index.html"}},
+				{Timestamp: 2000, Files: []string{"index.html"}, Layout: impl.LayoutRelease},
+			}
+			deleting := []string{"data/testapp/expiring.js"}
+
+			orphans, err := s3.OrphanKeys(&minioService, testNamespace, testBucket, kept, deleting, time.Now().Unix()+10, 0)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(orphans).To(HaveLen(2))
+			Expect(orphans[0].Key).To(Equal("data/testapp/zombie.js"))
+			Expect(orphans[0].Size).To(Equal(int64(9)))
+			Expect(orphans[1].Key).To(Equal("releases/testapp/1500/index.html"))
+		})
+
+		It("should not report protected files as orphans", func() {
+			s3.SetProtected(&minioService, []string{"fed-mods.json", "zombie.*"})
+			orphans, err := s3.OrphanKeys(&minioService, testNamespace, testBucket, nil, nil, time.Now().Unix()+10, 0)
+			Expect(err).ToNot(HaveOccurred())
+			keys := []string{}
+			for _, orphan := range orphans {
+				keys = append(keys, orphan.Key)
+			}
+			Expect(keys).To(Equal([]string{"data/testapp/expiring.js", "data/testapp/index.html", "releases/testapp/1500/index.html", "releases/testapp/2000/index.html"}))
+		})
+
+		It("should keep recent objects during the grace period", func() {
+			orphans, err := s3.OrphanKeys(&minioService, testNamespace, testBucket, nil, nil, time.Now().Unix(), 3600)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(orphans).To(BeEmpty())
+		})
+	})
+
+	Describe("Release layout", func() {
+		var (
+			client       *mock.S3Client
+			minioService s3.Minio
+			source       string
+		)
+
+		BeforeEach(func() {
+			client = mock.NewS3Client()
+			minioService = s3.NewMinioWithClient(client, testBucket, 86400)
+			s3.SetLayout(&minioService, impl.LayoutRelease)
+			source = GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(source, "index.html"), []byte("<html>v1</html>"), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(source, "vendor.js"), []byte("vendor"), 0644)).To(Succeed())
+		})
+
+		It("should write each release under its own keys", func() {
+			first, _, _, err := s3.PopulateFromDirWithHashes(&minioService, testNamespace, testBucket, os.DirFS(source), 1000, 1, impl.Manifest{}, impl.PrecompressOptions{})
+			Expect(err).ToNot(HaveOccurred())
+			previous := impl.NewManifest(first, "", "", 1000, nil)
+			previous.Layout = impl.LayoutRelease
+
+			Expect(os.WriteFile(filepath.Join(source, "index.html"), []byte("<html>v2</html>"), 0644)).To(Succeed())
+			_, _, stats, err := s3.PopulateFromDirWithHashes(&minioService, testNamespace, testBucket, os.DirFS(source), 2000, 1, previous, impl.PrecompressOptions{})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(string(client.Objects[testBucket+"/releases/testapp/1000/index.html"])).To(Equal("<html>v1</html>"))
+			Expect(string(client.Objects[testBucket+"/releases/testapp/2000/index.html"])).To(Equal("<html>v2</html>"))
+			Expect(client.Objects).ToNot(HaveKey(testBucket + "/data/testapp/index.html"))
+
+			// Unchanged files are copied server-side rather than uploaded
+			Expect(stats.Files).To(Equal(1))
+			Expect(stats.Skipped).To(Equal(1))
+			Expect(string(client.Objects[testBucket+"/releases/testapp/2000/vendor.js"])).To(Equal("vendor"))
+			vendor, _ := previous.Entry("vendor.js")
+			Expect(client.ObjectInfo[testBucket+"/releases/testapp/2000/vendor.js"].UserMetadata).To(HaveKeyWithValue("sha256", vendor.SHA256))
+		})
+
+		It("should swap the current pointer when the populate ends", func() {
+			Expect(s3.SetCurrent(&minioService, testNamespace, testBucket, 1000)).To(Succeed())
+			Expect(string(client.Objects[testBucket+"/current/testapp"])).To(Equal("1000"))
+
+			Expect(s3.SetCurrent(&minioService, testNamespace, testBucket, 2000)).To(Succeed())
+			Expect(string(client.Objects[testBucket+"/current/testapp"])).To(Equal("2000"))
+		})
+
+		It("should remove a stale pointer in the shared layout", func() {
+			Expect(s3.SetCurrent(&minioService, testNamespace, testBucket, 1000)).To(Succeed())
+
+			s3.SetLayout(&minioService, impl.LayoutShared)
+			Expect(s3.SetCurrent(&minioService, testNamespace, testBucket, 2000)).To(Succeed())
+			Expect(client.Objects).ToNot(HaveKey(testBucket + "/current/testapp"))
+		})
+
+		It("should delete the object of every listed release", func() {
+			Expect(minioService.SetItem(testNamespace, "index.html", "text/html", testBucket, 1000, "v1")).To(Succeed())
+			Expect(minioService.SetItem(testNamespace, "index.html", "text/html", testBucket, 2000, "v2")).To(Succeed())
+
+			Expect(minioService.DelKeys(impl.AllItems{testNamespace: impl.Items{"index.html": {1000}}})).To(Succeed())
+			Expect(client.Objects).ToNot(HaveKey(testBucket + "/releases/testapp/1000/index.html"))
+			Expect(client.Objects).To(HaveKey(testBucket + "/releases/testapp/2000/index.html"))
+		})
+
+		It("should roll back by copying the target release and moving the pointer", func() {
+			files, _, _, err := s3.PopulateFromDirWithHashes(&minioService, testNamespace, testBucket, os.DirFS(source), 1000, 1, impl.Manifest{}, impl.PrecompressOptions{})
+			Expect(err).ToNot(HaveOccurred())
+			target := impl.NewManifest(files, "myapp:v1", "", 1000, nil)
+			target.Layout = impl.LayoutRelease
+
+			restored, err := minioService.Rollback(testNamespace, target, 3000)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(restored.Layout).To(Equal(impl.LayoutRelease))
+			Expect(string(client.Objects[testBucket+"/releases/testapp/3000/index.html"])).To(Equal("<html>v1</html>"))
+			Expect(string(client.Objects[testBucket+"/current/testapp"])).To(Equal("3000"))
+		})
+	})
+
+	Describe("Rollback Operations", func() {
+		var (
+			client       *mock.S3Client
+			minioService s3.Minio
+			source       string
+		)
+
+		// release uploads source and builds its manifest as PopulateFn does
+		release := func(timestamp int64, image string) impl.Manifest {
+			files, versions, _, err := s3.PopulateFromDirWithHashes(&minioService, testNamespace, testBucket, os.DirFS(source), timestamp, 1, impl.Manifest{}, impl.PrecompressOptions{})
+			Expect(err).ToNot(HaveOccurred())
+			manifest := impl.NewManifest(files, image, "", timestamp, nil)
+			for i := range manifest.Entries {
+				manifest.Entries[i].VersionID = versions[manifest.Entries[i].Path]
+			}
+			return manifest
+		}
+
+		BeforeEach(func() {
+			client = mock.NewS3Client()
+			minioService = s3.NewMinioWithClient(client, testBucket, 86400)
+			source = GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(source, "index.html"), []byte("<html>v1</html>"), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(source, "vendor.js"), []byte("vendor"), 0644)).To(Succeed())
+		})
+
+		It("should copy back overwritten objects from their recorded versions", func() {
+			client.Versioning = true
+			target := release(1000, "myapp:v1")
+			Expect(os.WriteFile(filepath.Join(source, "index.html"), []byte("<html>v2</html>"), 0644)).To(Succeed())
+			release(2000, "myapp:v2")
+
+			restored, err := minioService.Rollback(testNamespace, target, 3000)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(string(client.Objects[testBucket+"/data/testapp/index.html"])).To(Equal("<html>v1</html>"))
+			Expect(client.ObjectInfo[testBucket+"/data/testapp/index.html"].VersionID).To(Equal(restored.Entries[0].VersionID))
+			Expect(restored.Timestamp).To(Equal(int64(3000)))
+			Expect(restored.RolledBackFrom).To(Equal(int64(1000)))
+			Expect(restored.Image).To(Equal("myapp:v1"))
+
+			stored, err := impl.ParseManifest(client.Objects[testBucket+"/manifests/testapp/3000"])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stored).To(Equal(restored))
+
+			report, err := s3.VerifyManifest(&minioService, testNamespace, restored)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(report.OK()).To(BeTrue())
+		})
+
+		It("should keep objects that still hold the release content", func() {
+			target := release(1000, "myapp:v1")
+
+			_, err := minioService.Rollback(testNamespace, target, 3000)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.Objects).To(HaveKey(testBucket + "/manifests/testapp/3000"))
+		})
+
+		It("should refuse to roll back overwritten objects without bucket versioning", func() {
+			target := release(1000, "myapp:v1")
+			Expect(os.WriteFile(filepath.Join(source, "index.html"), []byte("<html>v2</html>"), 0644)).To(Succeed())
+			release(2000, "myapp:v2")
+
+			_, err := minioService.Rollback(testNamespace, target, 3000)
+			Expect(err).To(MatchError(ContainSubstring("cannot restore index.html")))
+			Expect(string(client.Objects[testBucket+"/data/testapp/index.html"])).To(Equal("<html>v2</html>"))
+			Expect(client.Objects).ToNot(HaveKey(testBucket + "/manifests/testapp/3000"))
+		})
+
+		It("should refuse to roll back shared objects of manifests without hashes", func() {
+			release(1000, "myapp:v1")
+			target := impl.Manifest{Version: 1, Files: []string{"index.html"}, Entries: []impl.FileEntry{{Path: "index.html"}}, Image: "myapp:v1", Timestamp: 1000}
+
+			_, err := minioService.Rollback(testNamespace, target, 3000)
+			Expect(err).To(MatchError(ContainSubstring("release 1000 records no content hash")))
+			Expect(err.Error()).ToNot(ContainSubstring("versioning"))
+			Expect(client.Objects).ToNot(HaveKey(testBucket + "/manifests/testapp/3000"))
+		})
+
+		It("should record the rollback in the mock service", func() {
+			target := impl.Manifest{Files: []string{"index.html"}, Image: "myapp:v1", Timestamp: 1000}
+
+			restored, err := mockService.Rollback(testNamespace, target, 3000)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(restored.RolledBackFrom).To(Equal(int64(1000)))
+			stored, exists := mockService.GetStoredManifest(testNamespace, 3000)
+			Expect(exists).To(BeTrue())
+			Expect(stored.Image).To(Equal("myapp:v1"))
+			Expect(mockService.Operations).To(ContainElement("Rollback"))
+		})
+	})
+
 	Describe("Error handling", func() {
 		Context("Storage errors", func() {
 			It("should propagate storage errors correctly", func() {
@@ -256,7 +1093,14 @@ var _ = Describe("S3 Implementation with Mocks", func() {
 
 				// Test PopulateFn error
 				mockService.Errors["PopulateFn"] = fmt.Errorf("source directory not found")
-				err = mockService.PopulateFn("addr", "bucket", "source", "prefix", "test-image:v1", "valpop:v1", 3600, 3, 86400)
+				err = mockService.PopulateFn(impl.PopulateOptions{
+					Source:          "source",
+					Prefix:          "prefix",
+					Image:           "test-image:v1",
+					ValpopImage:     "valpop:v1",
+					Timeout:         3600,
+					MinAssetRecords: 3,
+				})
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(Equal("source directory not found"))
 			})
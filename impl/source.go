@@ -0,0 +1,478 @@
+package impl
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// OCI image layout files and media types OpenSource reads
+const (
+	ociLayoutFile       = "oci-layout"
+	ociIndexFile        = "index.json"
+	ociRefAnnotation    = "org.opencontainers.image.ref.name"
+	mediaTypeOCIIndex   = "application/vnd.oci.image.index.v1+json"
+	mediaTypeDockerList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	whiteoutPrefix      = ".wh."
+	whiteoutOpaque      = ".wh..wh..opq"
+)
+
+// Source is the file tree populate uploads, opened by OpenSource
+// Close removes whatever OpenSource unpacked to disk
+type Source struct {
+	fs.FS
+	// unpacked is the temporary directory an archive or image was unpacked into
+	unpacked string
+}
+
+// Close removes the files unpacked from an archive or image
+func (s Source) Close() error {
+	if s.unpacked == "" {
+		return nil
+	}
+	return os.RemoveAll(s.unpacked)
+}
+
+// OpenSource opens the --source of a populate, which is one of
+//   - a directory
+//   - a tar archive, optionally gzip compressed
+//   - an OCI image layout directory, optionally followed by ":ref" to pick an
+//     image by its ref name when the layout holds several
+//
+// subdir selects the directory inside the source to populate from, such as the
+// path the assets live at inside an image. Archives and image layers are
+// unpacked to a temporary directory, only below subdir, so memory use does not
+// grow with the archive. Symbolic links in them are skipped
+func OpenSource(source, subdir string) (Source, error) {
+	subdir = strings.Trim(path.Clean("/"+filepath.ToSlash(subdir)), "/")
+	if subdir == "" {
+		subdir = "."
+	}
+
+	info, err := os.Stat(source)
+	if errors.Is(err, fs.ErrNotExist) {
+		if layout, ref, ok := splitLayoutRef(source); ok {
+			return unpackSource(func(dest string) error {
+				return unpackImage(layout, ref, subdir, dest)
+			})
+		}
+	}
+	if err != nil {
+		return Source{}, fmt.Errorf("could not open source: %w", err)
+	}
+
+	switch {
+	case info.IsDir() && isImageLayout(source):
+		return unpackSource(func(dest string) error {
+			return unpackImage(source, "", subdir, dest)
+		})
+	case info.IsDir():
+		return Source{FS: os.DirFS(filepath.Join(source, filepath.FromSlash(subdir)))}, nil
+	default:
+		return unpackSource(func(dest string) error {
+			return unpackArchive(source, subdir, dest)
+		})
+	}
+}
+
+// unpackSource runs unpack into a new temporary directory and returns it as a
+// Source, removing it again if unpacking fails
+func unpackSource(unpack func(dest string) error) (Source, error) {
+	dest, err := os.MkdirTemp("", "valpop-source-")
+	if err != nil {
+		return Source{}, err
+	}
+	err = unpack(dest)
+	if err != nil {
+		os.RemoveAll(dest)
+		return Source{}, err
+	}
+	return Source{FS: os.DirFS(dest), unpacked: dest}, nil
+}
+
+func isImageLayout(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, ociLayoutFile))
+	return err == nil
+}
+
+// splitLayoutRef splits "layout:ref" when layout is an OCI image layout
+func splitLayoutRef(source string) (string, string, bool) {
+	i := strings.LastIndex(source, ":")
+	if i <= 0 || !isImageLayout(source[:i]) {
+		return "", "", false
+	}
+	return source[:i], source[i+1:], true
+}
+
+// unpackArchive unpacks the entries of a tar or tar.gz archive below subdir
+func unpackArchive(archive, subdir, dest string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return fmt.Errorf("could not open source: %w", err)
+	}
+	defer f.Close()
+
+	r, err := decompress(bufio.NewReader(f))
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", archive, err)
+	}
+	err = unpackTar(r, subdir, dest, false)
+	if err != nil {
+		return fmt.Errorf("could not unpack %s: %w", archive, err)
+	}
+	return nil
+}
+
+// decompress returns a reader of r's content, gunzipping it when it starts
+// with the gzip magic number
+func decompress(r *bufio.Reader) (io.Reader, error) {
+	magic, err := r.Peek(2)
+	if err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return gzip.NewReader(r)
+	}
+	return r, nil
+}
+
+// ociDescriptor is the subset of an OCI content descriptor OpenSource needs
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform,omitempty"`
+}
+
+// ociIndex is an OCI image index, or the index.json of an image layout
+type ociIndex struct {
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+// ociManifest is an OCI or Docker v2 image manifest
+type ociManifest struct {
+	Layers []ociDescriptor `json:"layers"`
+}
+
+// unpackImage applies the layers of the image ref in layout, or its only
+// image, below subdir, honouring the whiteouts of later layers
+func unpackImage(layout, ref, subdir, dest string) error {
+	raw, err := os.ReadFile(filepath.Join(layout, ociIndexFile))
+	if err != nil {
+		return fmt.Errorf("could not read image layout: %w", err)
+	}
+	index := ociIndex{}
+	err = json.Unmarshal(raw, &index)
+	if err != nil {
+		return fmt.Errorf("could not parse %s: %w", ociIndexFile, err)
+	}
+
+	descriptor, err := selectImage(index.Manifests, ref)
+	if err != nil {
+		return fmt.Errorf("%s: %w", layout, err)
+	}
+	// Multi-platform images list one manifest per platform in a nested index
+	for descriptor.MediaType == mediaTypeOCIIndex || descriptor.MediaType == mediaTypeDockerList {
+		nested := ociIndex{}
+		err = readBlobJSON(layout, descriptor, &nested)
+		if err != nil {
+			return err
+		}
+		descriptor, err = selectPlatform(nested.Manifests)
+		if err != nil {
+			return fmt.Errorf("%s: %w", layout, err)
+		}
+	}
+
+	manifest := ociManifest{}
+	err = readBlobJSON(layout, descriptor, &manifest)
+	if err != nil {
+		return err
+	}
+	for _, layer := range manifest.Layers {
+		err = unpackLayer(layout, layer, subdir, dest)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selectImage picks the image whose ref name is ref, or the only image when
+// ref is empty
+func selectImage(manifests []ociDescriptor, ref string) (ociDescriptor, error) {
+	if ref == "" {
+		if len(manifests) != 1 {
+			return ociDescriptor{}, fmt.Errorf("image layout holds %d images, select one with layout:ref", len(manifests))
+		}
+		return manifests[0], nil
+	}
+	for _, manifest := range manifests {
+		if manifest.Annotations[ociRefAnnotation] == ref {
+			return manifest, nil
+		}
+	}
+	return ociDescriptor{}, fmt.Errorf("no image with ref %q", ref)
+}
+
+// selectPlatform picks the linux image for the architecture valpop runs on,
+// falling back to the first image; static assets rarely differ between them
+func selectPlatform(manifests []ociDescriptor) (ociDescriptor, error) {
+	if len(manifests) == 0 {
+		return ociDescriptor{}, fmt.Errorf("image index lists no images")
+	}
+	for _, manifest := range manifests {
+		if manifest.Platform != nil && manifest.Platform.OS == "linux" && manifest.Platform.Architecture == runtime.GOARCH {
+			return manifest, nil
+		}
+	}
+	return manifests[0], nil
+}
+
+// openBlob opens the blob descriptor points to in layout
+func openBlob(layout string, descriptor ociDescriptor) (*os.File, error) {
+	algorithm, encoded, ok := strings.Cut(descriptor.Digest, ":")
+	if !ok || algorithm != "sha256" || !fs.ValidPath(encoded) || strings.Contains(encoded, "/") {
+		return nil, fmt.Errorf("unsupported digest %q", descriptor.Digest)
+	}
+	return os.Open(filepath.Join(layout, "blobs", algorithm, encoded))
+}
+
+// readBlobJSON parses the blob descriptor points to into v, checking its digest
+func readBlobJSON(layout string, descriptor ociDescriptor, v any) error {
+	f, err := openBlob(layout, descriptor)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	digest := newDigestReader(f)
+	raw, err := io.ReadAll(digest)
+	if err != nil {
+		return err
+	}
+	err = digest.verify(descriptor.Digest)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// unpackLayer applies one image layer, gzip compressed or not, below subdir
+func unpackLayer(layout string, layer ociDescriptor, subdir, dest string) error {
+	if strings.HasSuffix(layer.MediaType, "+zstd") || strings.HasSuffix(layer.MediaType, ".zstd") {
+		return fmt.Errorf("layer %s: unsupported media type %s", layer.Digest, layer.MediaType)
+	}
+	f, err := openBlob(layout, layer)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	digest := newDigestReader(f)
+	r, err := decompress(bufio.NewReader(digest))
+	if err != nil {
+		return fmt.Errorf("layer %s: %w", layer.Digest, err)
+	}
+	err = unpackTar(r, subdir, dest, true)
+	if err != nil {
+		return fmt.Errorf("layer %s: %w", layer.Digest, err)
+	}
+	// Drain the padding after the tar end marker so the digest covers the blob
+	_, err = io.Copy(io.Discard, digest)
+	if err != nil {
+		return err
+	}
+	return digest.verify(layer.Digest)
+}
+
+// digestReader hashes everything read through it
+type digestReader struct {
+	io.Reader
+	hash hash.Hash
+}
+
+func newDigestReader(r io.Reader) *digestReader {
+	hash := sha256.New()
+	return &digestReader{Reader: io.TeeReader(r, hash), hash: hash}
+}
+
+// verify checks that the content read so far has digest
+func (d *digestReader) verify(digest string) error {
+	actual := "sha256:" + hex.EncodeToString(d.hash.Sum(nil))
+	if actual != digest {
+		return fmt.Errorf("blob %s has digest %s", digest, actual)
+	}
+	return nil
+}
+
+// unpackTar writes the files of a tar stream below subdir into dest, with
+// subdir stripped from their paths. Layers also apply whiteouts, removing what
+// earlier layers wrote. Entries escaping the archive root are refused, and
+// symbolic links are skipped so a populate never reads outside dest
+func unpackTar(r io.Reader, subdir, dest string, layer bool) error {
+	reader := tar.NewReader(r)
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name, err := archivePath(header.Name)
+		if err != nil {
+			return err
+		}
+		base := path.Base(name)
+		if layer && strings.HasPrefix(base, whiteoutPrefix) {
+			dir := path.Dir(name)
+			if base == whiteoutOpaque {
+				err = whiteout(dest, subdir, dir, true)
+			} else {
+				err = whiteout(dest, subdir, path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)), false)
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		relative, ok := below(subdir, name)
+		if !ok || (relative == "." && header.Typeflag != tar.TypeDir) {
+			continue
+		}
+		target := filepath.Join(dest, filepath.FromSlash(relative))
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+				os.Remove(target)
+			}
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg, tar.TypeRegA:
+			err = writeEntry(target, reader)
+		case tar.TypeLink:
+			err = linkEntry(dest, subdir, header.Linkname, target)
+		default:
+			// Symbolic links, devices and fifos have no place in a static
+			// release; drop anything an earlier layer put at their path
+			err = os.RemoveAll(target)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", header.Name, err)
+		}
+	}
+}
+
+// archivePath cleans the name of a tar entry into a slash separated path
+// relative to the archive root
+func archivePath(name string) (string, error) {
+	cleaned := path.Clean(strings.TrimPrefix(name, "/"))
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("unsafe path %q in archive", name)
+	}
+	return cleaned, nil
+}
+
+// below returns name relative to subdir when name is subdir or inside it
+func below(subdir, name string) (string, bool) {
+	if subdir == "." {
+		return name, true
+	}
+	if name == subdir {
+		return ".", true
+	}
+	relative, ok := strings.CutPrefix(name, subdir+"/")
+	return relative, ok
+}
+
+// whiteout removes name, or only its content when opaque, from what earlier
+// layers unpacked. Removing subdir or one of its parents empties dest
+func whiteout(dest, subdir, name string, opaque bool) error {
+	relative, ok := below(subdir, name)
+	if !ok {
+		if name != "." && !strings.HasPrefix(subdir+"/", name+"/") {
+			return nil
+		}
+		relative, opaque = ".", true
+	}
+	if relative == "." {
+		opaque = true
+	}
+
+	target := filepath.Join(dest, filepath.FromSlash(relative))
+	if !opaque {
+		return os.RemoveAll(target)
+	}
+	entries, err := os.ReadDir(target)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err = os.RemoveAll(filepath.Join(target, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeEntry writes the content of a regular file entry to target, replacing
+// whatever an earlier layer left there
+func writeEntry(target string, r io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(target)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// linkEntry unpacks a hard link as a copy of its target, which must already be
+// unpacked below subdir
+func linkEntry(dest, subdir, linkname, target string) error {
+	name, err := archivePath(linkname)
+	if err != nil {
+		return err
+	}
+	relative, ok := below(subdir, name)
+	if !ok {
+		return fmt.Errorf("link target %q is outside %s", linkname, subdir)
+	}
+	f, err := os.Open(filepath.Join(dest, filepath.FromSlash(relative)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeEntry(target, f)
+}
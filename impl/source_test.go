@@ -0,0 +1,237 @@
+package impl_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/RedHatInsights/valpop/impl"
+)
+
+// tarEntry is a file, directory (trailing '/') or symlink (Link) of a test archive
+type tarEntry struct {
+	Name, Content, Link string
+}
+
+func buildTar(entries []tarEntry, compress bool) []byte {
+	var buf bytes.Buffer
+	var gz *gzip.Writer
+	w := tar.NewWriter(&buf)
+	if compress {
+		gz = gzip.NewWriter(&buf)
+		w = tar.NewWriter(gz)
+	}
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.Name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(entry.Content))}
+		switch {
+		case entry.Link != "":
+			header = &tar.Header{Name: entry.Name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: entry.Link}
+		case entry.Name[len(entry.Name)-1] == '/':
+			header = &tar.Header{Name: entry.Name, Mode: 0755, Typeflag: tar.TypeDir}
+		}
+		Expect(w.WriteHeader(header)).To(Succeed())
+		_, err := w.Write([]byte(entry.Content))
+		Expect(err).ToNot(HaveOccurred())
+	}
+	Expect(w.Close()).To(Succeed())
+	if compress {
+		Expect(gz.Close()).To(Succeed())
+	}
+	return buf.Bytes()
+}
+
+// writeBlob stores content in the image layout and returns its descriptor
+func writeBlob(layout, mediaType string, content []byte, annotations map[string]string) map[string]any {
+	sum := sha256.Sum256(content)
+	digest := hex.EncodeToString(sum[:])
+	Expect(os.MkdirAll(filepath.Join(layout, "blobs", "sha256"), 0755)).To(Succeed())
+	Expect(os.WriteFile(filepath.Join(layout, "blobs", "sha256", digest), content, 0644)).To(Succeed())
+	descriptor := map[string]any{"mediaType": mediaType, "digest": "sha256:" + digest, "size": len(content)}
+	if annotations != nil {
+		descriptor["annotations"] = annotations
+	}
+	return descriptor
+}
+
+func writeJSON(v any) []byte {
+	raw, err := json.Marshal(v)
+	Expect(err).ToNot(HaveOccurred())
+	return raw
+}
+
+// writeImage stores an image of layers in the layout and returns its manifest descriptor
+func writeImage(layout string, ref string, layers ...[]tarEntry) map[string]any {
+	descriptors := []any{}
+	for _, layer := range layers {
+		descriptors = append(descriptors, writeBlob(layout, "application/vnd.oci.image.layer.v1.tar+gzip", buildTar(layer, true), nil))
+	}
+	config := writeBlob(layout, "application/vnd.oci.image.config.v1+json", []byte("{}"), nil)
+	manifest := writeJSON(map[string]any{"schemaVersion": 2, "config": config, "layers": descriptors})
+	var annotations map[string]string
+	if ref != "" {
+		annotations = map[string]string{"org.opencontainers.image.ref.name": ref}
+	}
+	return writeBlob(layout, "application/vnd.oci.image.manifest.v1+json", manifest, annotations)
+}
+
+func writeLayout(layout string, manifests ...map[string]any) {
+	Expect(os.WriteFile(filepath.Join(layout, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644)).To(Succeed())
+	Expect(os.WriteFile(filepath.Join(layout, "index.json"), writeJSON(map[string]any{"schemaVersion": 2, "manifests": manifests}), 0644)).To(Succeed())
+}
+
+// sourceFiles returns the content of every file of source by path
+func sourceFiles(source fs.FS) map[string]string {
+	files := map[string]string{}
+	Expect(fs.WalkDir(source, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(source, path)
+		files[path] = string(content)
+		return err
+	})).To(Succeed())
+	return files
+}
+
+var _ = Describe("Sources", func() {
+	var dir string
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+	})
+
+	It("should open a directory below the source path", func() {
+		Expect(os.MkdirAll(filepath.Join(dir, "dist", "static"), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "dist", "static", "app.js"), []byte("app"), 0644)).To(Succeed())
+
+		source, err := impl.OpenSource(dir, "/dist/")
+		Expect(err).ToNot(HaveOccurred())
+		defer source.Close()
+		Expect(sourceFiles(source)).To(Equal(map[string]string{"static/app.js": "app"}))
+	})
+
+	DescribeTable("should unpack archives below the source path",
+		func(compress bool) {
+			archive := filepath.Join(dir, "dist.tar")
+			Expect(os.WriteFile(archive, buildTar([]tarEntry{
+				{Name: "./build/"},
+				{Name: "./build/index.html", Content: "<html></html>"},
+				{Name: "./build/static/app.js", Content: "app"},
+				{Name: "./build/passwd", Link: "/etc/passwd"},
+				{Name: "./README.md", Content: "readme"},
+			}, compress), 0644)).To(Succeed())
+
+			source, err := impl.OpenSource(archive, "build")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sourceFiles(source)).To(Equal(map[string]string{
+				"index.html":    "<html></html>",
+				"static/app.js": "app",
+			}))
+
+			Expect(source.Close()).To(Succeed())
+			_, err = fs.Stat(source, "index.html")
+			Expect(err).To(MatchError(fs.ErrNotExist))
+		},
+		Entry("tar", false),
+		Entry("tar.gz", true),
+	)
+
+	It("should refuse archive entries escaping the root", func() {
+		archive := filepath.Join(dir, "evil.tar.gz")
+		Expect(os.WriteFile(archive, buildTar([]tarEntry{{Name: "../../evil.js", Content: "evil"}}, true), 0644)).To(Succeed())
+
+		_, err := impl.OpenSource(archive, "")
+		Expect(err).To(MatchError(ContainSubstring(`unsafe path "../../evil.js" in archive`)))
+	})
+
+	It("should report a missing source", func() {
+		_, err := impl.OpenSource(filepath.Join(dir, "missing.tar.gz"), "")
+		Expect(err).To(MatchError(fs.ErrNotExist))
+	})
+
+	Context("OCI image layouts", func() {
+		base := []tarEntry{
+			{Name: "etc/os-release", Content: "ubi9"},
+			{Name: "srv/dist/index.html", Content: "v1"},
+			{Name: "srv/dist/old.js", Content: "old"},
+			{Name: "srv/dist/static/stale.css", Content: "stale"},
+		}
+		app := []tarEntry{
+			{Name: "srv/dist/index.html", Content: "v2"},
+			{Name: "srv/dist/.wh.old.js"},
+			{Name: "srv/dist/static/.wh..wh..opq"},
+			{Name: "srv/dist/static/app.css", Content: "app"},
+		}
+
+		It("should apply the layers and their whiteouts", func() {
+			writeLayout(dir, writeImage(dir, "", base, app))
+
+			source, err := impl.OpenSource(dir, "/srv/dist")
+			Expect(err).ToNot(HaveOccurred())
+			defer source.Close()
+			Expect(sourceFiles(source)).To(Equal(map[string]string{
+				"index.html":     "v2",
+				"static/app.css": "app",
+			}))
+		})
+
+		It("should empty the source path when a layer removes a parent", func() {
+			writeLayout(dir, writeImage(dir, "", base, []tarEntry{{Name: ".wh.srv"}, {Name: "srv/dist/new.js", Content: "new"}}))
+
+			source, err := impl.OpenSource(dir, "srv/dist")
+			Expect(err).ToNot(HaveOccurred())
+			defer source.Close()
+			Expect(sourceFiles(source)).To(Equal(map[string]string{"new.js": "new"}))
+		})
+
+		It("should select an image by ref", func() {
+			writeLayout(dir, writeImage(dir, "v1", base), writeImage(dir, "v2", base, app))
+
+			_, err := impl.OpenSource(dir, "srv/dist")
+			Expect(err).To(MatchError(ContainSubstring("image layout holds 2 images, select one with layout:ref")))
+			_, err = impl.OpenSource(dir+":v3", "srv/dist")
+			Expect(err).To(MatchError(ContainSubstring(`no image with ref "v3"`)))
+
+			source, err := impl.OpenSource(dir+":v1", "srv/dist")
+			Expect(err).ToNot(HaveOccurred())
+			defer source.Close()
+			Expect(sourceFiles(source)).To(HaveKeyWithValue("index.html", "v1"))
+		})
+
+		It("should pick an image from a multi-platform index", func() {
+			image := writeImage(dir, "", base, app)
+			image["platform"] = map[string]string{"os": "linux", "architecture": "s390x"}
+			index := writeJSON(map[string]any{"schemaVersion": 2, "manifests": []any{image}})
+			writeLayout(dir, writeBlob(dir, "application/vnd.oci.image.index.v1+json", index, nil))
+
+			source, err := impl.OpenSource(dir, "srv/dist")
+			Expect(err).ToNot(HaveOccurred())
+			defer source.Close()
+			Expect(sourceFiles(source)).To(HaveKeyWithValue("index.html", "v2"))
+		})
+
+		It("should reject blobs that do not match their digest", func() {
+			image := writeImage(dir, "", base)
+			manifest := map[string]any{}
+			raw, err := os.ReadFile(filepath.Join(dir, "blobs", "sha256", image["digest"].(string)[len("sha256:"):]))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(json.Unmarshal(raw, &manifest)).To(Succeed())
+			layer := manifest["layers"].([]any)[0].(map[string]any)
+			layerPath := filepath.Join(dir, "blobs", "sha256", layer["digest"].(string)[len("sha256:"):])
+			Expect(os.WriteFile(layerPath, buildTar([]tarEntry{{Name: "srv/dist/index.html", Content: "tampered"}}, true), 0644)).To(Succeed())
+			writeLayout(dir, image)
+
+			_, err = impl.OpenSource(dir, "srv/dist")
+			Expect(err).To(MatchError(ContainSubstring("has digest")))
+		})
+	})
+})
@@ -0,0 +1,41 @@
+package valkey
+
+import (
+	"context"
+	"io"
+)
+
+// Test-only access to unexported helpers for the external valkey_test package
+
+// ParseLockKey splits a lock key into its namespace and timestamp
+var ParseLockKey = parseLockKey
+
+// ExpiredKeys works out the data versions and manifests retention removes
+var ExpiredKeys = expiredKeys
+
+// FindOrphans works out the data keys gc --orphans removes
+var FindOrphans = findOrphans
+
+// ConflictingLock picks the lock that keeps a populate or gc from starting
+var ConflictingLock = conflictingLock
+
+// GCLockTimestamp is the timestamp of the lock gc holds
+const GCLockTimestamp = gcLockTimestamp
+
+// PopulateFromDir stores every file of a file system under the lock of a release
+var PopulateFromDir = (*Valkey).populateFromDir
+
+// LostLease returns a Valkey whose lock of namespace at timestamp was lost
+// with cause, as a failed renewal leaves it
+func LostLease(namespace string, timestamp int64, cause error) *Valkey {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(cause)
+	return &Valkey{
+		ctx:    context.Background(),
+		leases: map[string]lease{makeLockKey(namespace, timestamp): {ctx: ctx, stop: func() error { return cause }}},
+		out:    io.Discard,
+	}
+}
+
+// ReleaseItems picks the data versions pop serves for a release
+var ReleaseItems = releaseItems
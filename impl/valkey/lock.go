@@ -0,0 +1,267 @@
+package valkey
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	impl "github.com/RedHatInsights/valpop/impl"
+	vkc "github.com/valkey-io/valkey-go"
+)
+
+// Scripts run atomically on the server, so a lock is only changed by the owner
+// whose token it still holds
+var (
+	renewLockScript   = vkc.NewLuaScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) end return 0`)
+	releaseLockScript = vkc.NewLuaScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`)
+	// Only locks without a lease, as written by older valpop, can go stale
+	clearLockScript = vkc.NewLuaScript(`if redis.call("GET", KEYS[1]) == ARGV[1] and redis.call("PTTL", KEYS[1]) == -1 then return redis.call("DEL", KEYS[1]) end return 0`)
+)
+
+// lease is a lock this process holds: the stop of its renewals and the context
+// of the work done under it, which is cancelled once the lock is lost
+type lease struct {
+	ctx  context.Context
+	stop func() error
+}
+
+// gcLockTimestamp is the timestamp of the lock gc holds on a prefix; no
+// release has it, so the lock hides nothing from pop
+const gcLockTimestamp = 0
+
+// StartPopulate marks the release at timestamp as in progress, hiding it from
+// pop, with a lease owned by this process that is renewed until EndPopulate
+// A crashed populate stops renewing, so its lock expires with the lease
+// Populates and gc of a prefix exclude each other, see conflictingLock
+func (v *Valkey) StartPopulate(namespace, bucket string, timestamp int64) error {
+	lockKey := makeLockKey(namespace, timestamp)
+	resp := v.client.Do(v.ctx, v.client.B().Set().Key(lockKey).Value(v.lockOwner).Nx().Px(v.lockLease).Build())
+	if vkc.IsValkeyNil(resp.Error()) {
+		lock, err := v.readLock(lockKey)
+		if errors.Is(err, vkc.Nil) {
+			// Released in between; the release timestamp is taken all the same
+			lock = impl.Lock{Prefix: namespace, Timestamp: timestamp}
+		} else if err != nil {
+			return err
+		}
+		return impl.LockedError(lock)
+	}
+	if resp.Error() != nil {
+		return fmt.Errorf("err from valkey:%w", resp.Error())
+	}
+
+	conflict, err := v.findConflict(namespace, timestamp)
+	if err != nil || conflict != nil {
+		releaseErr := v.runLockScript(releaseLockScript, lockKey, v.lockOwner)
+		if err != nil {
+			return err
+		}
+		if releaseErr != nil {
+			return releaseErr
+		}
+		return impl.LockedError(*conflict)
+	}
+
+	ctx, stop := impl.KeepAlive(v.ctx, v.lockLease/3, func() error {
+		return v.runLockScript(renewLockScript, lockKey, v.lockOwner, strconv.FormatInt(v.lockLease.Milliseconds(), 10))
+	})
+	v.leases[lockKey] = lease{ctx: ctx, stop: stop}
+	fmt.Fprintf(v.out, "%s:%d (in-progress, owner %s)\n", namespace, timestamp, v.lockOwner)
+	return nil
+}
+
+// lockContext is the context for writes under the lock at lockKey: cancelled,
+// with the reason as its cause, once a renewal finds the lock lost
+func (v *Valkey) lockContext(lockKey string) context.Context {
+	if held, exists := v.leases[lockKey]; exists {
+		return held.ctx
+	}
+	return v.ctx
+}
+
+// checkLock returns why the lock at lockKey was lost, or nil while it is held
+// Populates check it before each write that another owner could race
+func (v *Valkey) checkLock(lockKey string) error {
+	return context.Cause(v.lockContext(lockKey))
+}
+
+// findConflict returns the lock in the way of the lock of namespace at
+// timestamp, which this process just set: the gc lock for a populate, any
+// populate lock for gc. Both sides set their own lock before looking for the
+// other, so at least one of two that start together backs off
+func (v *Valkey) findConflict(namespace string, timestamp int64) (*impl.Lock, error) {
+	locks := []impl.Lock{}
+	if timestamp == gcLockTimestamp {
+		all, err := v.Locks(namespace)
+		if err != nil {
+			return nil, err
+		}
+		locks = all
+	} else {
+		lock, err := v.readLock(makeLockKey(namespace, gcLockTimestamp))
+		if err != nil && !errors.Is(err, vkc.Nil) {
+			return nil, err
+		}
+		if err == nil {
+			locks = append(locks, lock)
+		}
+	}
+	return conflictingLock(locks, timestamp, time.Now().Unix()), nil
+}
+
+// conflictingLock returns the first of locks, all of one prefix, that excludes
+// a lock at timestamp at now: a held gc lock excludes populates, and a held
+// populate lock excludes gc. Stale locks never conflict
+func conflictingLock(locks []impl.Lock, timestamp, now int64) *impl.Lock {
+	for _, lock := range locks {
+		if lock.Expired(now) || lock.Timestamp == timestamp {
+			continue
+		}
+		if timestamp == gcLockTimestamp || lock.Timestamp == gcLockTimestamp {
+			return &lock
+		}
+	}
+	return nil
+}
+
+// EndPopulate stops renewing the lease and removes the lock if this process
+// still owns it, making the release visible
+func (v *Valkey) EndPopulate(namespace, bucket string, timestamp int64) error {
+	lockKey := makeLockKey(namespace, timestamp)
+	var renewErr error
+	if held, exists := v.leases[lockKey]; exists {
+		renewErr = held.stop()
+		delete(v.leases, lockKey)
+	}
+
+	err := v.runLockScript(releaseLockScript, lockKey, v.lockOwner)
+	if err != nil {
+		return err
+	}
+	if renewErr != nil {
+		return renewErr
+	}
+	fmt.Fprintf(v.out, "%s:%d (removed)\n", namespace, timestamp)
+	return nil
+}
+
+// runLockScript runs an owner-checked script on lockKey; a result of 0 means
+// the lock expired or is owned by someone else
+func (v *Valkey) runLockScript(script *vkc.Lua, lockKey string, args ...string) error {
+	changed, err := script.Exec(v.ctx, v.client, []string{lockKey}, args).AsInt64()
+	if err != nil {
+		return fmt.Errorf("err from valkey:%w", err)
+	}
+	if changed == 0 {
+		return fmt.Errorf("lock %s was lost: the lease expired, raise --lock-lease", lockKey)
+	}
+	return nil
+}
+
+// readLock returns the owner and lease of the lock at lockKey
+func (v *Valkey) readLock(lockKey string) (impl.Lock, error) {
+	namespace, timestamp, ok := parseLockKey(lockKey)
+	if !ok {
+		return impl.Lock{}, fmt.Errorf("invalid lock key %s", lockKey)
+	}
+
+	owner, err := v.client.Do(v.ctx, v.client.B().Get().Key(lockKey).Build()).ToString()
+	if err != nil {
+		return impl.Lock{}, fmt.Errorf("err from valkey:%w", err)
+	}
+	ttl, err := v.client.Do(v.ctx, v.client.B().Pttl().Key(lockKey).Build()).AsInt64()
+	if err != nil {
+		return impl.Lock{}, fmt.Errorf("err from valkey:%w", err)
+	}
+
+	lock := impl.Lock{Prefix: namespace, Timestamp: timestamp, Owner: owner}
+	if ttl > 0 {
+		lock.Expires = time.Now().Add(time.Duration(ttl) * time.Millisecond).Unix()
+	}
+	return lock, nil
+}
+
+// parseLockKey splits lock:{namespace}:{timestamp}; the namespace may contain ':'
+func parseLockKey(key string) (string, int64, bool) {
+	rest := strings.TrimPrefix(key, "lock:")
+	separator := strings.LastIndex(rest, ":")
+	if separator <= 0 {
+		return "", 0, false
+	}
+	timestamp, err := strconv.ParseInt(rest[separator+1:], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return rest[:separator], timestamp, true
+}
+
+// Locks returns the populate locks of prefix, or of every prefix when it is empty
+func (v *Valkey) Locks(prefix string) ([]impl.Lock, error) {
+	match := "lock:*"
+	if prefix != "" {
+		match = fmt.Sprintf("lock:%s:*", prefix)
+	}
+
+	locks := []impl.Lock{}
+	cursor := uint64(0)
+	for {
+		resp := v.client.Do(v.ctx, v.client.B().Scan().Cursor(cursor).Match(match).Build())
+		if resp.Error() != nil {
+			return nil, fmt.Errorf("err from valkey:%w", resp.Error())
+		}
+
+		scan, err := resp.AsScanEntry()
+		if err != nil {
+			return nil, fmt.Errorf("scan decode error:%w", err)
+		}
+
+		for _, key := range scan.Elements {
+			namespace, _, ok := parseLockKey(key)
+			// Only exact matches; a prefix of "app" must not pick up "app:admin"
+			if !ok || (prefix != "" && namespace != prefix) {
+				continue
+			}
+			lock, err := v.readLock(key)
+			if errors.Is(err, vkc.Nil) {
+				// Released since the scan
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			locks = append(locks, lock)
+		}
+
+		if scan.Cursor == 0 {
+			break
+		}
+		cursor = scan.Cursor
+	}
+
+	slices.SortFunc(locks, func(a, b impl.Lock) int {
+		if a.Prefix != b.Prefix {
+			return strings.Compare(a.Prefix, b.Prefix)
+		}
+		return int(a.Timestamp - b.Timestamp)
+	})
+	return locks, nil
+}
+
+// ClearLock removes a stale lock, one without a lease, after checking it still
+// has the listed owner
+func (v *Valkey) ClearLock(lock impl.Lock) error {
+	lockKey := makeLockKey(lock.Prefix, lock.Timestamp)
+	cleared, err := clearLockScript.Exec(v.ctx, v.client, []string{lockKey}, []string{lock.Owner}).AsInt64()
+	if err != nil {
+		return fmt.Errorf("err from valkey:%w", err)
+	}
+	if cleared == 0 {
+		return fmt.Errorf("lock %s is no longer stale", lock)
+	}
+	fmt.Fprintf(v.out, "Cleared lock %s\n", lock)
+	return nil
+}
@@ -1,11 +1,14 @@
 package valkey
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/fs"
+	"maps"
 	"os"
-	fp "path/filepath"
 	"slices"
 	"strconv"
 	"strings"
@@ -16,8 +19,50 @@ import (
 )
 
 type Valkey struct {
-	ctx    context.Context
-	client vkc.Client
+	ctx       context.Context
+	client    vkc.Client
+	lockOwner string
+	lockLease time.Duration
+	// leases are the locks held by this process, by lock key
+	leases map[string]lease
+	// protected are the glob patterns of files whose newest version cleanup keeps
+	protected []string
+	// contentTypes resolves the Content-Type recorded for populated files
+	contentTypes impl.ContentTypes
+	// out receives progress messages
+	out io.Writer
+}
+
+// Compile-time check that Valkey satisfies the shared storage interface
+var _ impl.Backend = (*Valkey)(nil)
+
+func init() {
+	impl.Register(impl.Factory{
+		Name:        "valkey",
+		Description: "Valkey/Redis key-value store",
+		Validate: func(cfg impl.Config) error {
+			_, err := impl.ContentTypesFromConfig(cfg)
+			if err != nil {
+				return err
+			}
+			return impl.ValidateProtected(impl.ProtectedPatterns(cfg))
+		},
+		New: func(cfg impl.Config) (impl.Backend, error) {
+			client, err := NewValkey(impl.Address(cfg))
+			if err != nil {
+				return nil, err
+			}
+			if lease := cfg.GetInt64("lock-lease"); lease > 0 {
+				client.lockLease = time.Duration(lease) * time.Second
+			}
+			client.protected = impl.ProtectedPatterns(cfg)
+			client.contentTypes, err = impl.ContentTypesFromConfig(cfg)
+			if err != nil {
+				return nil, err
+			}
+			return &client, nil
+		},
+	})
 }
 
 func NewValkey(addr string) (Valkey, error) {
@@ -26,15 +71,29 @@ func NewValkey(addr string) (Valkey, error) {
 		panic(err)
 	}
 	return Valkey{
-		ctx:    context.Background(),
-		client: client,
+		ctx:       context.Background(),
+		client:    client,
+		lockOwner: impl.NewLockOwner(),
+		lockLease: impl.DefaultLockLease,
+		leases:    map[string]lease{},
+		protected: impl.DefaultProtectedFiles,
+		out:       os.Stdout,
 	}, nil
 }
 
+// SetOutput sends progress messages to w instead of stdout
+func (v *Valkey) SetOutput(w io.Writer) {
+	v.out = w
+}
+
 func makeDataKey(namespace, filepath string, timestamp int64) string {
 	return fmt.Sprintf("data:%s:%d:%s", namespace, timestamp, filepath)
 }
 
+func makeManifestKey(namespace string, timestamp int64) string {
+	return fmt.Sprintf("manifest:%s:%d", namespace, timestamp)
+}
+
 func makeLockKey(namespace string, timestamp int64) string {
 	return fmt.Sprintf("lock:%s:%d", namespace, timestamp)
 }
@@ -43,40 +102,34 @@ func (v *Valkey) Close() {
 	v.client.Close()
 }
 
-func (v *Valkey) StartPopulate(namespace string, timestamp int64) error {
-	lockKey := makeLockKey(namespace, timestamp)
-	err := v.client.Do(v.ctx, v.client.B().Set().Key(lockKey).Value("in-progress").Build()).Error()
-	if err != nil {
-		return fmt.Errorf("err from valkey:%w", err)
-	}
-	fmt.Printf("%s:%d (in-progress)\n", namespace, timestamp)
-	return nil
-}
+// SetItem stores contents under a timestamped key; Valkey has no use for the
+// content type or bucket, they are accepted to satisfy impl.Implementation
+func (v *Valkey) SetItem(namespace, filepath, contentType, bucket string, timestamp int64, contents string) error {
+	key := makeDataKey(namespace, filepath, timestamp)
+
+	fmt.Fprintf(v.out, "%s: %s (%d)\n", filepath, key, len(contents))
 
-func (v *Valkey) EndPopulate(namespace string, timestamp int64) error {
-	lockKey := makeLockKey(namespace, timestamp)
-	err := v.client.Do(v.ctx, v.client.B().Del().Key(lockKey).Build()).Error()
+	err := v.client.Do(v.ctx, v.client.B().Set().Key(key).Value(string(contents)).Build()).Error()
 	if err != nil {
 		return fmt.Errorf("err from valkey:%w", err)
 	}
-	fmt.Printf("%s:%d (removed)\n", namespace, timestamp)
 	return nil
 }
 
-func (v *Valkey) SetItem(namespace, filepath string, timestamp int64, contents string) error {
-	key := makeDataKey(namespace, filepath, timestamp)
-
-	fmt.Printf("%s: %s (%d)\n", filepath, key, len(contents))
-
-	err := v.client.Do(v.ctx, v.client.B().Set().Key(key).Value(string(contents)).Build()).Error()
+// PutItem stores size bytes read from r; Valkey values live in memory, so the
+// contents are read in full before the SET
+func (v *Valkey) PutItem(namespace, filepath, contentType, bucket string, timestamp int64, r io.Reader, size int64) error {
+	contents, err := io.ReadAll(io.LimitReader(r, size))
 	if err != nil {
-		return fmt.Errorf("err from valkey:%w", err)
+		return fmt.Errorf("could not read %s: %w", filepath, err)
 	}
-	return nil
+	return v.SetItem(namespace, filepath, contentType, bucket, timestamp, string(contents))
 }
 
 func (v *Valkey) GetKeys(namespace string) (impl.AllItems, error) {
 	cacheList := impl.AllItems{namespace: impl.Items{}}
+	// Every file of a release shares its lock, so check each timestamp once
+	locked := map[int64]bool{}
 	cursor := uint64(0)
 	for {
 		resp := v.client.Do(v.ctx, v.client.B().Scan().Cursor(cursor).Match("data:"+namespace+":*").Build())
@@ -96,14 +149,17 @@ func (v *Valkey) GetKeys(namespace string) (impl.AllItems, error) {
 				return make(impl.AllItems), err
 			}
 
-			lockKey := makeLockKey(namespace, int64(timeStamp))
-			inProgress, err := v.isInProgress(lockKey)
+			inProgress, checked := locked[int64(timeStamp)]
+			if !checked {
+				inProgress, err = v.isInProgress(makeLockKey(namespace, int64(timeStamp)))
+				if err != nil {
+					return make(impl.AllItems), err
+				}
+				locked[int64(timeStamp)] = inProgress
+			}
 			if inProgress {
 				continue
 			}
-			if err != nil {
-				return make(impl.AllItems), err
-			}
 
 			cacheList[namespace][elems[2]] = append(cacheList[namespace][elems[2]], int64(timeStamp))
 		}
@@ -116,16 +172,14 @@ func (v *Valkey) GetKeys(namespace string) (impl.AllItems, error) {
 	return cacheList, nil
 }
 
+// isInProgress reports whether a populate holds the lock of a release; the
+// lock holds its owner, or "in-progress" when written by older valpop
 func (v *Valkey) isInProgress(lockKey string) (bool, error) {
-	resp := v.client.Do(v.ctx, v.client.B().Get().Key(lockKey).Build())
-	if resp.Error() != nil {
-		return false, nil
-	}
-	data, err := resp.ToString()
+	exists, err := v.client.Do(v.ctx, v.client.B().Exists().Key(lockKey).Build()).AsInt64()
 	if err != nil {
-		return false, err
+		return false, fmt.Errorf("err from valkey:%w", err)
 	}
-	return data == "in-progress", nil
+	return exists == 1, nil
 }
 
 func (v *Valkey) GetItem(namespace, filepath string, timestamp int64) (string, error) {
@@ -142,7 +196,7 @@ func (v *Valkey) GetItem(namespace, filepath string, timestamp int64) (string, e
 }
 
 func (v *Valkey) DelKeys(allitems impl.AllItems) error {
-	fmt.Printf("Deleting %d keys", len(impl.AllItems{}))
+	fmt.Fprintf(v.out, "Deleting %d keys", len(impl.AllItems{}))
 	keys := []string{}
 	for namespace, items := range allitems {
 		for filepath, timestamps := range items {
@@ -151,89 +205,376 @@ func (v *Valkey) DelKeys(allitems impl.AllItems) error {
 			}
 		}
 	}
+	// DEL needs at least one key
+	if len(keys) == 0 {
+		return nil
+	}
 
 	return v.client.Do(v.ctx, v.client.B().Del().Key(keys...).Build()).Error()
 }
 
-func PopFn(addr, dest string) error {
-	fmt.Println("Invoking pop...")
-	client, err := NewValkey(addr)
+// PopFn writes every file of the latest release in prefix into dest
+func (v *Valkey) PopFn(prefix, dest string) error {
+	return v.PopTo(prefix, impl.DirTarget(dest))
+}
+
+// PopTo hands every file of the latest release in prefix to target, sorted by
+// path; every file carries the timestamp of the newest populate as its release
+func (v *Valkey) PopTo(prefix string, target impl.PopTarget) error {
+	fmt.Fprintln(v.out, "Invoking pop...")
+
+	allKeys, err := v.Pop(prefix, 0)
 	if err != nil {
 		return err
 	}
 
-	defer client.Close()
+	release := int64(0)
+	for _, stamps := range allKeys[prefix] {
+		release = max(release, stamps[0])
+	}
+	for _, filepath := range slices.Sorted(maps.Keys(allKeys[prefix])) {
+		contents, err := v.GetItem(prefix, filepath, allKeys[prefix][filepath][0])
+		if err != nil {
+			return err
+		}
 
-	allKeys, err := client.GetKeys("")
-	if err != nil {
-		return err
+		file := impl.PoppedFile{Path: filepath, Size: int64(len(contents)), Timestamp: release}
+		err = target.WriteFile(file, strings.NewReader(contents))
+		if err != nil {
+			return fmt.Errorf("could not pop %s: %w", filepath, err)
+		}
+		fmt.Fprintf(v.out, "Popped: %s\n", filepath)
 	}
+	return nil
+}
 
-	for prefix, fileitems := range allKeys {
-		for filepath, stamps := range fileitems {
-			slices.Sort(stamps)
-			contents, err := client.GetItem(prefix, filepath, stamps[0])
-			if err != nil {
-				return err
-			}
-			writeFile(dest, filepath, contents)
+// PopulateFromDir stores every file under basepath with the given timestamp
+func (v *Valkey) PopulateFromDir(namespace, bucket, basepath string, timestamp int64) error {
+	_, err := v.populateFromDir(namespace, bucket, os.DirFS(basepath), timestamp, impl.PrecompressOptions{})
+	return err
+}
+
+// populateFromDir stores every file of fileSystem, then the variants
+// precompress selects, which pop writes next to their files
+func (v *Valkey) populateFromDir(namespace, bucket string, fileSystem fs.FS, timestamp int64, precompress impl.PrecompressOptions) ([]impl.FileInfo, error) {
+	ctx := v.lockContext(makeLockKey(namespace, timestamp))
+	store := func(file impl.FileInfo) error {
+		// Another owner may hold the lock by now, nothing more is written
+		if err := context.Cause(ctx); err != nil {
+			return err
 		}
+		return v.PutItem(namespace, file.Path, file.ContentType, bucket, timestamp, file.Reader, file.Size)
+	}
+
+	files, _, err := impl.ProcessFilesWithTypes(fileSystem, 1, v.contentTypes, store)
+	if err != nil || len(precompress.Encodings) == 0 {
+		return files, err
+	}
+	variants, _, err := impl.ProcessVariants(fileSystem, files, precompress, 1, store)
+	return append(files, variants...), err
+}
+
+// SetManifest stores the manifest of a populate run next to its data keys
+func (v *Valkey) SetManifest(namespace string, timestamp int64, manifest impl.Manifest) error {
+	raw, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("could not encode manifest:%w", err)
+	}
+
+	key := makeManifestKey(namespace, timestamp)
+	fmt.Fprintf(v.out, "manifest %s: %d files, image: %s, timestamp: %d\n", key, len(manifest.Files), manifest.Image, manifest.Timestamp)
+	err = v.client.Do(v.ctx, v.client.B().Set().Key(key).Value(string(raw)).Build()).Error()
+	if err != nil {
+		return fmt.Errorf("err from valkey:%w", err)
 	}
 	return nil
 }
 
-func writeFile(root, filepath, contents string) {
-	path := fp.Join(root, filepath)
-	dir, filename := fp.Split(path)
-	fmt.Printf("%s - %s\n", dir, filename)
-	os.MkdirAll(dir, os.ModePerm)
-	os.WriteFile(path, []byte(contents), 0664)
+// GetManifest reads the manifest written by the populate run at timestamp
+func (v *Valkey) GetManifest(namespace string, timestamp int64) (impl.Manifest, error) {
+	resp := v.client.Do(v.ctx, v.client.B().Get().Key(makeManifestKey(namespace, timestamp)).Build())
+	if resp.Error() != nil {
+		return impl.Manifest{}, fmt.Errorf("err from valkey:%w", resp.Error())
+	}
+	raw, err := resp.AsBytes()
+	if err != nil {
+		return impl.Manifest{}, fmt.Errorf("err from valkey:%w", err)
+	}
+	return impl.ParseManifest(raw)
 }
 
-func (v *Valkey) PopulateFn(addr, source, prefix, image, valpopImage string, timeout int64, minAssetRecords int64, cacheMaxAge int64) error {
-	currentTime := time.Now().Unix()
+// Verify checks every file of the manifest at timestamp, or of the newest
+// manifest when timestamp is 0, against the stored data keys
+func (v *Valkey) Verify(prefix string, timestamp int64) (impl.VerifyReport, error) {
+	if timestamp == 0 {
+		stamps, err := v.ManifestTimestamps(prefix)
+		if err != nil {
+			return impl.VerifyReport{}, err
+		}
+		if len(stamps) == 0 {
+			return impl.VerifyReport{}, fmt.Errorf("no manifests found for %s", prefix)
+		}
+		timestamp = stamps[len(stamps)-1]
+	}
+
+	manifest, err := v.GetManifest(prefix, timestamp)
+	if err != nil {
+		return impl.VerifyReport{}, fmt.Errorf("could not get manifest for %s: %w", prefix, err)
+	}
+
+	return impl.VerifyManifest(prefix, manifest, func(entry impl.FileEntry) (impl.StoredObject, bool, error) {
+		resp := v.client.Do(v.ctx, v.client.B().Get().Key(makeDataKey(prefix, entry.Path, timestamp)).Build())
+		if vkc.IsValkeyNil(resp.Error()) {
+			return impl.StoredObject{}, false, nil
+		}
+		contents, err := resp.AsBytes()
+		if err != nil {
+			return impl.StoredObject{}, false, fmt.Errorf("err from valkey:%w", err)
+		}
 
-	fileSystem := os.DirFS(source)
-	v.StartPopulate(prefix, currentTime)
-	err := fs.WalkDir(fileSystem, ".", func(path string, d fs.DirEntry, err error) error {
-		return dumpFile(v, fileSystem, prefix, path, d, fmt.Sprintf("%d", currentTime), err)
+		hash, err := impl.HashContent(bytes.NewReader(contents))
+		if err != nil {
+			return impl.StoredObject{}, false, err
+		}
+		return impl.StoredObject{Size: int64(len(contents)), SHA256: hash}, true, nil
 	})
+}
+
+// Prefixes returns every prefix with at least one stored manifest
+func (v *Valkey) Prefixes() ([]string, error) {
+	prefixes := []string{}
+	cursor := uint64(0)
+	for {
+		resp := v.client.Do(v.ctx, v.client.B().Scan().Cursor(cursor).Match("manifest:*").Build())
+		if resp.Error() != nil {
+			return nil, fmt.Errorf("err from valkey:%w", resp.Error())
+		}
+
+		scan, err := resp.AsScanEntry()
+		if err != nil {
+			return nil, fmt.Errorf("scan decode error:%w", err)
+		}
+
+		for _, key := range scan.Elements {
+			// manifest:{prefix}:{timestamp}, the prefix may itself contain ':'
+			rest := strings.TrimPrefix(key, "manifest:")
+			separator := strings.LastIndex(rest, ":")
+			if separator <= 0 {
+				continue
+			}
+			prefix := rest[:separator]
+			if !slices.Contains(prefixes, prefix) {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+
+		if scan.Cursor == 0 {
+			break
+		}
+		cursor = scan.Cursor
+	}
+	slices.Sort(prefixes)
+	return prefixes, nil
+}
+
+// Manifests reads every manifest stored for prefix
+func (v *Valkey) Manifests(prefix string) ([]impl.Manifest, error) {
+	stamps, err := v.ManifestTimestamps(prefix)
 	if err != nil {
-		fmt.Printf("%v", err)
+		return nil, err
 	}
-	v.EndPopulate(prefix, currentTime)
-	cleanupCache(v, prefix, timeout, minAssetRecords)
-	return nil
+
+	manifests := []impl.Manifest{}
+	for _, stamp := range stamps {
+		manifest, err := v.GetManifest(prefix, stamp)
+		if err != nil {
+			return nil, fmt.Errorf("could not get manifest %d: %w", stamp, err)
+		}
+		manifests = append(manifests, manifest)
+	}
+	return manifests, nil
+}
+
+// Current always returns 0: Valkey keeps no current pointer and pop serves
+// the newest release
+func (v *Valkey) Current(prefix string) (int64, error) {
+	return 0, nil
 }
 
-func dumpFile(client *Valkey, fileSystem fs.FS, prefix, path string, d fs.DirEntry, timestamp string, err error) error {
+// ManifestTimestamps returns the timestamps of every manifest stored for namespace
+func (v *Valkey) ManifestTimestamps(namespace string) ([]int64, error) {
+	stamps := []int64{}
+	keyPrefix := fmt.Sprintf("manifest:%s:", namespace)
+
+	cursor := uint64(0)
+	for {
+		resp := v.client.Do(v.ctx, v.client.B().Scan().Cursor(cursor).Match(keyPrefix+"*").Build())
+		if resp.Error() != nil {
+			return nil, fmt.Errorf("err from valkey:%w", resp.Error())
+		}
+
+		scan, err := resp.AsScanEntry()
+		if err != nil {
+			return nil, fmt.Errorf("scan decode error:%w", err)
+		}
+
+		for _, key := range scan.Elements {
+			stamp, err := strconv.ParseInt(strings.TrimPrefix(key, keyPrefix), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("could not get timestamp: %w", err)
+			}
+			stamps = append(stamps, stamp)
+		}
+
+		if scan.Cursor == 0 {
+			break
+		}
+		cursor = scan.Cursor
+	}
+	slices.Sort(stamps)
+	return stamps, nil
+}
+
+// Pop returns, for each file the served release lists, the newest timestamp at
+// or before it. The served release is the newest manifest at or before
+// timestamp, or the newest manifest when timestamp is 0, so files a rollback
+// left out are not served. Releases newer than it were left by a failed or
+// crashed populate once its lock was released or expired, and are skipped
+// Without any manifest the newest version of every file is served
+func (v *Valkey) Pop(namespace string, timestamp int64) (impl.AllItems, error) {
+	allKeys, err := v.GetKeys(namespace)
+	if err != nil {
+		return impl.AllItems{}, err
+	}
+	manifests, err := v.ManifestTimestamps(namespace)
 	if err != nil {
-		fmt.Printf("WE GOT AN ERR %v", err)
+		return impl.AllItems{}, err
 	}
 
-	if d.IsDir() {
-		return nil
+	limit := timestamp
+	var files []string
+	for _, stamp := range slices.Backward(manifests) {
+		if timestamp != 0 && stamp > timestamp {
+			continue
+		}
+		manifest, err := v.GetManifest(namespace, stamp)
+		if err != nil {
+			return impl.AllItems{}, fmt.Errorf("could not get manifest for %s: %w", namespace, err)
+		}
+		limit, files = stamp, manifest.Files
+		break
 	}
+	return impl.AllItems{namespace: releaseItems(allKeys[namespace], limit, files)}, nil
+}
+
+// releaseItems picks, for each file of keys that files lists, its newest
+// timestamp at or before limit; a nil files lists every file and a limit of 0
+// takes the newest timestamp
+func releaseItems(keys impl.Items, limit int64, files []string) impl.Items {
+	listed := map[string]bool{}
+	for _, file := range files {
+		listed[file] = true
+	}
+
+	items := impl.Items{}
+	for filepath, stamps := range keys {
+		if files != nil && !listed[filepath] {
+			continue
+		}
+		var newest int64
+		for _, stamp := range stamps {
+			if (limit == 0 || stamp <= limit) && stamp > newest {
+				newest = stamp
+			}
+		}
+		if newest != 0 {
+			items[filepath] = []int64{newest}
+		}
+	}
+	return items
+}
 
-	contents, err := fs.ReadFile(fileSystem, path)
+// Rollback copies the data keys of target to timestamp and records a new
+// manifest there. Pop only serves the files the newest manifest lists, so files
+// added after target are no longer served
+func (v *Valkey) Rollback(prefix string, target impl.Manifest, timestamp int64) (restored impl.Manifest, err error) {
+	for _, file := range target.Files {
+		resp := v.client.Do(v.ctx, v.client.B().Exists().Key(makeDataKey(prefix, file, target.Timestamp)).Build())
+		exists, err := resp.AsInt64()
+		if err != nil {
+			return impl.Manifest{}, fmt.Errorf("err from valkey:%w", err)
+		}
+		if exists == 0 {
+			return impl.Manifest{}, fmt.Errorf("cannot restore %s: release %d no longer stores it", file, target.Timestamp)
+		}
+	}
+
+	// The lock hides the half-copied release from pop, as during populate
+	err = v.StartPopulate(prefix, "", timestamp)
 	if err != nil {
-		return err
+		return impl.Manifest{}, err
 	}
+	defer func() {
+		endErr := v.EndPopulate(prefix, "", timestamp)
+		if err == nil && endErr != nil {
+			restored, err = impl.Manifest{}, endErr
+		}
+	}()
 
-	key := fmt.Sprintf("%s:%s:%s", prefix, timestamp, path)
+	lockKey := makeLockKey(prefix, timestamp)
+	for _, file := range target.Files {
+		err := v.checkLock(lockKey)
+		if err != nil {
+			return impl.Manifest{}, err
+		}
+		source, destination := makeDataKey(prefix, file, target.Timestamp), makeDataKey(prefix, file, timestamp)
+		err = v.client.Do(v.ctx, v.client.B().Copy().Source(source).Destination(destination).Replace().Build()).Error()
+		if err != nil {
+			return impl.Manifest{}, fmt.Errorf("could not restore %s: err from valkey:%w", file, err)
+		}
+		fmt.Fprintf(v.out, "Restored: %s\n", file)
+	}
 
-	fmt.Printf("%s: %s (%d)\n", path, key, len(contents))
+	restored = target
+	restored.Timestamp = timestamp
+	restored.RolledBackFrom = target.Timestamp
+	err = v.checkLock(lockKey)
+	if err != nil {
+		return impl.Manifest{}, err
+	}
+	err = v.SetManifest(prefix, timestamp, restored)
+	if err != nil {
+		return impl.Manifest{}, err
+	}
+	return restored, nil
+}
 
-	timestampAsInt, err := strconv.Atoi(timestamp)
+func (v *Valkey) PopulateFn(opts impl.PopulateOptions) error {
+	currentTime := time.Now().Unix()
+	prefix := opts.Prefix
+
+	err := v.StartPopulate(prefix, "", currentTime)
 	if err != nil {
 		return err
 	}
-	err = client.SetItem(prefix, path, int64(timestampAsInt), string(contents))
+	files, err := v.populateFromDir(prefix, "", impl.FilterFS(opts.SourceFS(), opts.Filter), currentTime, opts.Precompress)
+	if err == nil {
+		err = v.checkLock(makeLockKey(prefix, currentTime))
+	}
+	if err == nil {
+		err = v.SetManifest(prefix, currentTime, impl.NewManifest(files, opts.Image, opts.ValpopImage, currentTime, nil))
+	}
+	// Release the lock even after a failure, a failed release has no manifest
+	// and is skipped by pop. EndPopulate fails once the lease was lost, so
+	// cleanup only runs for a release populated under the lock
+	endErr := v.EndPopulate(prefix, "", currentTime)
 	if err != nil {
-		return fmt.Errorf("err from valkey:%w", err)
+		return err
 	}
-
-	return nil
+	if endErr != nil {
+		return endErr
+	}
+	return cleanupCache(v, prefix, opts.Timeout, opts.MinAssetRecords)
 }
 
 func cleanupCache(client *Valkey, prefix string, timeout int64, minAssetRecords int64) error {
@@ -242,6 +583,39 @@ func cleanupCache(client *Valkey, prefix string, timeout int64, minAssetRecords
 	if err != nil {
 		return err
 	}
+	stamps, err := client.ManifestTimestamps(prefix)
+	if err != nil {
+		return err
+	}
+
+	deleteItems, manifests := expiredKeys(prefix, cacheList, stamps, client.protected, time.Now().Unix(), timeout, minAssetRecords)
+	for filename, stamps := range deleteItems[prefix] {
+		for _, timestamp := range stamps {
+			fmt.Fprintf(client.out, "del: %s:%d\n", filename, timestamp)
+		}
+	}
+
+	fmt.Fprintf(client.out, "%v", deleteItems)
+	err = client.DelKeys(deleteItems)
+	if err != nil {
+		return fmt.Errorf("err from valkey:%w", err)
+	}
+
+	for _, manifest := range manifests {
+		err = client.client.Do(client.ctx, client.client.B().Del().Key(manifest.Key).Build()).Error()
+		if err != nil {
+			return fmt.Errorf("err from valkey:%w", err)
+		}
+		fmt.Fprintf(client.out, "Removed manifest %s\n", manifest.Key)
+	}
+	return nil
+}
+
+// expiredKeys returns the data versions and manifests of prefix that the
+// retention policy expires at currentTime. Every file keeps its newest
+// minAssetRecords versions, files matching a protected pattern keep at least
+// their newest, and manifests follow the same retention as the data they describe
+func expiredKeys(prefix string, cacheList impl.AllItems, manifestStamps []int64, protected []string, currentTime, timeout, minAssetRecords int64) (impl.AllItems, []impl.ManifestInfo) {
 	deleteItems := make(impl.AllItems)
 	deleteItems[prefix] = make(impl.Items)
 
@@ -252,6 +626,9 @@ func cleanupCache(client *Valkey, prefix string, timeout int64, minAssetRecords
 
 		// Determine how many versions to keep for this file
 		keepCount := minAssetRecords
+		if keepCount < 1 && impl.IsProtected(filename, protected) {
+			keepCount = 1
+		}
 		if keepCount > int64(len(stamps)) {
 			keepCount = int64(len(stamps))
 		}
@@ -260,17 +637,216 @@ func cleanupCache(client *Valkey, prefix string, timeout int64, minAssetRecords
 		for i := int(keepCount); i < len(stamps); i++ {
 			timestamp := stamps[i]
 			// Only delete if it's also older than the timeout
-			if time.Now().Unix()-timestamp > timeout {
-				fmt.Printf("del: %s:%d\n", filename, timestamp)
+			if currentTime-timestamp > timeout {
 				deleteItems[prefix][filename] = append(deleteItems[prefix][filename], timestamp)
 			}
 		}
 	}
 
-	fmt.Printf("%v", deleteItems)
-	err = client.DelKeys(deleteItems)
+	manifests := []impl.ManifestInfo{}
+	for _, stamp := range manifestStamps {
+		manifests = append(manifests, impl.ManifestInfo{Key: makeManifestKey(prefix, stamp), Timestamp: stamp})
+	}
+	return deleteItems, impl.DetermineManifestsToDelete(manifests, currentTime, timeout, minAssetRecords)
+}
+
+// GC removes the data versions and manifests of prefix that the retention
+// policy expires, as the cleanup after a populate does; a dry run only reports
+// them. It fails with impl.ErrLocked while a populate of prefix runs, and
+// holds the gc lock of prefix so no populate starts until it is done
+func (v *Valkey) GC(prefix string, opts impl.GCOptions) (result impl.GCResult, err error) {
+	if !opts.DryRun {
+		err = v.StartPopulate(prefix, "", gcLockTimestamp)
+		if err != nil {
+			return impl.GCResult{}, err
+		}
+		defer func() {
+			endErr := v.EndPopulate(prefix, "", gcLockTimestamp)
+			if err == nil && endErr != nil {
+				result, err = impl.GCResult{}, endErr
+			}
+		}()
+	}
+
+	cacheList, err := v.GetKeys(prefix)
 	if err != nil {
-		return fmt.Errorf("err from valkey:%w", err)
+		return impl.GCResult{}, err
 	}
-	return nil
+	stamps, err := v.ManifestTimestamps(prefix)
+	if err != nil {
+		return impl.GCResult{}, err
+	}
+
+	currentTime := time.Now().Unix()
+	deleteItems, manifests := expiredKeys(prefix, cacheList, stamps, v.protected, currentTime, opts.Timeout, opts.MinAssetRecords)
+	dataKeys, manifestKeys := []string{}, []string{}
+	for _, filename := range slices.Sorted(maps.Keys(deleteItems[prefix])) {
+		for _, timestamp := range deleteItems[prefix][filename] {
+			dataKeys = append(dataKeys, makeDataKey(prefix, filename, timestamp))
+		}
+	}
+	for _, manifest := range manifests {
+		manifestKeys = append(manifestKeys, manifest.Key)
+	}
+
+	// Without any manifest every data key would look unreferenced
+	orphans := []impl.StoredKey{}
+	if opts.Orphans && len(stamps) > 0 {
+		orphans, err = v.orphanKeys(prefix, cacheList, stamps, append(dataKeys, manifestKeys...), currentTime, opts.OrphanGrace)
+		if err != nil {
+			return impl.GCResult{}, err
+		}
+	}
+
+	result = impl.NewGCResult(prefix, opts.DryRun)
+	keys := []string{}
+	for _, key := range dataKeys {
+		size, err := v.keySize(key)
+		if err != nil {
+			return impl.GCResult{}, err
+		}
+		result.Add(key, size)
+		keys = append(keys, key)
+	}
+	for _, orphan := range orphans {
+		size, err := v.keySize(orphan.Key)
+		if err != nil {
+			return impl.GCResult{}, err
+		}
+		result.AddOrphan(orphan.Key, size)
+		keys = append(keys, orphan.Key)
+	}
+	for _, key := range manifestKeys {
+		size, err := v.keySize(key)
+		if err != nil {
+			return impl.GCResult{}, err
+		}
+		result.Add(key, size)
+		keys = append(keys, key)
+	}
+	if opts.DryRun || len(keys) == 0 {
+		return result, nil
+	}
+
+	err = result.CheckCap(opts.MaxDeletions)
+	if err != nil {
+		return impl.GCResult{}, err
+	}
+	err = v.checkLock(makeLockKey(prefix, gcLockTimestamp))
+	if err != nil {
+		return impl.GCResult{}, err
+	}
+	err = v.client.Do(v.ctx, v.client.B().Del().Key(keys...).Build()).Error()
+	if err != nil {
+		return impl.GCResult{}, fmt.Errorf("err from valkey:%w", err)
+	}
+	return result, nil
+}
+
+// keySize returns the length of the value stored at key
+func (v *Valkey) keySize(key string) (int64, error) {
+	size, err := v.client.Do(v.ctx, v.client.B().Strlen().Key(key).Build()).AsInt64()
+	if err != nil {
+		return 0, fmt.Errorf("err from valkey:%w", err)
+	}
+	return size, nil
+}
+
+// orphanKeys returns the data keys of prefix that no kept manifest lists, such
+// as those of a crashed populate, and that are older than grace. deleting are
+// the keys gc already removes, whose manifests are not kept
+func (v *Valkey) orphanKeys(prefix string, cacheList impl.AllItems, stamps []int64, deleting []string, currentTime, grace int64) ([]impl.StoredKey, error) {
+	kept := map[int64][]string{}
+	for _, stamp := range stamps {
+		if slices.Contains(deleting, makeManifestKey(prefix, stamp)) {
+			continue
+		}
+		manifest, err := v.GetManifest(prefix, stamp)
+		if err != nil {
+			return nil, fmt.Errorf("could not get manifest %d: %w", stamp, err)
+		}
+		kept[stamp] = manifest.Files
+	}
+	return findOrphans(prefix, cacheList, kept, deleting, v.protected, currentTime, grace), nil
+}
+
+// findOrphans returns the data keys of cacheList that neither a kept manifest,
+// by timestamp, lists nor deleting holds, and that are older than grace. A data
+// key is as old as its release timestamp; protected files are left to retention
+func findOrphans(prefix string, cacheList impl.AllItems, kept map[int64][]string, deleting, protected []string, currentTime, grace int64) []impl.StoredKey {
+	referenced := map[string]bool{}
+	for _, key := range deleting {
+		referenced[key] = true
+	}
+	for stamp, files := range kept {
+		for _, file := range files {
+			referenced[makeDataKey(prefix, file, stamp)] = true
+		}
+	}
+
+	stored := []impl.StoredKey{}
+	for filename, timestamps := range cacheList[prefix] {
+		if impl.IsProtected(filename, protected) {
+			continue
+		}
+		for _, timestamp := range timestamps {
+			stored = append(stored, impl.StoredKey{Key: makeDataKey(prefix, filename, timestamp), Modified: timestamp})
+		}
+	}
+	return impl.DetermineOrphans(stored, referenced, currentTime, grace)
+}
+
+// PlanPopulate works out what PopulateFn would do with opts without writing to
+// Valkey: the data keys of the new release, its manifest, and the keys cleanup
+// would remove once it is stored
+func (v *Valkey) PlanPopulate(opts impl.PopulateOptions) (impl.Plan, error) {
+	currentTime := time.Now().Unix()
+	prefix := opts.Prefix
+	plan := impl.NewPlan(prefix, currentTime)
+
+	excluded, err := opts.Filter.ExcludedPaths(opts.SourceFS())
+	if err != nil {
+		return impl.Plan{}, err
+	}
+	plan.Excluded = excluded
+	fileSystem := impl.FilterFS(opts.SourceFS(), opts.Filter)
+	files, _, err := impl.ProcessFilesWithTypes(fileSystem, 1, v.contentTypes, func(file impl.FileInfo) error {
+		return nil
+	})
+	if err != nil {
+		return impl.Plan{}, err
+	}
+	variants, _, err := impl.ProcessVariants(fileSystem, files, opts.Precompress, 1, func(file impl.FileInfo) error {
+		return nil
+	})
+	if err != nil {
+		return impl.Plan{}, err
+	}
+	files = append(files, variants...)
+
+	cacheList, err := v.GetKeys(prefix)
+	if err != nil {
+		return impl.Plan{}, err
+	}
+	stamps, err := v.ManifestTimestamps(prefix)
+	if err != nil {
+		return impl.Plan{}, err
+	}
+	for _, file := range files {
+		plan.Uploads = append(plan.Uploads, impl.PlannedChange{Action: impl.ActionUpload, Key: makeDataKey(prefix, file.Path, currentTime), Size: file.Size})
+		cacheList[prefix][file.Path] = append(cacheList[prefix][file.Path], currentTime)
+	}
+	plan.Manifests = append(plan.Manifests, impl.PlannedChange{Action: impl.ActionWrite, Key: makeManifestKey(prefix, currentTime)})
+
+	deleteItems, manifests := expiredKeys(prefix, cacheList, append(stamps, currentTime), v.protected, currentTime, opts.Timeout, opts.MinAssetRecords)
+	filenames := slices.Sorted(maps.Keys(deleteItems[prefix]))
+	for _, filename := range filenames {
+		for _, timestamp := range deleteItems[prefix][filename] {
+			plan.Deletes = append(plan.Deletes, impl.PlannedChange{Action: impl.ActionDelete, Key: makeDataKey(prefix, filename, timestamp)})
+		}
+	}
+	for _, manifest := range manifests {
+		plan.Deletes = append(plan.Deletes, impl.PlannedChange{Action: impl.ActionDelete, Key: manifest.Key})
+	}
+	return plan, nil
 }
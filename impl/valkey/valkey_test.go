@@ -0,0 +1,147 @@
+package valkey_test
+
+import (
+	"errors"
+	"testing/fstest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/RedHatInsights/valpop/impl"
+	"github.com/RedHatInsights/valpop/impl/valkey"
+)
+
+var _ = Describe("Valkey", func() {
+	Context("ParseLockKey", func() {
+		DescribeTable("should split lock keys",
+			func(key, namespace string, timestamp int64, ok bool) {
+				gotNamespace, gotTimestamp, gotOK := valkey.ParseLockKey(key)
+				Expect(gotOK).To(Equal(ok))
+				Expect(gotNamespace).To(Equal(namespace))
+				Expect(gotTimestamp).To(Equal(timestamp))
+			},
+			Entry("release lock", "lock:myapp:1000", "myapp", int64(1000), true),
+			Entry("namespace with a colon", "lock:myapp:admin:1000", "myapp:admin", int64(1000), true),
+			Entry("gc lock", "lock:myapp:0", "myapp", int64(0), true),
+			Entry("missing timestamp", "lock:myapp", "", int64(0), false),
+			Entry("invalid timestamp", "lock:myapp:latest", "", int64(0), false),
+		)
+	})
+
+	Context("ExpiredKeys", func() {
+		cacheList := func() impl.AllItems {
+			return impl.AllItems{"myapp": impl.Items{
+				"index.html":    {1000, 3000, 2000},
+				"app.js":        {1000},
+				"fed-mods.json": {1000},
+			}}
+		}
+
+		It("should keep the newest versions of each file and expire older ones past the timeout", func() {
+			deleteItems, manifests := valkey.ExpiredKeys("myapp", cacheList(), []int64{1000, 2000, 3000}, impl.DefaultProtectedFiles, 5000, 30, 2)
+
+			Expect(deleteItems["myapp"]).To(Equal(impl.Items{"index.html": {1000}}))
+			Expect(manifests).To(HaveLen(1))
+			Expect(manifests[0].Key).To(Equal("manifest:myapp:1000"))
+		})
+
+		It("should keep versions younger than the timeout", func() {
+			deleteItems, manifests := valkey.ExpiredKeys("myapp", cacheList(), []int64{1000, 2000, 3000}, impl.DefaultProtectedFiles, 2500, 1000, 1)
+
+			Expect(deleteItems["myapp"]).To(Equal(impl.Items{"index.html": {1000}}))
+			Expect(manifests).To(ConsistOf(impl.ManifestInfo{Key: "manifest:myapp:1000", Timestamp: 1000}))
+		})
+
+		It("should keep the newest version of protected files without minimum records", func() {
+			deleteItems, _ := valkey.ExpiredKeys("myapp", cacheList(), []int64{3000}, impl.DefaultProtectedFiles, 5000, 30, 0)
+
+			Expect(deleteItems["myapp"]).To(HaveKey("app.js"))
+			Expect(deleteItems["myapp"]).ToNot(HaveKey("fed-mods.json"))
+			Expect(deleteItems["myapp"]["index.html"]).To(Equal([]int64{3000, 2000, 1000}))
+		})
+	})
+
+	Context("FindOrphans", func() {
+		cacheList := impl.AllItems{"myapp": impl.Items{
+			"index.html":    {1000, 2000, 4900},
+			"app.js":        {1000},
+			"fed-mods.json": {500},
+		}}
+		kept := map[int64][]string{2000: {"index.html"}}
+
+		It("should return data keys no kept manifest lists, past the grace period", func() {
+			orphans := valkey.FindOrphans("myapp", cacheList, kept, nil, impl.DefaultProtectedFiles, 5000, 3600)
+
+			Expect(orphans).To(Equal([]impl.StoredKey{
+				{Key: "data:myapp:1000:app.js", Modified: 1000},
+				{Key: "data:myapp:1000:index.html", Modified: 1000},
+			}))
+		})
+
+		It("should skip keys gc already deletes", func() {
+			orphans := valkey.FindOrphans("myapp", cacheList, kept, []string{"data:myapp:1000:app.js"}, impl.DefaultProtectedFiles, 5000, 3600)
+
+			Expect(orphans).To(HaveLen(1))
+			Expect(orphans[0].Key).To(Equal("data:myapp:1000:index.html"))
+		})
+	})
+
+	Context("ConflictingLock", func() {
+		now := int64(5000)
+		gcLock := impl.Lock{Prefix: "myapp", Timestamp: valkey.GCLockTimestamp, Owner: "gc", Expires: 6000}
+		populateLock := impl.Lock{Prefix: "myapp", Timestamp: 4000, Owner: "populate", Expires: 6000}
+		staleLock := impl.Lock{Prefix: "myapp", Timestamp: 3000, Owner: "crashed"}
+
+		It("should keep populates from starting while gc runs", func() {
+			Expect(valkey.ConflictingLock([]impl.Lock{gcLock}, 4500, now)).To(Equal(&gcLock))
+		})
+
+		It("should keep gc from starting while a populate runs", func() {
+			Expect(valkey.ConflictingLock([]impl.Lock{gcLock, staleLock, populateLock}, valkey.GCLockTimestamp, now)).To(Equal(&populateLock))
+		})
+
+		It("should let populates run side by side and ignore stale locks", func() {
+			Expect(valkey.ConflictingLock([]impl.Lock{populateLock}, 4500, now)).To(BeNil())
+			Expect(valkey.ConflictingLock([]impl.Lock{gcLock, staleLock}, valkey.GCLockTimestamp, now)).To(BeNil())
+		})
+	})
+
+	Context("ReleaseItems", func() {
+		// Release 1000 stores index.html, 2000 adds new.js, and the rollback to
+		// 1000 at 3000 copies index.html back; 4000 is a crashed populate
+		keys := impl.Items{
+			"index.html": {1000, 2000, 3000, 4000},
+			"new.js":     {2000},
+		}
+
+		It("should not serve files added after the release a rollback restored", func() {
+			Expect(valkey.ReleaseItems(keys, 3000, []string{"index.html"})).To(Equal(impl.Items{
+				"index.html": {3000},
+			}))
+		})
+
+		It("should serve the files of an older release", func() {
+			Expect(valkey.ReleaseItems(keys, 2000, []string{"index.html", "new.js"})).To(Equal(impl.Items{
+				"index.html": {2000},
+				"new.js":     {2000},
+			}))
+		})
+
+		It("should serve the newest version of every file without a manifest", func() {
+			Expect(valkey.ReleaseItems(keys, 0, nil)).To(Equal(impl.Items{
+				"index.html": {4000},
+				"new.js":     {2000},
+			}))
+		})
+	})
+
+	Context("PopulateFromDir", func() {
+		It("should stop storing files once the lease is lost", func() {
+			lost := errors.New("lock lock:myapp:1000 was lost: the lease expired, raise --lock-lease")
+			files := fstest.MapFS{"index.html": {Data: []byte("<html></html>")}}
+
+			_, err := valkey.PopulateFromDir(valkey.LostLease("myapp", 1000, lost), "myapp", "", files, 1000, impl.PrecompressOptions{})
+			Expect(err).To(MatchError(lost))
+		})
+	})
+})
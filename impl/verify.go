@@ -0,0 +1,103 @@
+package impl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Verify problem kinds reported for a manifest entry
+const (
+	ProblemMissing      = "missing"
+	ProblemSizeMismatch = "size-mismatch"
+	ProblemHashMismatch = "hash-mismatch"
+)
+
+// StoredObject is what a backend knows about a stored data key
+// SHA256 is empty when the backend cannot tell without reading the object
+type StoredObject struct {
+	Size   int64
+	SHA256 string
+}
+
+// VerifyProblem describes one manifest entry that does not match storage
+type VerifyProblem struct {
+	Path     string `json:"path"`
+	Problem  string `json:"problem"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+}
+
+// VerifyReport is the result of checking a release against its manifest
+type VerifyReport struct {
+	Prefix          string          `json:"prefix"`
+	Timestamp       int64           `json:"timestamp"`
+	Image           string          `json:"image"`
+	ManifestVersion int             `json:"manifestVersion"`
+	Checked         int             `json:"checked"`
+	Problems        []VerifyProblem `json:"problems"`
+}
+
+// OK reports whether every file of the release is present and intact
+func (r VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r VerifyReport) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Verified %s:%d (image: %s, manifest v%d): %d files checked, %d problems\n", r.Prefix, r.Timestamp, r.Image, r.ManifestVersion, r.Checked, len(r.Problems))
+	for _, problem := range r.Problems {
+		if problem.Expected == "" {
+			fmt.Fprintf(&sb, "  %s: %s\n", problem.Problem, problem.Path)
+			continue
+		}
+		fmt.Fprintf(&sb, "  %s: %s (expected %s, got %s)\n", problem.Problem, problem.Path, problem.Expected, problem.Actual)
+	}
+	return sb.String()
+}
+
+// VerifyManifest checks every entry of manifest using stat, which looks up the
+// stored data key for an entry. Sizes are only compared for versioned manifests,
+// since legacy ones never recorded them, and hashes only when both sides have one
+func VerifyManifest(prefix string, manifest Manifest, stat func(entry FileEntry) (StoredObject, bool, error)) (VerifyReport, error) {
+	report := VerifyReport{
+		Prefix:          prefix,
+		Timestamp:       manifest.Timestamp,
+		Image:           manifest.Image,
+		ManifestVersion: manifest.Version,
+		Problems:        []VerifyProblem{},
+	}
+
+	entries := manifest.Entries
+	if len(entries) == 0 {
+		// Manifests built in memory from a file list carry no entries yet
+		entries = legacyEntries(manifest.Files)
+	}
+
+	for _, entry := range entries {
+		stored, found, err := stat(entry)
+		if err != nil {
+			return report, fmt.Errorf("could not check %s: %w", entry.Path, err)
+		}
+		report.Checked++
+
+		switch {
+		case !found:
+			report.Problems = append(report.Problems, VerifyProblem{Path: entry.Path, Problem: ProblemMissing})
+		case manifest.Version >= 2 && stored.Size != entry.Size:
+			report.Problems = append(report.Problems, VerifyProblem{
+				Path:     entry.Path,
+				Problem:  ProblemSizeMismatch,
+				Expected: fmt.Sprintf("%d", entry.Size),
+				Actual:   fmt.Sprintf("%d", stored.Size),
+			})
+		case entry.SHA256 != "" && stored.SHA256 != "" && stored.SHA256 != entry.SHA256:
+			report.Problems = append(report.Problems, VerifyProblem{
+				Path:     entry.Path,
+				Problem:  ProblemHashMismatch,
+				Expected: entry.SHA256,
+				Actual:   stored.SHA256,
+			})
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,93 @@
+package impl_test
+
+import (
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/RedHatInsights/valpop/impl"
+)
+
+var _ = Describe("VerifyManifest", func() {
+	var stored map[string]impl.StoredObject
+
+	stat := func(entry impl.FileEntry) (impl.StoredObject, bool, error) {
+		object, found := stored[entry.Path]
+		return object, found, nil
+	}
+
+	manifest := impl.Manifest{
+		Version:   2,
+		Image:     "myapp:v2",
+		Timestamp: 1742472000,
+		Entries: []impl.FileEntry{
+			{Path: "index.html", Size: 13, SHA256: "aaa"},
+			{Path: "app.js", Size: 42, SHA256: "bbb"},
+			{Path: "style.css", Size: 7, SHA256: "ccc"},
+		},
+	}
+
+	BeforeEach(func() {
+		stored = map[string]impl.StoredObject{
+			"index.html": {Size: 13, SHA256: "aaa"},
+			"app.js":     {Size: 42, SHA256: "bbb"},
+			"style.css":  {Size: 7, SHA256: "ccc"},
+		}
+	})
+
+	It("should pass a complete release", func() {
+		report, err := impl.VerifyManifest("myapp", manifest, stat)
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(report.OK()).To(BeTrue())
+		Expect(report.Checked).To(Equal(3))
+		Expect(report.Timestamp).To(Equal(int64(1742472000)))
+		Expect(report.ManifestVersion).To(Equal(2))
+	})
+
+	It("should report missing, truncated and corrupt files", func() {
+		delete(stored, "index.html")
+		stored["app.js"] = impl.StoredObject{Size: 20, SHA256: "bbb"}
+		stored["style.css"] = impl.StoredObject{Size: 7, SHA256: "zzz"}
+
+		report, err := impl.VerifyManifest("myapp", manifest, stat)
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(report.OK()).To(BeFalse())
+		Expect(report.Problems).To(Equal([]impl.VerifyProblem{
+			{Path: "index.html", Problem: impl.ProblemMissing},
+			{Path: "app.js", Problem: impl.ProblemSizeMismatch, Expected: "42", Actual: "20"},
+			{Path: "style.css", Problem: impl.ProblemHashMismatch, Expected: "ccc", Actual: "zzz"},
+		}))
+		Expect(report.String()).To(ContainSubstring("3 files checked, 3 problems"))
+		Expect(report.String()).To(ContainSubstring("missing: index.html"))
+	})
+
+	It("should only check presence for legacy manifests", func() {
+		legacy, err := impl.ParseManifest([]byte(`["index.html", "app.js", "gone.js"]`))
+		Expect(err).ToNot(HaveOccurred())
+
+		report, err := impl.VerifyManifest("myapp", legacy, stat)
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(report.Problems).To(Equal([]impl.VerifyProblem{{Path: "gone.js", Problem: impl.ProblemMissing}}))
+	})
+
+	It("should skip the hash check when storage has no hash", func() {
+		stored["app.js"] = impl.StoredObject{Size: 42}
+
+		report, err := impl.VerifyManifest("myapp", manifest, stat)
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(report.OK()).To(BeTrue())
+	})
+
+	It("should stop on storage errors", func() {
+		_, err := impl.VerifyManifest("myapp", manifest, func(entry impl.FileEntry) (impl.StoredObject, bool, error) {
+			return impl.StoredObject{}, false, fmt.Errorf("connection reset")
+		})
+
+		Expect(err).To(MatchError(ContainSubstring("could not check index.html: connection reset")))
+	})
+})